@@ -49,32 +49,40 @@ func (cmd *connectCmd) Synopsis() string {
 }
 
 func (cmd *connectCmd) Usage() string {
-	return `Usage: nbd connect -addr <addr> [-unix]
+	return `Usage: nbd connect [<uri>]
 
-Connect a server to an NBD device node.
+Connect a server to an NBD device node. The server is identified by an NBD
+URI, like nbd://localhost/disk or nbd+unix:///disk?socket=/run/nbd.sock. If no
+URI is given, it is constructed from -addr, -unix and -export.
 `
 }
 
 func (cmd *connectCmd) SetFlags(fs *flag.FlagSet) {
 	fs.StringVar(&cmd.export, "export", "", "Export to use. If not provided, the default is used")
-	fs.StringVar(&cmd.addr, "addr", "localhost:10809", "Address to listen on")
-	fs.BoolVar(&cmd.unix, "unix", false, "Serve on a unix domain socket")
+	fs.StringVar(&cmd.addr, "addr", "localhost:10809", "Address to connect to")
+	fs.BoolVar(&cmd.unix, "unix", false, "Connect to a unix domain socket")
 }
 
 func (cmd *connectCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if fs.NArg() != 0 {
+	if fs.NArg() > 1 {
 		log.Print(cmd.Usage())
 		return subcommands.ExitUsageError
 	}
 
-	network := "tcp"
-	if cmd.unix {
-		network = "unix"
+	u, err := cmd.uri(fs)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitUsageError
 	}
+	if u.TLS {
+		log.Println("TLS is not supported by the kernel NBD client")
+		return subcommands.ExitFailure
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	c, err := new(net.Dialer).DialContext(ctx, network, cmd.addr)
+	c, err := u.DialContext(ctx)
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
@@ -101,7 +109,7 @@ func (cmd *connectCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...inter
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	exp, err := cl.Go("")
+	exp, err := cl.Go(u.Export)
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
@@ -114,3 +122,19 @@ func (cmd *connectCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...inter
 	fmt.Printf("/dev/nbd%d\n", n)
 	return subcommands.ExitSuccess
 }
+
+// uri returns the URI given on the command line or, if there is none, the one
+// described by the flags.
+func (cmd *connectCmd) uri(fs *flag.FlagSet) (*nbd.URI, error) {
+	if fs.NArg() == 1 {
+		return nbd.ParseURI(fs.Arg(0))
+	}
+	if cmd.unix {
+		return &nbd.URI{Socket: cmd.addr, Export: cmd.export}, nil
+	}
+	host, port, err := net.SplitHostPort(cmd.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &nbd.URI{Host: host, Port: port, Export: cmd.export}, nil
+}
@@ -0,0 +1,303 @@
+//go:build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/fault"
+	"github.com/Merovius/nbd/history"
+	"github.com/Merovius/nbd/writelog"
+)
+
+// controller serves the control socket of nbd lo and nbd serve. Only dev and
+// snaps are required, commands needing other fields fail if they are nil.
+type controller struct {
+	dev        nbd.Device
+	device     string
+	snaps      *nbd.SnapshotDevice
+	history    *history.Device
+	log        *writelog.Device
+	crash      *crashable
+	faults     *faultSwitch
+	stats      *statsDevice
+	disconnect func()
+}
+
+// listen listens on a unix socket at path and serves it in a new goroutine.
+func (c *controller) listen(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	go c.serve(l)
+	log.Printf("Control socket listening on %s", path)
+	return l, nil
+}
+
+// serve accepts connections on l, until it is closed.
+func (c *controller) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go c.handleConn(conn)
+	}
+}
+
+// handleConn handles requests on conn, until it is closed.
+func (c *controller) handleConn(conn net.Conn) {
+	defer conn.Close()
+	dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+	for {
+		var req ctlRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		resp, err := c.handle(req)
+		if err != nil {
+			resp = &ctlResponse{Error: err.Error()}
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// errUnsupported is returned for commands not supported by a controller.
+var errUnsupported = errors.New("command not supported")
+
+func (c *controller) handle(req ctlRequest) (*ctlResponse, error) {
+	switch req.Cmd {
+	case "status":
+		resp := &ctlResponse{
+			Device:    c.device,
+			Snapshots: c.snaps.Snapshots(),
+		}
+		if c.history != nil {
+			resp.Seq = c.history.Seq()
+		}
+		if c.crash != nil {
+			resp.Crashed = c.crash.isCrashed()
+		}
+		if c.faults != nil {
+			if f := c.faults.get(); f != nil {
+				resp.Faults, resp.Injected = true, f.Injected()
+			}
+		}
+		return resp, nil
+	case "stats":
+		if c.stats == nil {
+			return nil, errors.New("not collecting statistics")
+		}
+		return &ctlResponse{Stats: c.stats.get()}, nil
+	case "crash", "uncrash":
+		if c.crash == nil {
+			return nil, errUnsupported
+		}
+		c.crash.setCrashed(req.Cmd == "crash")
+		log.Printf("Control: device is %s", map[bool]string{true: "read-only", false: "read-write"}[req.Cmd == "crash"])
+	case "faults":
+		if c.faults == nil {
+			return nil, errUnsupported
+		}
+		var f *fault.Device
+		if req.Plan != nil {
+			p, err := fault.ParsePlan(bytes.NewReader(req.Plan))
+			if err != nil {
+				return nil, err
+			}
+			f = fault.New(c.faults.device, p, fault.WithLog(func(e fault.Event) { log.Println(e) }))
+			log.Printf("Control: injecting faults according to a plan with %d rules", len(p.Rules))
+		} else {
+			log.Println("Control: not injecting faults")
+		}
+		c.faults.set(f)
+	case "snapshot":
+		if err := c.snaps.Snapshot(req.Name); err != nil {
+			return nil, err
+		}
+		log.Printf("Control: took snapshot %q", req.Name)
+	case "restore":
+		// Restoring would change the device behind the back of the write
+		// log, so replaying it would produce a different image.
+		if c.log != nil {
+			return nil, errors.New("can not restore snapshots while recording a write log")
+		}
+		// Likewise, the history would not contain the previous versions of
+		// restored blocks.
+		if c.history != nil {
+			return nil, errors.New("can not restore snapshots while keeping the history")
+		}
+		if err := c.snaps.Restore(req.Name); err != nil {
+			return nil, err
+		}
+		log.Printf("Control: restored snapshot %q", req.Name)
+	case "commit":
+		if err := c.snaps.Commit(); err != nil {
+			return nil, err
+		}
+		log.Println("Control: committed all snapshots")
+	case "mark":
+		if c.log == nil {
+			return nil, errors.New("not recording a write log")
+		}
+		if err := c.log.Mark(req.Name); err != nil {
+			return nil, err
+		}
+		log.Printf("Control: marked %q in the write log", req.Name)
+	case "flush":
+		if err := c.dev.Sync(); err != nil {
+			return nil, err
+		}
+	case "disconnect":
+		if c.disconnect == nil {
+			return nil, errUnsupported
+		}
+		log.Println("Control: disconnecting")
+		c.disconnect()
+	default:
+		return nil, fmt.Errorf("unknown command %q", req.Cmd)
+	}
+	return &ctlResponse{}, nil
+}
+
+// faultSwitch is a device passing requests to a fault.Device, if one is set,
+// or to the underlying device.
+type faultSwitch struct {
+	device
+	f atomic.Pointer[fault.Device]
+}
+
+func (s *faultSwitch) get() *fault.Device {
+	return s.f.Load()
+}
+
+// set replaces the fault.Device, releasing requests hanging in the old one.
+func (s *faultSwitch) set(f *fault.Device) {
+	if old := s.f.Swap(f); old != nil {
+		old.Close()
+	}
+}
+
+func (s *faultSwitch) cur() device {
+	if f := s.f.Load(); f != nil {
+		return f
+	}
+	return s.device
+}
+
+func (s *faultSwitch) ReadAt(p []byte, off int64) (int, error) {
+	return s.cur().ReadAt(p, off)
+}
+
+func (s *faultSwitch) WriteAt(p []byte, off int64) (int, error) {
+	return s.cur().WriteAt(p, off)
+}
+
+func (s *faultSwitch) WriteFUA(p []byte, off int64) (int, error) {
+	return nbd.WriteFUA(s.cur(), p, off)
+}
+
+func (s *faultSwitch) Sync() error {
+	return s.cur().Sync()
+}
+
+func (s *faultSwitch) Trim(off, length int64) error {
+	return s.cur().Trim(off, length)
+}
+
+func (s *faultSwitch) WriteZeroes(off, length int64, punch bool) error {
+	return s.cur().WriteZeroes(off, length, punch)
+}
+
+func (s *faultSwitch) ReportExtents(off, length int64) ([]nbd.Extent, error) {
+	return s.cur().ReportExtents(off, length)
+}
+
+// statsDevice counts the requests to a device.
+type statsDevice struct {
+	device
+	reads, writes, trims, zeroes, flushes atomic.Int64
+	bytesRead, bytesWritten, errors       atomic.Int64
+}
+
+func (s *statsDevice) get() *ioStats {
+	return &ioStats{
+		Reads:        s.reads.Load(),
+		Writes:       s.writes.Load(),
+		Trims:        s.trims.Load(),
+		Zeroes:       s.zeroes.Load(),
+		Flushes:      s.flushes.Load(),
+		BytesRead:    s.bytesRead.Load(),
+		BytesWritten: s.bytesWritten.Load(),
+		Errors:       s.errors.Load(),
+	}
+}
+
+// count records err, if it is not nil or io.EOF.
+func (s *statsDevice) count(err error) error {
+	if err != nil && err != io.EOF {
+		s.errors.Add(1)
+	}
+	return err
+}
+
+func (s *statsDevice) ReadAt(p []byte, off int64) (int, error) {
+	s.reads.Add(1)
+	n, err := s.device.ReadAt(p, off)
+	s.bytesRead.Add(int64(n))
+	return n, s.count(err)
+}
+
+func (s *statsDevice) WriteAt(p []byte, off int64) (int, error) {
+	s.writes.Add(1)
+	n, err := s.device.WriteAt(p, off)
+	s.bytesWritten.Add(int64(n))
+	return n, s.count(err)
+}
+
+func (s *statsDevice) WriteFUA(p []byte, off int64) (int, error) {
+	s.writes.Add(1)
+	n, err := nbd.WriteFUA(s.device, p, off)
+	s.bytesWritten.Add(int64(n))
+	return n, s.count(err)
+}
+
+func (s *statsDevice) Sync() error {
+	s.flushes.Add(1)
+	return s.count(s.device.Sync())
+}
+
+func (s *statsDevice) Trim(off, length int64) error {
+	s.trims.Add(1)
+	return s.count(s.device.Trim(off, length))
+}
+
+func (s *statsDevice) WriteZeroes(off, length int64, punch bool) error {
+	s.zeroes.Add(1)
+	return s.count(s.device.WriteZeroes(off, length, punch))
+}
@@ -0,0 +1,350 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Merovius/nbd"
+	"github.com/google/subcommands"
+)
+
+func init() {
+	commands = append(commands, &copyCmd{})
+}
+
+type copyCmd struct {
+	connections int
+	requests    int
+	requestSize int
+	progress    bool
+}
+
+func (cmd *copyCmd) Name() string {
+	return "copy"
+}
+
+func (cmd *copyCmd) Synopsis() string {
+	return "copy between NBD exports, files and block devices"
+}
+
+func (cmd *copyCmd) Usage() string {
+	return `Usage: nbd copy [flags] <src> <dst>
+
+Copy the contents of src to dst. Both can be NBD URIs, like
+nbd://localhost/disk, or paths of files or block devices. A local src can also
+be a qcow2 or VMDK image, which is converted to raw. Holes in the source
+are skipped, if the destination is known to be zero, and written as zeroes
+otherwise. If dst is a regular file, it is truncated to the size of src.
+`
+}
+
+func (cmd *copyCmd) SetFlags(fs *flag.FlagSet) {
+	fs.IntVar(&cmd.connections, "connections", 4, "Number of connections to use per NBD server, if it supports multiple connections")
+	fs.IntVar(&cmd.requests, "requests", 16, "Number of requests in flight per connection")
+	fs.IntVar(&cmd.requestSize, "request-size", 1<<20, "Maximum size of a single request")
+	fs.BoolVar(&cmd.progress, "progress", false, "Print progress to stderr")
+}
+
+// copyDevice is a source or destination of a copy.
+type copyDevice interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// endpoint is one side of a copy. It consists of one or more connections to
+// the same device.
+type endpoint struct {
+	devs []copyDevice
+	size int64
+	// zero is set, if the device is known to read as all zeroes.
+	zero bool
+}
+
+func (e *endpoint) Close() error {
+	var err error
+	for _, d := range e.devs {
+		if e := d.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// isURI returns whether the argument s refers to an NBD URI, as opposed to a
+// path.
+func isURI(s string) bool {
+	return strings.Contains(s, "://")
+}
+
+// openURI connects to the NBD export identified by uri. If the server
+// supports it, up to n connections are opened.
+func openURI(ctx context.Context, uri string, n int) (*endpoint, error) {
+	c, err := nbd.Dial(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	e := &endpoint{devs: []copyDevice{c}, size: int64(c.Export().Size)}
+	if c.Export().Flags&nbd.FlagCanMulticonn == 0 {
+		return e, nil
+	}
+	for len(e.devs) < n {
+		c, err := nbd.Dial(ctx, uri)
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+		e.devs = append(e.devs, c)
+	}
+	return e, nil
+}
+
+// openSource opens the source of a copy.
+func openSource(ctx context.Context, src string, n int) (*endpoint, error) {
+	if isURI(src) {
+		return openURI(ctx, src, n)
+	}
+	img, err := openImage(src, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint{devs: []copyDevice{img}, size: img.size}, nil
+}
+
+// openDest opens the destination of a copy, which must be able to hold size
+// bytes.
+func openDest(ctx context.Context, dst string, n int, size int64) (*endpoint, error) {
+	var e *endpoint
+	if isURI(dst) {
+		var err error
+		if e, err = openURI(ctx, dst, n); err != nil {
+			return nil, err
+		}
+	} else {
+		f, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		e = &endpoint{devs: []copyDevice{fileDevice{f}}}
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			err = f.Truncate(0)
+			if err == nil {
+				err = f.Truncate(size)
+			}
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			e.size, e.zero = size, true
+		} else if e.size, err = f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if e.size < size {
+		e.Close()
+		return nil, fmt.Errorf("%s is too small: %d < %d bytes", dst, e.size, size)
+	}
+	return e, nil
+}
+
+func (cmd *copyCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() != 2 || cmd.connections < 1 || cmd.requests < 1 || cmd.requestSize < 512 {
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	src, err := openSource(ctx, fs.Arg(0), cmd.connections)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer src.Close()
+	dst, err := openDest(ctx, fs.Arg(1), cmd.connections, src.size)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	if err := cmd.copy(ctx, src, dst); err != nil {
+		dst.Close()
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := dst.Close(); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// chunk is a range of the source to copy. zero is set, if the range is known
+// to read as zeroes.
+type chunk struct {
+	off, length int64
+	zero        bool
+}
+
+// copy copies the contents of src to dst.
+func (cmd *copyCmd) copy(ctx context.Context, src, dst *endpoint) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		err  error
+		done atomic.Int64
+	)
+	fail := func(e error) {
+		once.Do(func() {
+			err = e
+			cancel()
+		})
+	}
+
+	chunks := make(chan chunk)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(chunks)
+		if e := cmd.chunks(ctx, src.devs[0], src.size, chunks); e != nil {
+			fail(e)
+		}
+	}()
+
+	workers := max(len(src.devs), len(dst.devs)) * cmd.requests
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(r, w copyDevice) {
+			defer wg.Done()
+			buf := make([]byte, cmd.requestSize)
+			for c := range chunks {
+				if e := copyChunk(r, w, dst.zero, c, buf[:c.length]); e != nil {
+					fail(e)
+					return
+				}
+				done.Add(c.length)
+			}
+		}(src.devs[i%len(src.devs)], dst.devs[i%len(dst.devs)])
+	}
+
+	if cmd.progress {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			t := time.NewTicker(time.Second)
+			defer t.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-t.C:
+					printProgress(done.Load(), src.size)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	for _, d := range dst.devs {
+		if err := d.Sync(); err != nil {
+			return err
+		}
+	}
+	if cmd.progress {
+		printProgress(done.Load(), src.size)
+		fmt.Fprintln(os.Stderr)
+	}
+	return nil
+}
+
+// chunks sends the range of size bytes of src to ch, split into chunks of at
+// most cmd.requestSize bytes. If src reports its extents, ranges reading as
+// zeroes are marked as such.
+func (cmd *copyCmd) chunks(ctx context.Context, src copyDevice, size int64, ch chan<- chunk) error {
+	r, ok := src.(nbd.ExtentReporter)
+	for off := int64(0); off < size; {
+		ext := []nbd.Extent{{Offset: uint64(off), Length: uint64(size - off)}}
+		if ok {
+			var err error
+			if ext, err = r.ReportExtents(off, size-off); err != nil {
+				return err
+			}
+			if len(ext) == 0 {
+				return fmt.Errorf("no extents reported at offset %d", off)
+			}
+		}
+		for _, x := range ext {
+			end := min(int64(x.Offset+x.Length), size)
+			zero := x.Flags&nbd.ExtentZero != 0
+			for ; off < end; off += int64(cmd.requestSize) {
+				c := chunk{off, min(end-off, int64(cmd.requestSize)), zero}
+				select {
+				case ch <- c:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			off = end
+		}
+	}
+	return nil
+}
+
+// copyChunk copies c from r to w, using buf as a buffer. Ranges reading as
+// zero are skipped, if w is known to be zero, or written using WriteZeroes.
+func copyChunk(r, w copyDevice, zeroed bool, c chunk, buf []byte) error {
+	if !c.zero {
+		if _, err := r.ReadAt(buf, c.off); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if !nbd.IsZero(buf) {
+			_, err := w.WriteAt(buf, c.off)
+			return err
+		}
+	}
+	if zeroed {
+		return nil
+	}
+	if z, ok := w.(nbd.ZeroWriter); ok {
+		return z.WriteZeroes(c.off, c.length, true)
+	}
+	clear(buf)
+	_, err := w.WriteAt(buf, c.off)
+	return err
+}
+
+func printProgress(done, total int64) {
+	pct := 100.0
+	if total > 0 {
+		pct = 100 * float64(done) / float64(total)
+	}
+	fmt.Fprintf(os.Stderr, "\r%d/%d bytes (%.1f%%)", done, total, pct)
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/Merovius/nbd/fault"
+	"github.com/google/subcommands"
+)
+
+func init() {
+	commands = append(commands, &ctlCmd{})
+}
+
+// ctlRequest is a request sent to the control socket of nbd lo.
+type ctlRequest struct {
+	Cmd  string `json:"cmd"`
+	Name string `json:"name,omitempty"`
+	// Plan is a fault plan, as parsed by fault.ParsePlan.
+	Plan json.RawMessage `json:"plan,omitempty"`
+}
+
+// ctlResponse is the response to a ctlRequest.
+type ctlResponse struct {
+	Error     string   `json:"error,omitempty"`
+	Device    string   `json:"device,omitempty"`
+	Crashed   bool     `json:"crashed,omitempty"`
+	Faults    bool     `json:"faults,omitempty"`
+	Injected  int      `json:"injected,omitempty"`
+	Snapshots []string `json:"snapshots,omitempty"`
+	Seq       uint64   `json:"seq,omitempty"`
+	Stats     *ioStats `json:"stats,omitempty"`
+}
+
+// ioStats are the I/O statistics of a device.
+type ioStats struct {
+	Reads        int64 `json:"reads"`
+	Writes       int64 `json:"writes"`
+	Trims        int64 `json:"trims"`
+	Zeroes       int64 `json:"zeroes"`
+	Flushes      int64 `json:"flushes"`
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+	Errors       int64 `json:"errors"`
+}
+
+type ctlCmd struct{}
+
+func (cmd *ctlCmd) Name() string {
+	return "ctl"
+}
+
+func (cmd *ctlCmd) Synopsis() string {
+	return "control a device provided by nbd lo or nbd serve"
+}
+
+func (cmd *ctlCmd) Usage() string {
+	return `Usage: nbd ctl <socket> <command> [<arg>]
+
+Send a command to the control socket of nbd lo or nbd serve (see their -control
+flag). nbd serve only supports status and the commands for snapshots and
+flushing. Commands are:
+
+	status            print the state of the device as JSON
+	stats             print I/O statistics as JSON
+	crash             fail all writes with EPERM
+	uncrash           accept writes again
+	faults [<plan>]   inject faults according to the JSON fault plan in the
+	                  given file or stop injecting faults, if none is given
+	snapshot <name>   take a snapshot of the device
+	restore <name>    roll the device back to a snapshot
+	commit            drop all snapshots, keeping the current contents
+	mark <name>       insert a mark into the write log (see nbd help log)
+	flush             flush the device
+	disconnect        disconnect the device and make nbd lo exit
+`
+}
+
+func (cmd *ctlCmd) SetFlags(fs *flag.FlagSet) {
+}
+
+func (cmd *ctlCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	req := ctlRequest{Cmd: fs.Arg(1)}
+	switch req.Cmd {
+	case "snapshot", "restore", "mark":
+		if fs.NArg() != 3 {
+			log.Print(cmd.Usage())
+			return subcommands.ExitUsageError
+		}
+		req.Name = fs.Arg(2)
+	case "faults":
+		if fs.NArg() == 3 {
+			b, err := os.ReadFile(fs.Arg(2))
+			if err != nil {
+				log.Println(err)
+				return subcommands.ExitFailure
+			}
+			if _, err := fault.ParsePlan(bytes.NewReader(b)); err != nil {
+				log.Printf("%s: %v", fs.Arg(2), err)
+				return subcommands.ExitFailure
+			}
+			req.Plan = b
+		}
+	default:
+		if fs.NArg() != 2 {
+			log.Print(cmd.Usage())
+			return subcommands.ExitUsageError
+		}
+	}
+	resp, err := control(ctx, fs.Arg(0), req)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if req.Cmd == "status" || req.Cmd == "stats" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if req.Cmd == "stats" {
+			enc.Encode(resp.Stats)
+		} else {
+			enc.Encode(resp)
+		}
+	}
+	return subcommands.ExitSuccess
+}
+
+// control sends req to the control socket at path and returns the response.
+func control(ctx context.Context, path string, req ctlRequest) (*ctlResponse, error) {
+	c, err := new(net.Dialer).DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if err := json.NewEncoder(c).Encode(req); err != nil {
+		return nil, err
+	}
+	resp := new(ctlResponse)
+	if err := json.NewDecoder(c).Decode(resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/qcow2"
+	"github.com/Merovius/nbd/vmdk"
+)
+
+// device is a Device supporting all optional interfaces.
+type device interface {
+	plainDevice
+	nbd.FUAWriter
+}
+
+// plainDevice is a device, which does not necessarily support FUA writes.
+type plainDevice interface {
+	nbd.Device
+	nbd.Trimmer
+	nbd.ZeroWriter
+	nbd.ExtentReporter
+}
+
+// syncFUA adds a WriteFUA method to a plainDevice, which syncs it after the
+// write.
+type syncFUA struct {
+	plainDevice
+}
+
+func (d syncFUA) WriteFUA(p []byte, off int64) (int, error) {
+	return nbd.WriteFUA(d.plainDevice, p, off)
+}
+
+// image is a disk image opened by openImage.
+type image struct {
+	device
+	io.Closer
+	size int64
+	// readOnly is set for formats which can only be read.
+	readOnly bool
+}
+
+// openImage opens the disk image at path. The format is detected from its
+// header, defaulting to raw. flag is passed to os.OpenFile and must be either
+// os.O_RDONLY or os.O_RDWR. Read-only formats are always opened read-only.
+func openImage(path string, flag int) (*image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	isQcow2, isVMDK := qcow2.IsImage(f), vmdk.IsImage(f)
+	f.Close()
+	switch {
+	case isQcow2:
+		img, err := qcow2.Open(path, flag)
+		if err != nil {
+			return nil, err
+		}
+		return &image{syncFUA{img}, img, img.Size(), false}, nil
+	case isVMDK:
+		img, err := vmdk.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &image{readOnlyDevice{img}, img, img.Size(), true}, nil
+	}
+	if f, err = os.OpenFile(path, flag, 0); err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &image{fileDevice{f}, f, size, false}, nil
+}
+
+// readOnlyDevice adds Trim, WriteZeroes and WriteFUA methods to a VMDK image,
+// which fail with EPERM.
+type readOnlyDevice struct {
+	*vmdk.Image
+}
+
+func (readOnlyDevice) Trim(off, length int64) error {
+	return nbd.EPERM
+}
+
+func (readOnlyDevice) WriteZeroes(off, length int64, punch bool) error {
+	return nbd.EPERM
+}
+
+func (readOnlyDevice) WriteFUA(p []byte, off int64) (int, error) {
+	return 0, nbd.EPERM
+}
+
+// fileDevice is a Device backed by a file or block device. It reports holes
+// and writes zeroes efficiently, where the platform supports it.
+type fileDevice struct {
+	*os.File
+}
+
+// ReportExtents implements nbd.ExtentReporter. It only returns a single
+// extent. If the platform or file system does not support finding holes, the
+// range is reported as allocated.
+func (f fileDevice) ReportExtents(off, length int64) ([]nbd.Extent, error) {
+	end := off + length
+	data, hole, err := seekData(f.File, off)
+	if err != nil {
+		return []nbd.Extent{{Offset: uint64(off), Length: uint64(length)}}, nil
+	}
+	if data > off {
+		return []nbd.Extent{{
+			Offset: uint64(off),
+			Length: uint64(min(data, end) - off),
+			Flags:  nbd.ExtentHole | nbd.ExtentZero,
+		}}, nil
+	}
+	return []nbd.Extent{{Offset: uint64(off), Length: uint64(min(hole, end) - off)}}, nil
+}
+
+// WriteZeroes implements nbd.ZeroWriter.
+func (f fileDevice) WriteZeroes(off, length int64, punch bool) error {
+	err := zeroRange(f.File, off, length, punch)
+	if !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+	return nbd.WriteZeroes(f.File, off, length, punch)
+}
+
+// WriteFUA implements nbd.FUAWriter, by syncing the file after the write.
+func (f fileDevice) WriteFUA(p []byte, off int64) (int, error) {
+	return nbd.WriteFUA(f.File, p, off)
+}
+
+// Trim implements nbd.Trimmer, by punching a hole, if supported.
+func (f fileDevice) Trim(off, length int64) error {
+	err := zeroRange(f.File, off, length, true)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	return err
+}
+
+// newOverlay returns a copy-on-write overlay of the given size on top of base.
+// spec is either "mem", to keep modifications in memory, or the path of a
+// sparse file to create for them. The file is removed by the returned
+// function, as its contents are meaningless without the overlay.
+func newOverlay(spec string, base nbd.Device, size int64) (*nbd.Overlay, func(), error) {
+	if spec == "mem" {
+		return nbd.NewOverlay(base, nbd.NewMemDevice(size), size), func() {}, nil
+	}
+	f, err := os.OpenFile(spec, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	done := func() {
+		f.Close()
+		os.Remove(spec)
+	}
+	if err := f.Truncate(size); err != nil {
+		done()
+		return nil, nil, err
+	}
+	return nbd.NewOverlay(base, fileDevice{f}, size), done, nil
+}
+
+// saveImage writes the contents of d to a new sparse file at path, skipping
+// ranges reading as zeroes.
+func saveImage(path string, d nbd.Device, size int64) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<20)
+	r, _ := d.(nbd.ExtentReporter)
+	for off := int64(0); off < size; {
+		ext := []nbd.Extent{{Offset: uint64(off), Length: uint64(size - off)}}
+		if r != nil {
+			if ext, err = r.ReportExtents(off, size-off); err != nil {
+				return err
+			}
+			if len(ext) == 0 {
+				return fmt.Errorf("no extents reported at offset %d", off)
+			}
+		}
+		for _, x := range ext {
+			end := min(int64(x.Offset+x.Length), size)
+			for ; x.Flags&nbd.ExtentZero == 0 && off < end; off += int64(len(buf)) {
+				b := buf[:min(end-off, int64(len(buf)))]
+				if _, err := d.ReadAt(b, off); err != nil && err != io.EOF {
+					return err
+				}
+				if nbd.IsZero(b) {
+					continue
+				}
+				if _, err := f.WriteAt(b, off); err != nil {
+					return err
+				}
+			}
+			off = end
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// seekData returns the start of the first data region at or after off and
+// the start of the hole following it. If there is no data after off, both are
+// the size of the file.
+func seekData(f *os.File, off int64) (data, hole int64, err error) {
+	data, err = unix.Seek(int(f.Fd()), off, unix.SEEK_DATA)
+	if errors.Is(err, unix.ENXIO) {
+		data, err = f.Seek(0, os.SEEK_END)
+		return data, data, err
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	hole, err = unix.Seek(int(f.Fd()), data, unix.SEEK_HOLE)
+	return data, hole, err
+}
+
+// zeroRange sets the range of length bytes at off of f to zero, deallocating
+// it, if punch is true. It returns errors.ErrUnsupported, if f does not
+// support this.
+func zeroRange(f *os.File, off, length int64, punch bool) error {
+	mode := uint32(unix.FALLOC_FL_ZERO_RANGE | unix.FALLOC_FL_KEEP_SIZE)
+	if punch {
+		mode = unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE
+	}
+	err := unix.Fallocate(int(f.Fd()), mode, off, length)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return errors.ErrUnsupported
+	}
+	return err
+}
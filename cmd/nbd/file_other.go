@@ -0,0 +1,30 @@
+//go:build !linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func seekData(f *os.File, off int64) (data, hole int64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
+
+func zeroRange(f *os.File, off, length int64, punch bool) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	commands = append(commands, &infoCmd{})
+}
+
+type infoCmd struct {
+	json bool
+}
+
+func (cmd *infoCmd) Name() string {
+	return "info"
+}
+
+func (cmd *infoCmd) Synopsis() string {
+	return "show information about an export of an NBD server"
+}
+
+func (cmd *infoCmd) Usage() string {
+	return `Usage: nbd info [-json] <uri>
+
+Show the size, transmission flags, block size constraints and available
+metadata contexts of the export identified by the given NBD URI.
+`
+}
+
+func (cmd *infoCmd) SetFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.json, "json", false, "Print output as JSON")
+}
+
+// transmissionFlags are the names of the transmission flags, as given in the
+// protocol specification, indexed by bit.
+var transmissionFlags = []string{
+	"HAS_FLAGS",
+	"READ_ONLY",
+	"SEND_FLUSH",
+	"SEND_FUA",
+	"ROTATIONAL",
+	"SEND_TRIM",
+	"SEND_WRITE_ZEROES",
+	"SEND_DF",
+	"CAN_MULTI_CONN",
+	"SEND_RESIZE",
+	"SEND_CACHE",
+	"SEND_FAST_ZERO",
+	"BLOCK_STAT_PAYLOAD",
+}
+
+// flagNames returns the names of the transmission flags set in f.
+func flagNames(f uint16) []string {
+	names := []string{}
+	for i := 0; i < 16; i++ {
+		if f&(1<<i) == 0 {
+			continue
+		}
+		if i < len(transmissionFlags) {
+			names = append(names, transmissionFlags[i])
+		} else {
+			names = append(names, fmt.Sprintf("0x%x", 1<<i))
+		}
+	}
+	return names
+}
+
+func (cmd *infoCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() != 1 {
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cl, u, done, err := handshake(ctx, fs.Arg(0))
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer done()
+
+	exp, err := cl.Info(u.Export)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	meta, err := cl.ListMetaContexts(u.Export)
+	if err != nil {
+		log.Printf("listing metadata contexts: %v", err)
+	}
+	cl.Abort()
+
+	type blockSizes struct {
+		Min       uint32 `json:"min"`
+		Preferred uint32 `json:"preferred"`
+		Max       uint32 `json:"max"`
+	}
+	out := struct {
+		Name         string      `json:"name"`
+		Description  string      `json:"description,omitempty"`
+		Size         uint64      `json:"size"`
+		Flags        uint16      `json:"flags"`
+		FlagNames    []string    `json:"flag_names"`
+		BlockSizes   *blockSizes `json:"block_sizes,omitempty"`
+		MetaContexts []string    `json:"meta_contexts"`
+	}{
+		Name:         exp.Name,
+		Description:  exp.Description,
+		Size:         exp.Size,
+		Flags:        exp.Flags,
+		FlagNames:    flagNames(exp.Flags),
+		MetaContexts: append([]string{}, meta...),
+	}
+	if bs := exp.BlockSizes; bs != nil {
+		out.BlockSizes = &blockSizes{bs.Min, bs.Preferred, bs.Max}
+	}
+
+	if cmd.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(out); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "Export:\t%s\n", out.Name)
+	if out.Description != "" {
+		fmt.Fprintf(w, "Description:\t%s\n", out.Description)
+	}
+	fmt.Fprintf(w, "Size:\t%d\n", out.Size)
+	fmt.Fprintf(w, "Flags:\t0x%04x %s\n", out.Flags, strings.Join(out.FlagNames, " "))
+	if bs := out.BlockSizes; bs != nil {
+		fmt.Fprintf(w, "Block sizes:\tmin %d, preferred %d, max %d\n", bs.Min, bs.Preferred, bs.Max)
+	}
+	for i, m := range out.MetaContexts {
+		label := ""
+		if i == 0 {
+			label = "Metadata contexts:"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", label, m)
+	}
+	w.Flush()
+	return subcommands.ExitSuccess
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -26,6 +27,8 @@ import (
 	"syscall"
 
 	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/fault"
+	"github.com/Merovius/nbd/writelog"
 	"github.com/google/subcommands"
 	"golang.org/x/sys/unix"
 )
@@ -34,7 +37,14 @@ func init() {
 	commands = append(commands, &loCmd{})
 }
 
-type loCmd struct{}
+type loCmd struct {
+	mem      sizeFlag
+	overlay  string
+	faults   string
+	control  string
+	log      string
+	throttle throttleFlags
+}
 
 func (cmd *loCmd) Name() string {
 	return "lo"
@@ -46,9 +56,20 @@ func (cmd *loCmd) Synopsis() string {
 
 func (cmd *loCmd) Usage() string {
 	return `Usage: nbd lo <file>
+       nbd lo -mem <size>
 
 Provide file locally as a block device. An NBD device node will be chosen automatically and the path of that device printed to stdout.
 
+The file can be a raw image, a qcow2 image or a sparse VMDK image, which is
+detected from its header. VMDK images are read-only.
+
+With -mem, a sparse in-memory device of the given size is provided instead of
+a file. Its contents are lost when nbd lo exits.
+
+With -overlay, the file is opened read-only and writes go to a copy-on-write
+overlay instead, which is discarded on exit. The overlay is either kept in
+memory ("mem") or in a newly created sparse file at the given path.
+
 As a special feature, you can toggle write-only mode by sending a SIGUSR1. In
 write-only mode, all write-requests are denied with a EPERM. This is useful for
 testing crash-resilience of an application on a given filesystem. You can
@@ -56,49 +77,178 @@ create a virtual block device with a filesystem of your choice and have the
 application under test write to it. When you want to simulate a crash, you send
 a SIGUSR1 and unmount the device. You then send another SIGUSR1 and remount the
 filesystem to check whether invariants of the application survived the "crash".
-`
+
+With -control, nbd lo listens on a unix socket for commands, which can be sent
+with nbd ctl. They allow crashing the device without signals, changing the
+fault plan, reading I/O statistics, taking and restoring snapshots, flushing and
+disconnecting the device. Changes made after a snapshot is taken are kept in
+memory, until the snapshots are committed. See nbd help ctl for details.
+
+With -faults, errors, delays and hangs are injected into requests according to
+a JSON fault plan, like
+
+	{"rules": [
+		{"op": "write", "after": 999, "count": 1, "error": "ENOSPC"},
+		{"op": "read", "offset": 0, "length": 65536, "error": "EIO"},
+		{"op": "flush", "from": "10s", "delay": "2s"}
+	]}
+
+Rules match on "op" (read, write, trim, zero or flush), the range given by
+"offset" and "length", and the time since the start given by "from" and
+"until". The first "after" matching requests are let through and the rule fires
+at most "count" times, each time with the given "probability". The first firing
+rule applies its "delay", "hang" and "error". Rules can also silently corrupt
+data, by flipping "flip" random bits of reads or writes, by dropping writes and
+flushes ("drop") or by adding "misdirect" to the offset of writes. Random
+decisions are derived from the "seed" of the plan. Every injected fault is
+logged.
+
+With -log, all writes, trims, zeroes and flushes are recorded in the given file,
+similar to dm-log-writes. Marks can be inserted into the log with nbd ctl, to
+replay the log up to a given point later, using nbd log replay. Snapshots can
+not be restored while recording a log.
+
+` + throttleUsage
 }
 
-func (cmd *loCmd) SetFlags(fs *flag.FlagSet) {}
+func (cmd *loCmd) SetFlags(fs *flag.FlagSet) {
+	fs.Var(&cmd.mem, "mem", "Provide an in-memory device of the given size (like 512M or 2G), instead of a file")
+	fs.StringVar(&cmd.overlay, "overlay", "", "Write changes to a copy-on-write overlay: \"mem\" or the path of a file to create")
+	fs.StringVar(&cmd.faults, "faults", "", "Inject faults according to the JSON fault plan in the given file")
+	fs.StringVar(&cmd.control, "control", "", "Listen for commands from nbd ctl on a unix socket at the given path")
+	fs.StringVar(&cmd.log, "log", "", "Record all modifications in a write log at the given path")
+	cmd.throttle.register(fs)
+}
 
 func (cmd *loCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if fs.NArg() != 1 {
+	if (cmd.mem == 0) != (fs.NArg() == 1) || fs.NArg() > 1 {
 		log.Print(cmd.Usage())
 		return subcommands.ExitUsageError
 	}
 
-	f, err := os.OpenFile(fs.Arg(0), os.O_RDWR, 0)
-	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
+	var (
+		dev  device
+		size int64
+	)
+	if cmd.mem != 0 {
+		dev, size = syncFUA{nbd.NewMemDevice(int64(cmd.mem))}, int64(cmd.mem)
+	} else {
+		mode := os.O_RDWR
+		if cmd.overlay != "" {
+			mode = os.O_RDONLY
+		}
+		img, err := openImage(fs.Arg(0), mode)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		defer img.Close()
+		if img.readOnly && cmd.overlay == "" {
+			log.Println("Image is read-only, use -overlay to make it writable")
+		}
+		dev, size = img.device, img.size
 	}
-	defer f.Close()
+	if cmd.overlay != "" {
+		o, done, err := newOverlay(cmd.overlay, dev, size)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		defer done()
+		dev = syncFUA{o}
+	}
+	log.Println(size)
 
-	fi, err := f.Stat()
+	snaps := nbd.NewSnapshotDevice(dev, size)
+	var (
+		top device = syncFUA{snaps}
+		wl  *writelog.Device
+	)
+	if cmd.log != "" {
+		f, err := os.OpenFile(cmd.log, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		defer f.Close()
+		if wl, err = writelog.New(snaps, size, f); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		defer func() {
+			if err := wl.Close(); err != nil {
+				log.Println(err)
+			}
+		}()
+		top = wl
+	}
+	c := &crashable{device: top}
+	slow, err := cmd.throttle.device(c)
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	log.Println(fi.Size())
-
-	d := &crashable{Device: f}
-	ch := make(chan os.Signal)
+	faults := &faultSwitch{device: c}
+	if slow != nil {
+		faults.device = slow
+	}
+	stats := &statsDevice{device: faults}
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, unix.SIGUSR1)
 	go func() {
 		for range ch {
-			d.toggleCrash()
+			c.toggleCrash()
 		}
 	}()
 
 	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if cmd.faults != "" {
+		f, err := loadFaults(cmd.faults, faults.device)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		faults.set(f)
+	}
+	// Release hanging and delayed requests on exit, so the device can be disconnected.
+	go func() {
+		<-ctx.Done()
+		faults.set(nil)
+		if slow != nil {
+			slow.Close()
+		}
+	}()
 
-	idx, wait, err := nbd.Loopback(ctx, d, uint64(fi.Size()))
+	idx, wait, err := nbd.Loopback(ctx, stats, uint64(size))
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
 	log.Printf("Connected to /dev/nbd%d", idx)
+	if cmd.control != "" {
+		ctl := &controller{
+			dev:        stats,
+			device:     fmt.Sprintf("/dev/nbd%d", idx),
+			snaps:      snaps,
+			log:        wl,
+			crash:      c,
+			faults:     faults,
+			stats:      stats,
+			disconnect: cancel,
+		}
+		l, err := ctl.listen(cmd.control)
+		if err != nil {
+			log.Println(err)
+			cancel()
+			wait()
+			return subcommands.ExitFailure
+		}
+		defer l.Close()
+	}
 	if err := wait(); err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
@@ -106,8 +256,23 @@ func (cmd *loCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{
 	return subcommands.ExitSuccess
 }
 
+// loadFaults returns a fault.Device on top of d, using the plan in the given
+// file.
+func loadFaults(path string, d nbd.Device) (*fault.Device, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := fault.ParsePlan(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fault.New(d, p, fault.WithLog(func(e fault.Event) { log.Println(e) })), nil
+}
+
 type crashable struct {
-	nbd.Device
+	device
 	crashed uint32
 }
 
@@ -119,9 +284,42 @@ func (c *crashable) toggleCrash() {
 	}
 }
 
+func (c *crashable) setCrashed(crashed bool) {
+	var v uint32
+	if crashed {
+		v = 1 << 31
+	}
+	atomic.StoreUint32(&c.crashed, v)
+}
+
+func (c *crashable) isCrashed() bool {
+	return atomic.LoadUint32(&c.crashed) != 0
+}
+
 func (c *crashable) WriteAt(p []byte, offset int64) (n int, err error) {
 	if atomic.LoadUint32(&c.crashed) != 0 {
 		return 0, nbd.Errorf(nbd.EPERM, "write-only")
 	}
-	return c.Device.WriteAt(p, offset)
+	return c.device.WriteAt(p, offset)
+}
+
+func (c *crashable) WriteFUA(p []byte, offset int64) (n int, err error) {
+	if atomic.LoadUint32(&c.crashed) != 0 {
+		return 0, nbd.Errorf(nbd.EPERM, "write-only")
+	}
+	return nbd.WriteFUA(c.device, p, offset)
+}
+
+func (c *crashable) Trim(off, length int64) error {
+	if atomic.LoadUint32(&c.crashed) != 0 {
+		return nbd.Errorf(nbd.EPERM, "write-only")
+	}
+	return c.device.Trim(off, length)
+}
+
+func (c *crashable) WriteZeroes(off, length int64, punch bool) error {
+	if atomic.LoadUint32(&c.crashed) != 0 {
+		return nbd.Errorf(nbd.EPERM, "write-only")
+	}
+	return c.device.WriteZeroes(off, length, punch)
 }
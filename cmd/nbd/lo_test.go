@@ -0,0 +1,58 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/fault"
+	"github.com/Merovius/nbd/writelog"
+)
+
+func TestLoFUA(t *testing.T) {
+	var buf bytes.Buffer
+	wl, err := writelog.New(nbd.NewMemDevice(1<<20), 1<<20, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &crashable{device: wl}
+	faults := &faultSwitch{device: c}
+	faults.set(fault.New(c, fault.Plan{}))
+	stats := &statsDevice{device: faults}
+
+	if _, err := stats.WriteFUA([]byte("hello"), 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := wl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := writelog.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []writelog.Entry
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != 1 || got[0].Type != writelog.Write || !got[0].FUA {
+		t.Errorf("FUA write was logged as %v, want a single write with FUA", got)
+	}
+	if n := stats.get().Writes; n != 1 {
+		t.Errorf("stats counted %d writes, want 1", n)
+	}
+
+	c.setCrashed(true)
+	if _, err := stats.WriteFUA([]byte("hello"), 4096); err == nil {
+		t.Error("FUA write to crashed device succeeded")
+	}
+}
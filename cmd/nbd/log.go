@@ -0,0 +1,165 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+
+	"github.com/Merovius/nbd/writelog"
+	"github.com/google/subcommands"
+)
+
+func init() {
+	commands = append(commands, &logCmd{})
+}
+
+type logCmd struct{}
+
+func (cmd *logCmd) Name() string {
+	return "log"
+}
+
+func (cmd *logCmd) Synopsis() string {
+	return "inspect and replay write logs"
+}
+
+func (cmd *logCmd) Usage() string {
+	return `Usage: nbd log dump <log>
+       nbd log replay [-until <mark>] [-entries <n>] <log> <image>
+
+Inspect or replay a write log, as recorded by nbd lo -log.
+
+dump prints all entries of the log.
+
+replay applies the entries of the log to an image, to reconstruct the device
+at any point of the log. The image should have the contents the device had
+when recording started. If it does not exist, an empty raw image is created.
+With -until, the log is replayed up to and including the given mark. With
+-entries, at most the given number of entries are replayed.
+`
+}
+
+func (cmd *logCmd) SetFlags(fs *flag.FlagSet) {
+}
+
+func (cmd *logCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() < 1 {
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	var err error
+	switch fs.Arg(0) {
+	case "dump":
+		if fs.NArg() != 2 {
+			log.Print(cmd.Usage())
+			return subcommands.ExitUsageError
+		}
+		err = dumpLog(fs.Arg(1))
+	case "replay":
+		rfs := flag.NewFlagSet("replay", flag.ContinueOnError)
+		until := rfs.String("until", "", "Replay up to and including the given mark")
+		entries := rfs.Int("entries", -1, "Replay at most the given number of entries")
+		if rfs.Parse(fs.Args()[1:]) != nil || rfs.NArg() != 2 {
+			log.Print(cmd.Usage())
+			return subcommands.ExitUsageError
+		}
+		err = replayLog(rfs.Arg(0), rfs.Arg(1), *until, *entries)
+	default:
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func openLog(path string) (*writelog.Reader, io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := writelog.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, f, nil
+}
+
+func dumpLog(path string) error {
+	r, c, err := openLog(path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	fmt.Printf("size %d\n", r.Size())
+	for i := 0; ; i++ {
+		e, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		fmt.Printf("%d\t%v\n", i, e)
+	}
+}
+
+func replayLog(path, target, until string, entries int) error {
+	r, c, err := openLog(path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := os.Stat(target); errors.Is(err, fs.ErrNotExist) {
+		f, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(r.Size())
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+	}
+	img, err := openImage(target, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if img.readOnly {
+		return fmt.Errorf("%s is read-only", target)
+	}
+	if img.size < r.Size() {
+		return fmt.Errorf("%s is smaller than the logged device (%d < %d bytes)", target, img.size, r.Size())
+	}
+	n, err := writelog.Replay(img, r, until, entries)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replayed %d entries", n)
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+func init() {
+	commands = append(commands, &lsCmd{})
+}
+
+type lsCmd struct {
+	json bool
+}
+
+func (cmd *lsCmd) Name() string {
+	return "ls"
+}
+
+func (cmd *lsCmd) Synopsis() string {
+	return "list the exports of an NBD server"
+}
+
+func (cmd *lsCmd) Usage() string {
+	return `Usage: nbd ls [-json] <uri>
+
+List the exports of the NBD server identified by the given NBD URI (the export
+name of the URI is ignored), with their descriptions.
+`
+}
+
+func (cmd *lsCmd) SetFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.json, "json", false, "Print output as JSON")
+}
+
+func (cmd *lsCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() != 1 {
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cl, _, done, err := handshake(ctx, fs.Arg(0))
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer done()
+
+	exp, err := cl.Exports()
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	cl.Abort()
+
+	if cmd.json {
+		type export struct {
+			Name        string `json:"name"`
+			Description string `json:"description,omitempty"`
+		}
+		out := []export{}
+		for _, e := range exp {
+			out = append(out, export{e.Name, e.Description})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(out); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "Export\tDescription\n")
+	for _, e := range exp {
+		fmt.Fprintf(w, "%s\t%s\n", e.Name, e.Description)
+	}
+	w.Flush()
+	return subcommands.ExitSuccess
+}
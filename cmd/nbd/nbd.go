@@ -17,8 +17,10 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/google/subcommands"
 )
@@ -70,3 +72,28 @@ func (f *indexFlag) Set(s string) error {
 	f.val = uint32(v)
 	return nil
 }
+
+// sizeFlag is a size in bytes, optionally using one of the binary suffixes K,
+// M, G or T.
+type sizeFlag int64
+
+func (f *sizeFlag) String() string {
+	return strconv.FormatInt(int64(*f), 10)
+}
+
+func (f *sizeFlag) Set(s string) error {
+	shift := 0
+	if i := strings.IndexAny(s, "KMGTkmgt"); i >= 0 && i == len(s)-1 {
+		shift = 10 * (1 + strings.IndexByte("KMGT", s[i]&^0x20))
+		s = s[:i]
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	if v < 0 || v > (1<<63-1)>>shift {
+		return fmt.Errorf("size %s out of range", s)
+	}
+	*f = sizeFlag(v << shift)
+	return nil
+}
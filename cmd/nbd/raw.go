@@ -0,0 +1,273 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/Merovius/nbd"
+	"github.com/google/subcommands"
+)
+
+func init() {
+	commands = append(commands,
+		&readCmd{},
+		&writeCmd{},
+		&opCmd{
+			name:     "flush",
+			synopsis: "flush the write cache of an NBD export",
+			usage: `Usage: nbd flush <uri>
+
+Send a flush request to the export identified by the given NBD URI.
+`,
+			op: func(c *nbd.Conn, _, _ int64, _ bool) error {
+				if c.Export().Flags&nbd.FlagSendFlush == 0 {
+					return errors.New("server does not support flush")
+				}
+				return c.Sync()
+			},
+		},
+		&opCmd{
+			name:     "trim",
+			synopsis: "trim a range of an NBD export",
+			usage: `Usage: nbd trim [-offset <n>] [-length <n>] <uri>
+
+Send trim requests for a range of the export identified by the given NBD URI.
+By default, the range extends to the end of the export.
+`,
+			ranged: true,
+			op: func(c *nbd.Conn, off, length int64, _ bool) error {
+				if c.Export().Flags&nbd.FlagSendTrim == 0 {
+					return errors.New("server does not support trim")
+				}
+				return c.Trim(off, length)
+			},
+		},
+		&opCmd{
+			name:     "zero",
+			synopsis: "write zeroes to a range of an NBD export",
+			usage: `Usage: nbd zero [-offset <n>] [-length <n>] [-punch] <uri>
+
+Send write zeroes requests for a range of the export identified by the given
+NBD URI. By default, the range extends to the end of the export. If the server
+does not support write zeroes, buffers filled with zeroes are written instead.
+`,
+			ranged: true,
+			punch:  true,
+			op: func(c *nbd.Conn, off, length int64, punch bool) error {
+				return c.WriteZeroes(off, length, punch)
+			},
+		},
+	)
+}
+
+// dial connects to the export identified by uri, using the userspace client.
+func dial(ctx context.Context, uri string) (*nbd.Conn, error) {
+	if !isURI(uri) {
+		return nil, fmt.Errorf("invalid NBD URI %q", uri)
+	}
+	return nbd.Dial(ctx, uri)
+}
+
+// clampRange checks that off is inside the export and limits length to its
+// end. A negative length extends to the end of the export.
+func clampRange(c *nbd.Conn, off, length int64) (int64, error) {
+	size := int64(c.Export().Size)
+	if off < 0 || off > size {
+		return 0, fmt.Errorf("offset %d is out of range [0,%d]", off, size)
+	}
+	if length < 0 || length > size-off {
+		length = size - off
+	}
+	return length, nil
+}
+
+type readCmd struct {
+	offset int64
+	length int64
+	hex    bool
+}
+
+func (cmd *readCmd) Name() string {
+	return "read"
+}
+
+func (cmd *readCmd) Synopsis() string {
+	return "read bytes from an NBD export"
+}
+
+func (cmd *readCmd) Usage() string {
+	return `Usage: nbd read [-offset <n>] [-length <n>] [-hex] <uri>
+
+Read a range of the export identified by the given NBD URI and write it to
+stdout. By default, the range extends to the end of the export.
+`
+}
+
+func (cmd *readCmd) SetFlags(fs *flag.FlagSet) {
+	fs.Int64Var(&cmd.offset, "offset", 0, "Offset to start reading at")
+	fs.Int64Var(&cmd.length, "length", -1, "Number of bytes to read")
+	fs.BoolVar(&cmd.hex, "hex", false, "Print a hexdump instead of raw bytes")
+}
+
+func (cmd *readCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() != 1 {
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	c, err := dial(ctx, fs.Arg(0))
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer c.Close()
+	length, err := clampRange(c, cmd.offset, cmd.length)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	var w io.Writer = os.Stdout
+	if cmd.hex {
+		d := hex.Dumper(os.Stdout)
+		defer d.Close()
+		w = d
+	}
+	r := io.NewSectionReader(c, cmd.offset, length)
+	if _, err := io.CopyBuffer(w, r, make([]byte, 1<<20)); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+type writeCmd struct {
+	offset int64
+}
+
+func (cmd *writeCmd) Name() string {
+	return "write"
+}
+
+func (cmd *writeCmd) Synopsis() string {
+	return "write bytes from stdin to an NBD export"
+}
+
+func (cmd *writeCmd) Usage() string {
+	return `Usage: nbd write [-offset <n>] <uri>
+
+Write the data read from stdin to the export identified by the given NBD URI,
+starting at the given offset. The data is flushed afterwards.
+`
+}
+
+func (cmd *writeCmd) SetFlags(fs *flag.FlagSet) {
+	fs.Int64Var(&cmd.offset, "offset", 0, "Offset to start writing at")
+}
+
+func (cmd *writeCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() != 1 {
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	c, err := dial(ctx, fs.Arg(0))
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer c.Close()
+	if _, err := clampRange(c, cmd.offset, 0); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	w := io.NewOffsetWriter(c, cmd.offset)
+	if _, err := io.CopyBuffer(w, os.Stdin, make([]byte, 1<<20)); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := c.Sync(); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// opCmd is a subcommand sending a single kind of request to an export.
+type opCmd struct {
+	name     string
+	synopsis string
+	usage    string
+	// ranged is set, if the request applies to a range of the export.
+	ranged bool
+	// punch is set, if the command accepts the -punch flag.
+	punch bool
+	op    func(c *nbd.Conn, off, length int64, punch bool) error
+
+	offset   int64
+	length   int64
+	punchSet bool
+}
+
+func (cmd *opCmd) Name() string {
+	return cmd.name
+}
+
+func (cmd *opCmd) Synopsis() string {
+	return cmd.synopsis
+}
+
+func (cmd *opCmd) Usage() string {
+	return cmd.usage
+}
+
+func (cmd *opCmd) SetFlags(fs *flag.FlagSet) {
+	if cmd.ranged {
+		fs.Int64Var(&cmd.offset, "offset", 0, "Start of the range")
+		fs.Int64Var(&cmd.length, "length", -1, "Length of the range")
+	}
+	if cmd.punch {
+		fs.BoolVar(&cmd.punchSet, "punch", false, "Allow the server to deallocate the range")
+	}
+}
+
+func (cmd *opCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() != 1 {
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	c, err := dial(ctx, fs.Arg(0))
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer c.Close()
+	length, err := clampRange(c, cmd.offset, cmd.length)
+	if err == nil {
+		err = cmd.op(c, cmd.offset, length, cmd.punchSet)
+	}
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
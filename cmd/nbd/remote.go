@@ -0,0 +1,48 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/Merovius/nbd"
+)
+
+// handshake connects to the server identified by the NBD URI uri and starts
+// the handshake, upgrading the connection to TLS if requested. The returned
+// function closes the connection.
+func handshake(ctx context.Context, uri string) (*nbd.Client, *nbd.URI, func(), error) {
+	u, err := nbd.ParseURI(uri)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cfg, err := u.TLSConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	c, err := u.DialContext(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cl, err := nbd.ClientHandshake(ctx, c)
+	if err == nil && cfg != nil {
+		err = cl.StartTLS(cfg)
+	}
+	if err != nil {
+		c.Close()
+		return nil, nil, nil, err
+	}
+	return cl, u, func() { cl.NetConn().Close() }, nil
+}
@@ -19,11 +19,19 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/fat"
+	"github.com/Merovius/nbd/history"
+	"github.com/Merovius/nbd/partition"
 	"github.com/google/subcommands"
 )
 
@@ -32,8 +40,16 @@ func init() {
 }
 
 type serveCmd struct {
-	addr string
-	unix bool
+	addr      string
+	unix      bool
+	overlay   string
+	ephemeral bool
+	saveDir   string
+	parts     bool
+	fat       bool
+	control   string
+	history   bool
+	throttle  throttleFlags
 }
 
 func (cmd *serveCmd) Name() string {
@@ -46,14 +62,60 @@ func (cmd *serveCmd) Synopsis() string {
 
 func (cmd *serveCmd) Usage() string {
 	return `Usage: nbd serve <file>
+       nbd serve -fat <dir>
 
-Serve a file as over NBD as a block device.
-`
+Serve a file as over NBD as a block device. The file can be a raw image, a
+qcow2 image or a sparse VMDK image, which is detected from its header. VMDK
+images are exported read-only, unless -overlay or -ephemeral is used.
+
+With -fat, a read-only FAT32 image with the contents of the given directory is
+served instead. The image is generated on the fly, file contents are read from
+the directory when accessed. Symbolic links and special files are skipped.
+
+With -overlay, the file is opened read-only and writes go to a copy-on-write
+overlay instead, which is discarded on exit. The overlay is either kept in
+memory ("mem") or in a newly created sparse file at the given path.
+
+With -ephemeral, the file is opened read-only and every connection gets its own
+in-memory copy-on-write overlay, which is discarded when it disconnects. If
+-save-dir is given, clients can connect to the export <name>@<save> to have
+their modified image saved to <save> in that directory when they disconnect.
+
+With -partitions, the MBR or GPT partition table of the image is read and every
+partition is additionally exported as <name>/p<N>, numbered like Linux does. GPT
+partitions are also exported under their partition name or, if they have none,
+their unique GUID.
+
+With -control, nbd serve listens on a unix socket for commands, which can be
+sent with nbd ctl. They allow taking named snapshots of the served image while
+clients are connected, rolling back to a snapshot and committing all snapshots.
+Every snapshot is additionally exported read-only as <name>@<snapshot>. Changes
+made after a snapshot is taken are kept in memory, until the snapshots are
+committed. Clients should disconnect before rolling back, as they might have
+cached data which is no longer current.
+
+With -history, all versions of modified blocks are kept in memory, to be able to
+read the image as it was at any earlier point. Every write, trim and zero
+request gets a sequence number, starting at 1. The image as of sequence number
+<N> is exported read-only as <name>@<N>, where <name>@0 is the initial image.
+The current sequence number is shown by nbd ctl status. This is useful to
+bisect which write corrupted a filesystem. Snapshots can not be restored with
+-history.
+
+` + throttleUsage
 }
 
 func (cmd *serveCmd) SetFlags(fs *flag.FlagSet) {
 	fs.StringVar(&cmd.addr, "addr", "localhost:10809", "Address to listen on")
 	fs.BoolVar(&cmd.unix, "unix", false, "Serve on a unix domain socket")
+	fs.StringVar(&cmd.overlay, "overlay", "", "Write changes to a copy-on-write overlay: \"mem\" or the path of a file to create")
+	fs.BoolVar(&cmd.ephemeral, "ephemeral", false, "Give every connection its own copy-on-write overlay")
+	fs.StringVar(&cmd.saveDir, "save-dir", "", "Directory to save ephemeral overlays in, if requested by clients")
+	fs.BoolVar(&cmd.fat, "fat", false, "Serve a FAT32 image of a directory")
+	fs.BoolVar(&cmd.parts, "partitions", false, "Also export the partitions of the image")
+	fs.StringVar(&cmd.control, "control", "", "Listen for commands from nbd ctl on a unix socket at the given path")
+	fs.BoolVar(&cmd.history, "history", false, "Keep the history of the image and export it as of every write")
+	cmd.throttle.register(fs)
 }
 
 func (cmd *serveCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -62,33 +124,204 @@ func (cmd *serveCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interfa
 		return subcommands.ExitUsageError
 	}
 
-	f, err := os.OpenFile(fs.Arg(0), os.O_RDWR, 0)
-	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
+	mode := os.O_RDWR
+	if cmd.overlay != "" || cmd.ephemeral {
+		mode = os.O_RDONLY
 	}
-	defer f.Close()
-
-	fi, err := f.Stat()
+	var (
+		d        nbd.Device
+		size     int64
+		readOnly bool
+		bs       *nbd.BlockSizeConstraints
+	)
+	if cmd.fat {
+		im, err := fat.New(os.DirFS(fs.Arg(0)))
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		d, size, readOnly = im, im.Size(), true
+	} else {
+		img, err := openImage(fs.Arg(0), mode)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		defer img.Close()
+		d, size, readOnly = img, img.size, img.readOnly
+		if f, ok := img.device.(fileDevice); ok {
+			if fi, err := f.Stat(); err == nil {
+				bs = blockSize(fi)
+			}
+		}
+	}
+	if cmd.overlay != "" {
+		o, done, err := newOverlay(cmd.overlay, d, size)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		defer done()
+		d = o
+	}
+	var (
+		snaps *nbd.SnapshotDevice
+		hist  *history.Device
+	)
+	if cmd.control != "" {
+		snaps = nbd.NewSnapshotDevice(d, size)
+		d = snaps
+	}
+	if cmd.history {
+		hist = history.New(d, size)
+		d = hist
+	}
+	slow, err := cmd.throttle.device(d)
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
+	if cmd.control != "" {
+		ctl := &controller{dev: d, snaps: snaps, history: hist}
+		l, err := ctl.listen(cmd.control)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		defer l.Close()
+	}
+	if slow != nil {
+		d = slow
+	}
 	network := "tcp"
 	if cmd.unix {
 		network = "unix"
 	}
+	name := filepath.Base(fs.Arg(0))
+	if abs, err := filepath.Abs(fs.Arg(0)); err == nil {
+		name = filepath.Base(abs)
+	}
+	if u, err := listenURI(network, cmd.addr, name); err == nil {
+		log.Printf("Serving %s", u)
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if slow != nil {
+		// Stop delays on exit, so connections can be closed.
+		go func() {
+			<-ctx.Done()
+			slow.Close()
+		}()
+	}
 
-	err = nbd.ListenAndServe(ctx, network, cmd.addr, nbd.Export{
-		Name:        filepath.Base(fs.Arg(0)),
-		Description: "",
-		Size:        uint64(fi.Size()),
-		BlockSizes:  blockSize(fi),
-		Device:      f,
-	})
+	var flags uint16
+	if readOnly && cmd.overlay == "" && !cmd.ephemeral {
+		flags = nbd.FlagReadOnly
+	}
+	newExport := func(name, desc string, d nbd.Device, size int64) nbd.Export {
+		exp := nbd.Export{
+			Name:        name,
+			Description: desc,
+			Size:        uint64(size),
+			Flags:       flags,
+			BlockSizes:  bs,
+			Device:      d,
+			Ephemeral:   cmd.ephemeral,
+		}
+		if cmd.ephemeral && cmd.saveDir != "" {
+			exp.Save = func(name string, o *nbd.Overlay) error {
+				path := filepath.Join(cmd.saveDir, name)
+				var err error
+				if name != filepath.Base(name) || name == "." || name == ".." {
+					err = fmt.Errorf("invalid name %q", name)
+				} else {
+					err = saveImage(path, o, size)
+				}
+				if err != nil {
+					log.Printf("Saving %s: %v", path, err)
+					return err
+				}
+				log.Printf("Saved %s", path)
+				return nil
+			}
+		}
+		return exp
+	}
+	exps := []nbd.Export{newExport(name, "", d, size)}
+	exp := exps[0]
+	if snaps != nil {
+		exps[0].Views = func() []nbd.Export { return snaps.Exports(exp) }
+	}
+	if hist != nil {
+		exps[0].Lookup = func(suffix string) (nbd.Export, bool) { return hist.Lookup(exp, suffix) }
+	}
+	if cmd.parts {
+		pexps, err := partitionExports(name, d, size, newExport)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		exps = append(exps, pexps...)
+	}
+	err = nbd.ListenAndServe(ctx, network, cmd.addr, exps...)
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
 	return subcommands.ExitSuccess
 }
+
+// partitionExports reads the partition table of d and returns an export for
+// every partition, using newExport to create them.
+func partitionExports(name string, d nbd.Device, size int64, newExport func(name, desc string, d nbd.Device, size int64) nbd.Export) ([]nbd.Export, error) {
+	t, err := partition.Read(d, size)
+	if err != nil {
+		return nil, fmt.Errorf("reading partition table: %w", err)
+	}
+	// Only use partition names as aliases if they are unique and valid
+	// export names.
+	names := make(map[string]int)
+	for _, p := range t.Partitions {
+		names[p.Name]++
+	}
+	var exps []nbd.Export
+	for _, p := range t.Partitions {
+		desc := "type " + p.Type
+		if p.GUID != "" {
+			desc = fmt.Sprintf("%q, type %s, GUID %s", p.Name, p.Type, p.GUID)
+		}
+		pd := p.Device(d)
+		exps = append(exps, newExport(fmt.Sprintf("%s/p%d", name, p.Number), desc, pd, p.Size))
+		alias := p.Name
+		if alias == "" || names[alias] > 1 || strings.ContainsAny(alias, "/@") || strings.HasPrefix(alias, "p") && isNumber(alias[1:]) {
+			alias = p.GUID
+		}
+		if alias != "" {
+			exps = append(exps, newExport(name+"/"+alias, desc, pd, p.Size))
+		}
+		log.Printf("Partition %d: %s, %d bytes", p.Number, desc, p.Size)
+	}
+	return exps, nil
+}
+
+func isNumber(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// listenURI returns the URI clients can use to connect to the given export,
+// when listening on network and addr.
+func listenURI(network, addr, export string) (*nbd.URI, error) {
+	if network == "unix" {
+		addr, err := filepath.Abs(addr)
+		return &nbd.URI{Socket: addr, Export: export}, err
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if port == nbd.DefaultPort {
+		port = ""
+	}
+	return &nbd.URI{Host: host, Port: port, Export: export}, nil
+}
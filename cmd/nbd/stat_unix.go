@@ -18,13 +18,13 @@ package main
 
 import (
 	"os"
+	"syscall"
 
 	"github.com/Merovius/nbd"
-	"golang.org/x/sys/unix"
 )
 
 func blockSize(fi os.FileInfo) *nbd.BlockSizeConstraints {
-	if st, ok := fi.Sys().(*unix.Stat_t); ok {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
 		if st.Blksize > 0xffff {
 			return nil
 		}
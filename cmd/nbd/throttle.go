@@ -0,0 +1,73 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/throttle"
+)
+
+// throttleFlags are the flags configuring a throttle.Device.
+type throttleFlags struct {
+	latency   string
+	iops      int
+	bandwidth sizeFlag
+}
+
+// throttleUsage documents throttleFlags, for the usage of a command.
+const throttleUsage = `With -latency, requests are delayed by latencies drawn from a distribution. It
+is a comma-separated list of latencies, optionally prefixed by an operation
+(read, write, trim, zero or flush) to only apply to that, like
+
+	-latency 1ms,write=uniform:1ms:5ms,flush=lognormal:50ms:0.5
+
+A latency is either a fixed duration or one of uniform:<min>:<max>,
+lognormal:<median>:<sigma> or longtail:<min>:<alpha>, a Pareto distribution
+where the probability of exceeding k times the minimum is k^-alpha. With -iops
+and -bandwidth, the number of requests and the number of bytes read and
+written per second are limited. This can be used to reproduce timeouts and
+other slow-disk behavior.
+`
+
+func (f *throttleFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.latency, "latency", "", "Delay requests by the given latencies (like 5ms or flush=lognormal:50ms:0.5)")
+	fs.IntVar(&f.iops, "iops", 0, "Limit the number of requests per second")
+	fs.Var(&f.bandwidth, "bandwidth", "Limit the number of bytes read and written per second (like 10M)")
+}
+
+// device returns a throttle.Device on top of d, according to the flags. If
+// none are set, it returns nil.
+func (f *throttleFlags) device(d nbd.Device) (*throttle.Device, error) {
+	var opts []throttle.Option
+	if f.latency != "" {
+		o, err := throttle.ParseLatencies(f.latency)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, o)
+	}
+	if f.iops > 0 {
+		opts = append(opts, throttle.WithIOPS(f.iops, 0))
+	}
+	if f.bandwidth > 0 {
+		opts = append(opts, throttle.WithBandwidth(int64(f.bandwidth), 0))
+	}
+	if len(opts) == 0 {
+		return nil, nil
+	}
+	return throttle.New(d, opts...), nil
+}
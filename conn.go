@@ -0,0 +1,850 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Conn is the client side of an NBD connection in transmission phase. It
+// implements Device, so it can be used to access an export from userspace,
+// without involving the kernel. All methods are safe for concurrent use.
+// Concurrent requests are pipelined over the connection.
+type Conn struct {
+	dial func(context.Context) (net.Conn, error)
+	name string
+	opts connOptions
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	export Export
+	bs     BlockSizeConstraints
+
+	// wmu serializes writes to the connection. If both wmu and mu are held,
+	// wmu must be acquired first.
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	nc      net.Conn // nil while reconnecting
+	rw      io.ReadWriteCloser
+	meta    map[uint32]string
+	gen     uint64 // incremented on every reconnect
+	handle  uint64
+	pending map[uint64]*call
+	err     error // set, once c is permanently unusable
+}
+
+// call is an in-flight request. It stays in Conn.pending until a reply has
+// been received or its caller gives up, so it can be replayed if the
+// connection is lost.
+type call struct {
+	req  request
+	buf  []byte
+	meta string // metadata context, for block status requests
+	ext  []Extent
+	err  error
+	done chan struct{}
+}
+
+// ConnOption configures optional behavior of a Conn.
+type ConnOption func(*connOptions)
+
+type connOptions struct {
+	retries int
+	backoff time.Duration
+	tls     *tls.Config
+	meta    []string
+}
+
+// maxBackoff is the upper limit for the exponential backoff when
+// reconnecting.
+const maxBackoff = 30 * time.Second
+
+// WithReconnect makes a Conn reconnect to the server, if the connection is
+// lost. Up to retries attempts are made, waiting backoff before the first and
+// doubling that for each subsequent attempt. After reconnecting, all requests
+// which have not yet received a reply are sent again. If the export changed
+// its size in the meantime, the Conn fails permanently.
+func WithReconnect(retries int, backoff time.Duration) ConnOption {
+	return func(o *connOptions) {
+		o.retries = retries
+		o.backoff = backoff
+	}
+}
+
+// WithTLS makes a Conn upgrade the connection to TLS during the handshake,
+// using cfg.
+func WithTLS(cfg *tls.Config) ConnOption {
+	return func(o *connOptions) {
+		o.tls = cfg
+	}
+}
+
+// WithMetaContexts selects the given metadata contexts, in addition to
+// base:allocation, so they can be queried using Conn.Extents.
+func WithMetaContexts(names ...string) ConnOption {
+	return func(o *connOptions) {
+		o.meta = append(o.meta, names...)
+	}
+}
+
+// Open connects to an NBD server, using dial to establish a connection. It
+// performs the handshake and opens the export identified by exportName,
+// entering transmission phase. If exportName is the empty string, the default
+// export is used. The Conn stays usable until ctx is cancelled or Close is
+// called.
+func Open(ctx context.Context, dial func(context.Context) (net.Conn, error), exportName string, opts ...ConnOption) (*Conn, error) {
+	c := &Conn{
+		dial:    dial,
+		name:    exportName,
+		pending: make(map[uint64]*call),
+	}
+	for _, o := range opts {
+		o(&c.opts)
+	}
+	s, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.export = s.export
+	c.bs = s.export.BlockSizes.effective()
+	c.setConn(s)
+	return c, nil
+}
+
+// session is the result of a successful handshake.
+type session struct {
+	nc     net.Conn
+	export Export
+	// meta maps the IDs of the selected metadata contexts to their names.
+	meta map[uint32]string
+}
+
+// connect dials a new connection and does the handshake.
+func (c *Conn) connect(ctx context.Context) (session, error) {
+	nc, err := c.dial(ctx)
+	if err != nil {
+		return session{}, err
+	}
+	s := session{meta: make(map[uint32]string)}
+	structured := false
+	cl, err := ClientHandshake(ctx, nc)
+	if err == nil && c.opts.tls != nil {
+		err = cl.StartTLS(c.opts.tls)
+	}
+	if err == nil {
+		err = cl.StructuredReplies()
+		structured = err == nil
+		if isErrno(err, errUnsup) {
+			err = nil
+		}
+	}
+	if err == nil && structured {
+		var ids map[string]uint32
+		ids, err = cl.SetMetaContexts(c.name, append([]string{BaseAllocation}, c.opts.meta...)...)
+		if isErrno(err, errUnsup) {
+			err = nil
+		}
+		for name, id := range ids {
+			s.meta[id] = name
+		}
+	}
+	if err != nil {
+		cl.close()
+		nc.Close()
+		return session{}, err
+	}
+	s.nc = cl.NetConn()
+	s.export, err = cl.Go(c.name)
+	if err == nil {
+		// Closing the Client expires the deadline of nc, to interrupt pending
+		// operations.
+		err = s.nc.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		s.nc.Close()
+		return session{}, err
+	}
+	return s, nil
+}
+
+// setConn makes the connection of s the current one, starts receiving replies
+// on it and (re-)sends all pending requests.
+func (c *Conn) setConn(s session) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		s.nc.Close()
+		return
+	}
+	c.nc = s.nc
+	c.rw = wrapConn(c.ctx, s.nc)
+	c.meta = s.meta
+	c.gen++
+	gen, rw := c.gen, c.rw
+	var replay []*call
+	for _, cl := range c.pending {
+		replay = append(replay, cl)
+	}
+	c.mu.Unlock()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.recv(gen, rw, s.meta)
+	}()
+	for _, cl := range replay {
+		if err := writeRequest(rw, &cl.req); err != nil {
+			c.broken(gen, err)
+			return
+		}
+	}
+}
+
+// Export returns the export c is connected to.
+func (c *Conn) Export() Export {
+	return c.export
+}
+
+// BlockSizes returns the block size constraints honored by c. If the server
+// did not send any, the defaults from the protocol are used.
+func (c *Conn) BlockSizes() BlockSizeConstraints {
+	return c.bs
+}
+
+// span returns the range [start, end) of the next request needed to access n
+// bytes at off, respecting the block size constraints. If direct is false, the
+// range is a single block which only partially overlaps the requested range
+// and has to be accessed via a temporary buffer.
+func (c *Conn) span(off uint64, n int) (start, end uint64, direct bool) {
+	min, max := uint64(c.bs.Min), uint64(c.bs.Max)
+	start = off - off%min
+	if start != off || uint64(n) < min {
+		end = start + min
+		if end > c.export.Size {
+			end = c.export.Size
+		}
+		return start, end, false
+	}
+	end = off + uint64(n)
+	end -= end % min
+	if end-start > max {
+		end = start + max
+	}
+	return start, end, true
+}
+
+// ReadAt implements io.ReaderAt. Requests are split and aligned to honor the
+// block size constraints of the export.
+func (c *Conn) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, EINVAL
+	}
+	if uint64(off) >= c.export.Size {
+		return 0, io.EOF
+	}
+	if rem := c.export.Size - uint64(off); uint64(len(p)) > rem {
+		p, err = p[:rem], io.EOF
+	}
+	for n < len(p) {
+		o := uint64(off) + uint64(n)
+		start, end, direct := c.span(o, len(p)-n)
+		var b []byte
+		if direct {
+			b = p[n : n+int(end-start)]
+		} else {
+			b = make([]byte, end-start)
+		}
+		req := request{typ: cmdRead, offset: start, length: uint32(len(b))}
+		if e := c.do(req, b); e != nil {
+			if oe, ok := e.(*OffsetError); ok && oe.Offset > o {
+				n += copy(p[n:], b[o-start:oe.Offset-start])
+			}
+			return n, e
+		}
+		if direct {
+			n += len(b)
+		} else {
+			n += copy(p[n:], b[o-start:])
+		}
+	}
+	return n, err
+}
+
+// WriteAt implements io.WriterAt. Requests are split and aligned to honor the
+// block size constraints of the export. Unaligned writes are done by reading,
+// modifying and writing back the affected blocks. This is not atomic, so
+// concurrent unaligned writes to the same block can lose data.
+func (c *Conn) WriteAt(p []byte, off int64) (n int, err error) {
+	return c.writeAt(p, off, 0)
+}
+
+// WriteFUA implements FUAWriter. If the server does not support
+// NBD_CMD_FLAG_FUA, it calls WriteAt followed by Sync.
+func (c *Conn) WriteFUA(p []byte, off int64) (n int, err error) {
+	if c.export.Flags&FlagSendFUA == 0 {
+		if n, err = c.WriteAt(p, off); err != nil {
+			return n, err
+		}
+		return n, c.Sync()
+	}
+	return c.writeAt(p, off, cmdFlagFUA)
+}
+
+// writeAt implements WriteAt, passing flags with every write request.
+func (c *Conn) writeAt(p []byte, off int64, flags uint16) (n int, err error) {
+	if c.export.Flags&FlagReadOnly != 0 {
+		return 0, EPERM
+	}
+	if off < 0 {
+		return 0, EINVAL
+	}
+	if uint64(off)+uint64(len(p)) > c.export.Size {
+		return 0, ENOSPC
+	}
+	for n < len(p) {
+		o := uint64(off) + uint64(n)
+		start, end, direct := c.span(o, len(p)-n)
+		var (
+			b []byte
+			m int
+		)
+		if direct {
+			b = p[n : n+int(end-start)]
+			m = len(b)
+		} else {
+			b = make([]byte, end-start)
+			req := request{typ: cmdRead, offset: start, length: uint32(len(b))}
+			if err := c.do(req, b); err != nil {
+				return n, err
+			}
+			m = copy(b[o-start:], p[n:])
+		}
+		req := request{typ: cmdWrite, flags: flags, offset: start, length: uint32(len(b)), data: b}
+		if err := c.do(req, nil); err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// Sync sends a flush request to the server. It is a no-op, if the server
+// does not support flushing.
+func (c *Conn) Sync() error {
+	if c.export.Flags&FlagSendFlush == 0 {
+		return nil
+	}
+	return c.do(request{typ: cmdFlush}, nil)
+}
+
+// maxLength returns the largest length of a request without payload, that
+// honors the block size constraints.
+func (c *Conn) maxLength() uint64 {
+	return math.MaxUint32 - math.MaxUint32%uint64(c.bs.Min)
+}
+
+// Trim implements Trimmer. It is a no-op, if the server does not support
+// trimming.
+func (c *Conn) Trim(off, length int64) error {
+	if c.export.Flags&FlagSendTrim == 0 {
+		return nil
+	}
+	return c.ranges(request{typ: cmdTrim}, off, length)
+}
+
+// WriteZeroes implements ZeroWriter. If the server does not support
+// NBD_CMD_WRITE_ZEROES, buffers filled with zeroes are written instead.
+func (c *Conn) WriteZeroes(off, length int64, punch bool) error {
+	if c.export.Flags&FlagSendWriteZeroes == 0 {
+		// Wrap c, to hide its WriteZeroes method from WriteZeroes.
+		return WriteZeroes(struct{ Device }{c}, off, length, punch)
+	}
+	req := request{typ: cmdWriteZeroes}
+	if !punch {
+		req.flags |= cmdFlagNoHole
+	}
+	return c.ranges(req, off, length)
+}
+
+// ranges sends req for the range of length bytes at off, split into multiple
+// requests, if necessary.
+func (c *Conn) ranges(req request, off, length int64) error {
+	if c.export.Flags&FlagReadOnly != 0 {
+		return EPERM
+	}
+	if off < 0 || length < 0 {
+		return EINVAL
+	}
+	if uint64(off)+uint64(length) > c.export.Size {
+		return ENOSPC
+	}
+	for length > 0 {
+		n := min(uint64(length), c.maxLength())
+		req.offset, req.length = uint64(off), uint32(n)
+		if err := c.do(req, nil); err != nil {
+			return err
+		}
+		off, length = off+int64(n), length-int64(n)
+	}
+	return nil
+}
+
+// blockStatus queries the extents of the range of length bytes at off in the
+// given metadata context. If one is set, the server is asked to only return a
+// single extent.
+func (c *Conn) blockStatus(ctx context.Context, off, length uint64, meta string, one bool) ([]Extent, error) {
+	if !c.hasMetaContext(meta) {
+		return nil, fmt.Errorf("metadata context %q not selected", meta)
+	}
+	length = min(length, c.maxLength())
+	cl := &call{
+		req:  request{typ: cmdBlockStatus, offset: off, length: uint32(length)},
+		meta: meta,
+	}
+	if one {
+		cl.req.flags |= cmdFlagReqOne
+	}
+	if err := c.roundTrip(ctx, cl); err != nil {
+		return nil, err
+	}
+	if len(cl.ext) == 0 {
+		return nil, fmt.Errorf("server sent no extents for %s at %d", meta, off)
+	}
+	return cl.ext, nil
+}
+
+// Extents returns an iterator over the extents of the range of length bytes
+// at off, in the given metadata context. The context must have been selected
+// using WithMetaContexts, except for base:allocation, which is selected
+// automatically, if the server supports it. The extents are clipped to the
+// range. Iteration stops after the first error.
+func (c *Conn) Extents(ctx context.Context, off, length uint64, metaContext string) iter.Seq2[Extent, error] {
+	return func(yield func(Extent, error) bool) {
+		end := off + length
+		if end > c.export.Size || end < off {
+			end = c.export.Size
+		}
+		for off < end {
+			ext, err := c.blockStatus(ctx, off, end-off, metaContext, false)
+			if err != nil {
+				yield(Extent{}, err)
+				return
+			}
+			for _, x := range ext {
+				if x.Offset+x.Length > end {
+					x.Length = end - x.Offset
+				}
+				if !yield(x, nil) {
+					return
+				}
+				if off = x.Offset + x.Length; off >= end {
+					break
+				}
+			}
+		}
+	}
+}
+
+// Extent returns the extent starting at off in the given metadata context.
+// It asks the server for a single extent, which may be cheaper to compute
+// than a full range. See Extents for how to select metadata contexts.
+func (c *Conn) Extent(ctx context.Context, off uint64, metaContext string) (Extent, error) {
+	if off >= c.export.Size {
+		return Extent{}, io.EOF
+	}
+	ext, err := c.blockStatus(ctx, off, c.export.Size-off, metaContext, true)
+	if err != nil {
+		return Extent{}, err
+	}
+	return ext[0], nil
+}
+
+// ReportExtents implements ExtentReporter, using the base:allocation metadata
+// context. If the server does not support it, the range is reported as
+// allocated.
+func (c *Conn) ReportExtents(off, length int64) ([]Extent, error) {
+	if !c.hasMetaContext(BaseAllocation) {
+		return []Extent{{uint64(off), uint64(length), 0}}, nil
+	}
+	var out []Extent
+	for x, err := range c.Extents(c.ctx, uint64(off), uint64(length), BaseAllocation) {
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, x)
+	}
+	return out, nil
+}
+
+// hasMetaContext returns whether the given metadata context is selected.
+func (c *Conn) hasMetaContext(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.meta {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Close disconnects from the server. Any pending requests fail.
+func (c *Conn) Close() error {
+	c.wmu.Lock()
+	c.mu.Lock()
+	rw, nc := c.rw, c.nc
+	if c.err != nil {
+		nc = nil
+	}
+	c.failLocked(errors.New("use of closed connection"))
+	c.mu.Unlock()
+	var err error
+	if nc != nil {
+		err = writeRequest(rw, &request{typ: cmdDisc})
+		if e := nc.Close(); err == nil {
+			err = e
+		}
+	}
+	c.wmu.Unlock()
+	c.cancel()
+	c.wg.Wait()
+	return err
+}
+
+// do sends req and waits for the reply. For reads, the payload of the reply
+// is read into buf.
+func (c *Conn) do(req request, buf []byte) error {
+	return c.roundTrip(c.ctx, &call{req: req, buf: buf})
+}
+
+// roundTrip sends the request of cl and waits for the reply, or until ctx is
+// cancelled.
+func (c *Conn) roundTrip(ctx context.Context, cl *call) error {
+	cl.done = make(chan struct{})
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.handle++
+	cl.req.handle = c.handle
+	c.pending[cl.req.handle] = cl
+	gen := c.gen
+	c.mu.Unlock()
+
+	c.send(gen, cl)
+	select {
+	case <-cl.done:
+		return cl.err
+	case <-c.ctx.Done():
+		c.abandon(cl)
+		return c.ctx.Err()
+	case <-ctx.Done():
+		c.abandon(cl)
+		return ctx.Err()
+	}
+}
+
+// abandon removes cl from the pending calls, if it is still pending, so a late
+// reply is not read into the buffer of cl, which belongs to the caller again.
+func (c *Conn) abandon(cl *call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[cl.req.handle] == cl {
+		delete(c.pending, cl.req.handle)
+	}
+}
+
+// send writes the request of cl to the connection, if it is still generation
+// gen. Otherwise, cl was (or will be) replayed by setConn.
+func (c *Conn) send(gen uint64, cl *call) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	rw, ok := c.rw, c.gen == gen && c.nc != nil
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := writeRequest(rw, &cl.req); err != nil {
+		c.broken(gen, err)
+	}
+}
+
+// recv reads replies from rw, until an error occurs. meta maps the IDs of the
+// metadata contexts selected on the connection to their names.
+func (c *Conn) recv(gen uint64, rw io.ReadWriter, meta map[uint32]string) {
+	br := bufio.NewReader(rw)
+	err := do(struct {
+		io.Reader
+		io.Writer
+	}{br, rw}, func(e *encoder) {
+		// Errors and extents reported in structured reply chunks are
+		// collected, until the final chunk is received.
+		r := &chunks{meta, make(map[uint64]error), make(map[uint64][]Extent)}
+		for {
+			b, err := br.Peek(4)
+			e.check(err)
+			if binary.BigEndian.Uint32(b) == structuredReplyMagic {
+				c.recvChunk(e, r)
+				continue
+			}
+			var rep simpleReply
+			rep.decode(e)
+			cl := c.lookup(rep.handle)
+			if cl == nil {
+				e.check(fmt.Errorf("reply to unknown handle 0x%x", rep.handle))
+			}
+			if rep.errno != 0 {
+				c.finish(cl, Errno(rep.errno), nil)
+				continue
+			}
+			if cl.req.typ == cmdRead {
+				e.read(cl.buf)
+			}
+			c.finish(cl, nil, nil)
+		}
+	})
+	c.broken(gen, err)
+}
+
+// chunks collects the results from structured reply chunks of a connection.
+type chunks struct {
+	meta map[uint32]string
+	errs map[uint64]error
+	ext  map[uint64][]Extent
+}
+
+// recvChunk reads a structured reply chunk and applies it to the
+// corresponding call.
+func (c *Conn) recvChunk(e *encoder, r *chunks) {
+	var rep structuredReply
+	rep.decode(e)
+	cl := c.lookup(rep.handle)
+	if cl == nil {
+		e.check(fmt.Errorf("reply to unknown handle 0x%x", rep.handle))
+	}
+	// chunk returns the [start, end) range of the chunk payload relative to
+	// the request, checking that it is in bounds.
+	chunk := func(off uint64, n uint32) (start, end int) {
+		if off < cl.req.offset || off-cl.req.offset+uint64(n) > uint64(cl.req.length) {
+			e.check(fmt.Errorf("server sent chunk out of bounds of request"))
+		}
+		return int(off - cl.req.offset), int(off-cl.req.offset) + int(n)
+	}
+	switch {
+	case rep.typ == replyTypeNone:
+		if rep.length != 0 || rep.flags&replyFlagDone == 0 {
+			e.check(errors.New("invalid NONE chunk"))
+		}
+	case rep.typ == replyTypeOffsetData && cl.req.typ == cmdRead:
+		if rep.length < 8 {
+			e.check(errors.New("invalid OFFSET_DATA chunk"))
+		}
+		start, end := chunk(e.uint64(), rep.length-8)
+		e.read(cl.buf[start:end])
+	case rep.typ == replyTypeOffsetHole && cl.req.typ == cmdRead:
+		if rep.length != 12 {
+			e.check(errors.New("invalid OFFSET_HOLE chunk"))
+		}
+		off := e.uint64()
+		start, end := chunk(off, e.uint32())
+		for i := range cl.buf[start:end] {
+			cl.buf[start+i] = 0
+		}
+	case rep.typ == replyTypeBlockStatus && cl.req.typ == cmdBlockStatus:
+		if rep.length < 12 || (rep.length-4)%8 != 0 {
+			e.check(errors.New("invalid BLOCK_STATUS chunk"))
+		}
+		id := e.uint32()
+		off := cl.req.offset
+		var ext []Extent
+		for n := (rep.length - 4) / 8; n > 0; n-- {
+			x := Extent{Offset: off, Length: uint64(e.uint32()), Flags: e.uint32()}
+			if x.Length == 0 {
+				e.check(errors.New("server sent empty extent"))
+			}
+			ext = append(ext, x)
+			off += x.Length
+		}
+		if r.meta[id] == cl.meta {
+			r.ext[rep.handle] = ext
+		}
+	case rep.typ&(1<<15) != 0:
+		if rep.length < 6 {
+			e.check(errors.New("invalid error chunk"))
+		}
+		code := Errno(e.uint32())
+		n := e.uint16()
+		if uint32(n) > rep.length-6 {
+			e.check(errors.New("invalid error chunk"))
+		}
+		msg := make([]byte, n)
+		e.read(msg)
+		rest := rep.length - 6 - uint32(n)
+		prev := r.errs[rep.handle]
+		if rep.typ == replyTypeErrorOffset && rest == 8 {
+			off := e.uint64()
+			chunk(off, 0)
+			// Report the first error, so the caller knows how much data was
+			// read successfully.
+			if oe, ok := prev.(*OffsetError); prev == nil || (ok && off < oe.Offset) {
+				r.errs[rep.handle] = &OffsetError{code, off, string(msg)}
+			}
+		} else {
+			e.discard(rest)
+			if prev == nil && n == 0 {
+				r.errs[rep.handle] = code
+			} else if prev == nil {
+				r.errs[rep.handle] = Errorf(code, "%s", msg)
+			}
+		}
+	default:
+		e.discard(rep.length)
+	}
+	if rep.flags&replyFlagDone != 0 {
+		err, ext := r.errs[rep.handle], r.ext[rep.handle]
+		delete(r.errs, rep.handle)
+		delete(r.ext, rep.handle)
+		c.finish(cl, err, ext)
+	}
+}
+
+// lookup returns the pending call with the given handle, or nil.
+func (c *Conn) lookup(handle uint64) *call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pending[handle]
+}
+
+// finish removes cl from the pending calls and returns err and ext to its
+// caller.
+func (c *Conn) finish(cl *call, err error, ext []Extent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[cl.req.handle] != cl {
+		return
+	}
+	delete(c.pending, cl.req.handle)
+	cl.err = err
+	cl.ext = ext
+	close(cl.done)
+}
+
+// broken is called if an error occurs on the connection of generation gen. It
+// either starts reconnecting or fails c permanently.
+func (c *Conn) broken(gen uint64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.gen != gen || c.nc == nil {
+		return
+	}
+	c.nc.Close()
+	c.rw.Close()
+	c.nc, c.rw = nil, nil
+	if c.opts.retries <= 0 || c.ctx.Err() != nil {
+		c.failLocked(err)
+		return
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.reconnect(err)
+	}()
+}
+
+// reconnect tries to re-establish the connection. err is the error that
+// caused the connection to be lost.
+func (c *Conn) reconnect(err error) {
+	backoff := c.opts.backoff
+	for i := 0; i < c.opts.retries; i++ {
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-c.ctx.Done():
+			t.Stop()
+			c.fail(c.ctx.Err())
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		var s session
+		s, err = c.connect(c.ctx)
+		if err != nil {
+			continue
+		}
+		if s.export.Size != c.export.Size {
+			s.nc.Close()
+			c.fail(fmt.Errorf("export size changed from %d to %d after reconnect", c.export.Size, s.export.Size))
+			return
+		}
+		c.setConn(s)
+		return
+	}
+	c.fail(fmt.Errorf("giving up after %d reconnect attempts: %w", c.opts.retries, err))
+}
+
+// fail permanently fails c, with err returned from all pending and future
+// requests.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failLocked(err)
+}
+
+// failLocked is like fail, but expects c.mu to be held.
+func (c *Conn) failLocked(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for h, cl := range c.pending {
+		delete(c.pending, h)
+		cl.err = err
+		close(cl.done)
+	}
+}
+
+// writeRequest encodes req and writes it to w in a single call.
+func writeRequest(w io.ReadWriter, req *request) error {
+	return do(w, func(e *encoder) {
+		e.buf = []byte{}
+		req.encode(e)
+		buf := e.buf
+		e.buf = nil
+		e.write(buf)
+	})
+}
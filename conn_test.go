@@ -0,0 +1,585 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testDevice struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (d *testDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return copy(p, d.buf[off:]), nil
+}
+
+func (d *testDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return copy(d.buf[off:], p), nil
+}
+
+func (d *testDevice) Sync() error {
+	return nil
+}
+
+// testServer serves exp on a unix socket and returns a function to dial it.
+// All connections made with the returned function are recorded in conns.
+func testServer(t *testing.T, ctx context.Context, exp ...Export) (dial func(context.Context) (net.Conn, error), conns func() []net.Conn) {
+	sock := filepath.Join(t.TempDir(), "nbd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				Serve(ctx, c, exp...)
+				c.Close()
+			}()
+		}
+	}()
+	var (
+		mu sync.Mutex
+		cs []net.Conn
+	)
+	dial = func(ctx context.Context) (net.Conn, error) {
+		c, err := new(net.Dialer).DialContext(ctx, "unix", sock)
+		if err == nil {
+			mu.Lock()
+			cs = append(cs, c)
+			mu.Unlock()
+		}
+		return c, err
+	}
+	conns = func() []net.Conn {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]net.Conn(nil), cs...)
+	}
+	return dial, conns
+}
+
+func TestConnReadWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := NewMemDevice(1 << 20)
+	dial, _ := testServer(t, ctx, Export{
+		Name:   "test",
+		Size:   uint64(d.Size()),
+		Flags:  FlagHasFlags | FlagSendFlush,
+		Device: d,
+	})
+	c, err := Open(ctx, dial, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	want := bytes.Repeat([]byte("foobar"), 1000)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			if _, err := c.WriteAt(want, off); err != nil {
+				t.Errorf("WriteAt(%d) = %v", off, err)
+			}
+		}(int64(i) * 8192)
+	}
+	wg.Wait()
+	if err := c.Sync(); err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := c.ReadAt(got, 3*8192); err != nil {
+		t.Fatalf("ReadAt() = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("ReadAt returned different data than written")
+	}
+	if _, err := c.ReadAt(got, d.Size()-10); err == nil {
+		t.Fatal("ReadAt past the end succeeded")
+	}
+}
+
+func TestConnReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := NewMemDevice(1 << 20)
+	dial, conns := testServer(t, ctx, Export{
+		Size:   uint64(d.Size()),
+		Device: d,
+	})
+	c, err := Open(ctx, dial, "", WithReconnect(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	want := []byte("Hello, world!")
+	if _, err := c.WriteAt(want, 42); err != nil {
+		t.Fatal(err)
+	}
+	conns()[0].Close()
+
+	got := make([]byte, len(want))
+	if _, err := c.ReadAt(got, 42); err != nil {
+		t.Fatalf("ReadAt after connection loss: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ReadAt() = %q, want %q", got, want)
+	}
+	if n := len(conns()); n != 2 {
+		t.Fatalf("got %d connections, want 2", n)
+	}
+}
+
+func TestConnNoReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := NewMemDevice(4096)
+	dial, conns := testServer(t, ctx, Export{
+		Size:   uint64(d.Size()),
+		Device: d,
+	})
+	c, err := Open(ctx, dial, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conns()[0].Close()
+	if _, err := c.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Fatal("ReadAt on broken connection succeeded")
+	}
+}
+
+// alignedDevice fails all requests not aligned to bs.
+type alignedDevice struct {
+	testDevice
+	bs int64
+}
+
+func (d *alignedDevice) ReadAt(p []byte, off int64) (int, error) {
+	if off%d.bs != 0 || int64(len(p))%d.bs != 0 {
+		return 0, Errorf(EINVAL, "unaligned read of %d bytes at %d", len(p), off)
+	}
+	return d.testDevice.ReadAt(p, off)
+}
+
+func (d *alignedDevice) WriteAt(p []byte, off int64) (int, error) {
+	if off%d.bs != 0 || int64(len(p))%d.bs != 0 {
+		return 0, Errorf(EINVAL, "unaligned write of %d bytes at %d", len(p), off)
+	}
+	return d.testDevice.WriteAt(p, off)
+}
+
+func TestConnBlockSizes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &alignedDevice{testDevice{buf: make([]byte, 1<<20)}, 512}
+	dial, _ := testServer(t, ctx, Export{
+		Size:       uint64(len(d.buf)),
+		BlockSizes: &BlockSizeConstraints{Min: 512, Preferred: 4096, Max: 8192},
+		Device:     d,
+	})
+	c, err := Open(ctx, dial, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got, want := c.BlockSizes(), (BlockSizeConstraints{512, 4096, 8192}); got != want {
+		t.Fatalf("BlockSizes() = %v, want %v", got, want)
+	}
+
+	want := bytes.Repeat([]byte("0123456789"), 3000)
+	for _, off := range []int64{0, 1, 511, 512, 4097} {
+		if _, err := c.WriteAt(want, off); err != nil {
+			t.Fatalf("WriteAt(%d) = %v", off, err)
+		}
+		got := make([]byte, len(want))
+		if _, err := c.ReadAt(got, off); err != nil {
+			t.Fatalf("ReadAt(%d) = %v", off, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("ReadAt(%d) returned different data than written", off)
+		}
+	}
+	got := make([]byte, 3)
+	if _, err := c.ReadAt(got, 1); err != nil || string(got) != "012" {
+		t.Fatalf("ReadAt(1) = %q, %v, want %q, <nil>", got, err, "012")
+	}
+}
+
+func TestConnStructuredReplies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, client := net.Pipe()
+	defer server.Close()
+	go func() {
+		p, err := serverHandshake(server, []Export{{Size: 4096}})
+		if err != nil || !p.Structured {
+			t.Errorf("serverHandshake() = %+v, %v", p, err)
+			return
+		}
+		do(server, func(e *encoder) {
+			var req request
+			req.decode(e)
+			chunk := func(flags, typ uint16, data ...interface{}) {
+				var b bytes.Buffer
+				for _, v := range data {
+					binary.Write(&b, binary.BigEndian, v)
+				}
+				(&structuredReply{flags, typ, req.handle, uint32(b.Len()), b.Bytes()}).encode(e)
+			}
+			chunk(0, replyTypeOffsetData, uint64(0), bytes.Repeat([]byte{1}, 1024))
+			chunk(0, replyTypeErrorOffset, uint32(EIO), uint16(3), []byte("bad"), uint64(3072))
+			chunk(0, replyTypeOffsetHole, uint64(1024), uint32(1024))
+			chunk(0, replyTypeOffsetData, uint64(2048), bytes.Repeat([]byte{2}, 1024))
+			chunk(replyFlagDone, replyTypeNone)
+		})
+		io.Copy(io.Discard, server)
+	}()
+
+	c, err := Open(ctx, func(context.Context) (net.Conn, error) { return client, nil }, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := bytes.Repeat([]byte{42}, 4096)
+	n, err := c.ReadAt(buf, 0)
+	var oe *OffsetError
+	if !errors.As(err, &oe) || oe.Offset != 3072 || oe.Code != EIO || oe.Message != "bad" {
+		t.Fatalf("ReadAt() = %v, want OffsetError at 3072", err)
+	}
+	if !errors.Is(err, EIO) {
+		t.Errorf("errors.Is(%v, EIO) = false", err)
+	}
+	if n != 3072 {
+		t.Errorf("ReadAt() = %d, want 3072", n)
+	}
+	want := append(append(bytes.Repeat([]byte{1}, 1024), make([]byte, 1024)...), bytes.Repeat([]byte{2}, 1024)...)
+	if !bytes.Equal(buf[:n], want) {
+		t.Error("ReadAt() returned wrong data")
+	}
+}
+
+// extentDevice reports alternating data and holes of 4KiB each, returning at
+// most two extents per call.
+type extentDevice struct {
+	testDevice
+}
+
+func (d *extentDevice) ReportExtents(off, length int64) ([]Extent, error) {
+	var ext []Extent
+	for len(ext) < 2 && length > 0 {
+		n := 4096 - off%4096
+		var flags uint32
+		if (off/4096)%2 == 1 {
+			flags = ExtentHole | ExtentZero
+		}
+		ext = append(ext, Extent{uint64(off), uint64(n), flags})
+		off, length = off+n, length-n
+	}
+	return ext, nil
+}
+
+func TestConnExtents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &extentDevice{testDevice{buf: make([]byte, 32768)}}
+	dial, _ := testServer(t, ctx, Export{
+		Size:   uint64(len(d.buf)),
+		Device: d,
+	})
+	c, err := Open(ctx, dial, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var got []Extent
+	for x, err := range c.Extents(ctx, 1000, 20000, BaseAllocation) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, x)
+	}
+	want := []Extent{
+		{1000, 3096, 0},
+		{4096, 4096, ExtentHole | ExtentZero},
+		{8192, 4096, 0},
+		{12288, 4096, ExtentHole | ExtentZero},
+		{16384, 4096, 0},
+		{20480, 520, ExtentHole | ExtentZero},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Extents() = %v, want %v", got, want)
+	}
+
+	x, err := c.Extent(ctx, 5000, BaseAllocation)
+	if want := (Extent{5000, 3192, ExtentHole | ExtentZero}); err != nil || x != want {
+		t.Errorf("Extent(5000) = %v, %v, want %v, <nil>", x, err, want)
+	}
+
+	for _, err := range c.Extents(ctx, 0, 100, "qemu:dirty-bitmap:foo") {
+		if err == nil {
+			t.Error("Extents succeeded for unselected metadata context")
+		}
+	}
+}
+
+type trimDevice struct {
+	testDevice
+	trimmed int64
+}
+
+func (d *trimDevice) Trim(off, length int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.trimmed += length
+	return nil
+}
+
+func TestConnTrimAndWriteZeroes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &trimDevice{testDevice: testDevice{buf: bytes.Repeat([]byte{1}, 1<<20)}}
+	dial, _ := testServer(t, ctx, Export{
+		Size:   uint64(len(d.buf)),
+		Device: d,
+	})
+	c, err := Open(ctx, dial, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if f := c.Export().Flags; f&FlagSendTrim == 0 || f&FlagSendWriteZeroes == 0 {
+		t.Fatalf("server did not advertise trim and write zeroes (flags 0x%x)", f)
+	}
+	if err := c.Trim(4096, 8192); err != nil {
+		t.Fatalf("Trim() = %v", err)
+	}
+	if d.trimmed != 8192 {
+		t.Errorf("device trimmed %d bytes, want 8192", d.trimmed)
+	}
+	if err := c.WriteZeroes(1000, 500000, true); err != nil {
+		t.Fatalf("WriteZeroes() = %v", err)
+	}
+	want := bytes.Repeat([]byte{1}, 1<<20)
+	for i := 1000; i < 501000; i++ {
+		want[i] = 0
+	}
+	got := make([]byte, 1<<20)
+	if _, err := c.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("WriteZeroes did not zero the range")
+	}
+}
+
+func TestServeFlags(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buf := make([]byte, 1<<20)
+	dial, _ := testServer(t, ctx,
+		Export{Name: "plain", Size: uint64(len(buf)), Device: &testDevice{buf: buf}},
+		Export{Name: "trim", Size: uint64(len(buf)), Device: &trimDevice{testDevice: testDevice{buf: buf}}},
+		Export{Name: "ro", Size: uint64(len(buf)), Flags: FlagReadOnly, Device: &trimDevice{testDevice: testDevice{buf: buf}}},
+		Export{Name: "ephemeral", Size: uint64(len(buf)), Device: &testDevice{buf: buf}, Ephemeral: true},
+	)
+	tcs := []struct {
+		name     string
+		set, clr uint16
+	}{
+		{"plain", FlagHasFlags | FlagSendFlush | FlagSendFUA | FlagSendWriteZeroes, FlagSendTrim | FlagReadOnly},
+		{"trim", FlagHasFlags | FlagSendFlush | FlagSendFUA | FlagSendWriteZeroes | FlagSendTrim, FlagReadOnly},
+		{"ro", FlagHasFlags | FlagReadOnly, FlagSendTrim | FlagSendWriteZeroes | FlagSendFUA},
+		{"ephemeral", FlagHasFlags | FlagSendFlush | FlagSendFUA | FlagSendWriteZeroes | FlagSendTrim, FlagReadOnly},
+	}
+	for _, tc := range tcs {
+		cl, err := dial(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := ClientHandshake(ctx, cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp, err := client.Info(tc.name)
+		client.Abort()
+		if err != nil {
+			t.Errorf("Info(%q) = %v", tc.name, err)
+			continue
+		}
+		if exp.Flags&tc.set != tc.set || exp.Flags&tc.clr != 0 {
+			t.Errorf("%s: flags = 0x%x, want 0x%x set and 0x%x clear", tc.name, exp.Flags, tc.set, tc.clr)
+		}
+
+		c, err := Open(ctx, dial, tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f := c.Export().Flags; f != exp.Flags {
+			t.Errorf("%s: Open negotiated flags 0x%x, Info returned 0x%x", tc.name, f, exp.Flags)
+		}
+		c.Close()
+	}
+}
+
+func TestServeEphemeral(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	base := NewMemDevice(1 << 20)
+	saved := make(chan *Overlay, 1)
+	dial, _ := testServer(t, ctx, Export{
+		Name:      "test",
+		Size:      uint64(base.Size()),
+		Device:    base,
+		Ephemeral: true,
+		Save: func(name string, o *Overlay) error {
+			if name != "snap" {
+				t.Errorf("Save(%q), want snap", name)
+			}
+			saved <- o
+			return nil
+		},
+		// Names not provided by Lookup must still be usable to save.
+		Lookup: func(suffix string) (Export, bool) {
+			if suffix != "view" {
+				return Export{}, false
+			}
+			return Export{Name: "test@view", Size: uint64(base.Size()), Flags: FlagReadOnly, Device: base}, true
+		},
+	})
+
+	var cs []*Conn
+	for _, name := range []string{"test", "test", "test@snap"} {
+		c, err := Open(ctx, dial, name)
+		if err != nil {
+			t.Fatalf("Open(%q) = %v", name, err)
+		}
+		defer c.Close()
+		cs = append(cs, c)
+	}
+	for i, c := range cs {
+		if _, err := c.WriteAt([]byte{byte(i + 1)}, 42); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, c := range cs {
+		b := make([]byte, 1)
+		if _, err := c.ReadAt(b, 42); err != nil || b[0] != byte(i+1) {
+			t.Errorf("connection %d read %v, %v, want %d", i, b, err, i+1)
+		}
+	}
+	b := make([]byte, 1)
+	if base.ReadAt(b, 42); b[0] != 0 {
+		t.Error("write to ephemeral export modified the base device")
+	}
+
+	for _, c := range cs {
+		c.Close()
+	}
+	select {
+	case o := <-saved:
+		o.ReadAt(b, 42)
+		if b[0] != 3 {
+			t.Errorf("saved overlay contains %d, want 3", b[0])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("overlay was not saved")
+	}
+	if c, err := Open(ctx, dial, "test@view"); err != nil {
+		t.Errorf("Open(test@view) = %v", err)
+	} else {
+		c.Close()
+	}
+	if _, err := Open(ctx, dial, "foo@snap"); err == nil {
+		t.Error("Open succeeded for unknown export")
+	}
+}
+
+func TestServeRangeChecks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := NewMemDevice(2 << 20)
+	dial, _ := testServer(t, ctx,
+		Export{Name: "rw", Size: 1 << 20, Device: d},
+		Export{Name: "ro", Size: 1 << 20, Flags: FlagReadOnly, Device: d},
+	)
+	open := func(name string) *Conn {
+		t.Helper()
+		c, err := Open(ctx, dial, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Circumvent the checks of the client, to test the server.
+		c.export.Size = 2 << 20
+		c.export.Flags = c.export.Flags&^FlagReadOnly | FlagSendTrim | FlagSendWriteZeroes
+		return c
+	}
+	rw, ro := open("rw"), open("ro")
+	defer rw.Close()
+	defer ro.Close()
+
+	b := bytes.Repeat([]byte{1}, 8192)
+	if _, err := rw.WriteAt(b, 1<<20-4096); err == nil {
+		t.Error("write past the end of the export succeeded")
+	}
+	if err := rw.WriteZeroes(1<<20-4096, 8192, false); err == nil {
+		t.Error("write zeroes past the end of the export succeeded")
+	}
+	if err := rw.Trim(1<<20-4096, 8192); err == nil {
+		t.Error("trim past the end of the export succeeded")
+	}
+	if _, err := ro.WriteAt(b, 0); err == nil {
+		t.Error("write to read-only export succeeded")
+	}
+	if err := ro.WriteZeroes(0, 8192, false); err == nil {
+		t.Error("write zeroes to read-only export succeeded")
+	}
+	if err := ro.Trim(0, 8192); err == nil {
+		t.Error("trim of read-only export succeeded")
+	}
+	if d.Allocated() != 0 {
+		t.Errorf("device has %d bytes allocated, want 0", d.Allocated())
+	}
+	if err := rw.WriteZeroes(1<<20-4096, 4096, false); err != nil {
+		t.Errorf("write zeroes at the end of the export = %v", err)
+	}
+}
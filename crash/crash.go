@@ -0,0 +1,363 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package crash enumerates the states a block device can be left in by a
+// crash, to systematically test the durability of software using it.
+//
+// A Recorder is used as the device under test and records all writes and
+// flushes. Afterwards, Enumerate can be called for any point in the recorded
+// stream of operations, to check invariants on every distinct state the
+// device could be in, if it had crashed at that point.
+//
+// The model follows the semantics of the Linux block layer: Operations
+// completed before the last flush are persistent. Writes after it (an epoch)
+// might or might not have been persisted and might have been persisted in
+// any order, except that writes with FUA are always persisted. Writes
+// themselves are assumed to be atomic.
+package crash
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/Merovius/nbd"
+)
+
+// OpType is the type of a recorded operation.
+type OpType int
+
+const (
+	Write OpType = iota
+	WriteZeroes
+	Trim
+	Flush
+)
+
+func (t OpType) String() string {
+	switch t {
+	case Write:
+		return "write"
+	case WriteZeroes:
+		return "write-zeroes"
+	case Trim:
+		return "trim"
+	case Flush:
+		return "flush"
+	}
+	return fmt.Sprintf("OpType(%d)", int(t))
+}
+
+// Op is a recorded operation.
+type Op struct {
+	Type   OpType
+	Off    int64
+	Length int64
+	// Data is the data of a Write. It must not be modified.
+	Data []byte
+	// Punch is set for WriteZeroes, if the range may be deallocated.
+	Punch bool
+	// FUA is set for writes done with forced unit access.
+	FUA bool
+}
+
+// apply applies o to d.
+func (o Op) apply(d *nbd.Overlay) error {
+	switch o.Type {
+	case Write:
+		_, err := d.WriteAt(o.Data, o.Off)
+		return err
+	case WriteZeroes:
+		return d.WriteZeroes(o.Off, o.Length, o.Punch)
+	case Trim:
+		return d.Trim(o.Off, o.Length)
+	}
+	return nil
+}
+
+// overlaps returns whether o and p modify overlapping ranges.
+func (o Op) overlaps(p Op) bool {
+	return o.Off < p.Off+p.Length && p.Off < o.Off+o.Length
+}
+
+// Recorder is an nbd.Device recording all operations done on it. It never
+// writes to the underlying device, instead changes are kept in memory.
+//
+// Recorder implements nbd.Trimmer, nbd.ZeroWriter and nbd.FUAWriter. Trimmed
+// ranges read as zeroes.
+type Recorder struct {
+	mu   sync.Mutex
+	base nbd.Device
+	size int64
+	live *nbd.Overlay
+	ops  []Op
+}
+
+// NewRecorder returns a Recorder of the given size, using base as the initial
+// contents. base must not be modified while the Recorder is used.
+func NewRecorder(base nbd.Device, size int64) *Recorder {
+	return &Recorder{
+		base: base,
+		size: size,
+		live: nbd.NewOverlay(base, nbd.NewMemDevice(size), size),
+	}
+}
+
+// do applies o and records it, if it succeeded.
+func (r *Recorder) do(o Op) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := o.apply(r.live); err != nil {
+		return err
+	}
+	r.ops = append(r.ops, o)
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *Recorder) ReadAt(p []byte, off int64) (int, error) {
+	return r.live.ReadAt(p, off)
+}
+
+// WriteAt implements io.WriterAt.
+func (r *Recorder) WriteAt(p []byte, off int64) (int, error) {
+	if err := r.do(Op{Type: Write, Off: off, Length: int64(len(p)), Data: slices.Clone(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteFUA implements nbd.FUAWriter.
+func (r *Recorder) WriteFUA(p []byte, off int64) (int, error) {
+	if err := r.do(Op{Type: Write, Off: off, Length: int64(len(p)), Data: slices.Clone(p), FUA: true}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteZeroes implements nbd.ZeroWriter.
+func (r *Recorder) WriteZeroes(off, length int64, punch bool) error {
+	return r.do(Op{Type: WriteZeroes, Off: off, Length: length, Punch: punch})
+}
+
+// Trim implements nbd.Trimmer.
+func (r *Recorder) Trim(off, length int64) error {
+	return r.do(Op{Type: Trim, Off: off, Length: length})
+}
+
+// Sync implements nbd.Device, by recording a flush.
+func (r *Recorder) Sync() error {
+	return r.do(Op{Type: Flush})
+}
+
+// Len returns the number of recorded operations.
+func (r *Recorder) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.ops)
+}
+
+// Ops returns the recorded operations.
+func (r *Recorder) Ops() []Op {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.ops)
+}
+
+// ErrLimit is returned by Enumerate, if there are more states than the limit.
+var ErrLimit = errors.New("too many crash states")
+
+// Option is an option for Enumerate.
+type Option func(*options)
+
+type options struct {
+	limit int
+}
+
+// WithLimit sets the maximum number of states passed to the callback of
+// Enumerate. The default is 4096.
+func WithLimit(n int) Option {
+	return func(o *options) {
+		o.limit = n
+	}
+}
+
+// Enumerate calls f with every distinct state the device could be in after a
+// crash directly after the first point operations completed. point must be
+// between 0 and Len().
+//
+// The device passed to f is read-only and must not be used after f returns.
+// To mount a filesystem on it, which might need to replay a journal, wrap it
+// in an nbd.Overlay. If f returns an error, Enumerate stops and returns it.
+func (r *Recorder) Enumerate(point int, f func(d nbd.Device) error, opts ...Option) error {
+	o := options{limit: 4096}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	r.mu.Lock()
+	if point < 0 || point > len(r.ops) {
+		r.mu.Unlock()
+		return fmt.Errorf("crash point %d out of range [0,%d]", point, len(r.ops))
+	}
+	ops := r.ops[:point:point]
+	r.mu.Unlock()
+
+	// Everything up to the last flush is persistent.
+	last := -1
+	for i, op := range ops {
+		if op.Type == Flush {
+			last = i
+		}
+	}
+	ops, epoch := ops[:last+1], ops[last+1:]
+	prefix := nbd.NewOverlay(r.base, nbd.NewMemDevice(r.size), r.size)
+	for _, op := range ops {
+		if err := op.apply(prefix); err != nil {
+			return err
+		}
+	}
+	e := &enumerator{
+		size:   r.size,
+		prefix: prefix,
+		epoch:  epoch,
+		seen:   make(map[[sha256.Size]byte]bool),
+		limit:  o.limit,
+		// Orders of overlapping writes often lead to the same state, so
+		// we allow more candidates than states.
+		tries: 64 * o.limit,
+		f:     f,
+		buf:   make([]byte, 64<<10),
+	}
+	return e.subsets(0, nil)
+}
+
+// enumerator enumerates the crash states of an epoch.
+type enumerator struct {
+	size   int64
+	prefix nbd.Device
+	epoch  []Op
+	seen   map[[sha256.Size]byte]bool
+	limit  int
+	tries  int
+	f      func(nbd.Device) error
+	buf    []byte
+}
+
+// subsets enumerates all subsets of the epoch containing all writes with FUA,
+// starting with op i. set contains the indices of the ops already chosen.
+func (e *enumerator) subsets(i int, set []int) error {
+	if i == len(e.epoch) {
+		return e.orders(set)
+	}
+	if e.epoch[i].Type == Flush {
+		return e.subsets(i+1, set)
+	}
+	if !e.epoch[i].FUA {
+		if err := e.subsets(i+1, set); err != nil {
+			return err
+		}
+	}
+	return e.subsets(i+1, append(set, i))
+}
+
+// orders enumerates all orders in which the ops in set could have been
+// persisted. Only the order of overlapping ops matters, so they are grouped
+// into connected components of overlapping ops, which are permuted
+// independently.
+func (e *enumerator) orders(set []int) error {
+	var comps [][]int
+	for _, i := range set {
+		var merged []int
+		rest := comps[:0]
+		for _, c := range comps {
+			if slices.ContainsFunc(c, func(j int) bool { return e.epoch[i].overlaps(e.epoch[j]) }) {
+				merged = append(merged, c...)
+			} else {
+				rest = append(rest, c)
+			}
+		}
+		comps = append(rest, append(merged, i))
+	}
+	return e.permute(comps, nil)
+}
+
+// permute calls e.check for every combination of permutations of comps,
+// appended to order.
+func (e *enumerator) permute(comps [][]int, order []int) error {
+	if len(comps) == 0 {
+		return e.check(order)
+	}
+	c := comps[0]
+	if len(c) == 1 {
+		return e.permute(comps[1:], append(order, c[0]))
+	}
+	for i := range c {
+		c[0], c[i] = c[i], c[0]
+		if err := e.permute(append([][]int{c[1:]}, comps[1:]...), append(order, c[0])); err != nil {
+			return err
+		}
+		c[0], c[i] = c[i], c[0]
+	}
+	return nil
+}
+
+// check builds the state from applying the ops in order and passes it to f,
+// if it was not seen before.
+func (e *enumerator) check(order []int) error {
+	if e.tries--; e.tries < 0 {
+		return ErrLimit
+	}
+	d := nbd.NewOverlay(e.prefix, nbd.NewMemDevice(e.size), e.size)
+	for _, i := range order {
+		if err := e.epoch[i].apply(d); err != nil {
+			return err
+		}
+	}
+	// States can only differ in ranges modified in the epoch.
+	h := sha256.New()
+	for _, op := range e.epoch {
+		if op.Type == Flush {
+			continue
+		}
+		for off, end := op.Off, op.Off+op.Length; off < end; {
+			buf := e.buf[:min(end-off, int64(len(e.buf)))]
+			if _, err := d.ReadAt(buf, off); err != nil {
+				return err
+			}
+			h.Write(buf)
+			off += int64(len(buf))
+		}
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	if e.seen[sum] {
+		return nil
+	}
+	if len(e.seen) == e.limit {
+		return ErrLimit
+	}
+	e.seen[sum] = true
+	return e.f(readOnly{d})
+}
+
+// readOnly is a read-only wrapper for a Device.
+type readOnly struct {
+	nbd.Device
+}
+
+func (readOnly) WriteAt(p []byte, off int64) (int, error) {
+	return 0, nbd.EPERM
+}
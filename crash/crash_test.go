@@ -0,0 +1,103 @@
+package crash
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/Merovius/nbd"
+)
+
+// states returns the first byte of each block of all crash states at point,
+// sorted.
+func states(t *testing.T, r *Recorder, point int, blocks int) []string {
+	t.Helper()
+	var out []string
+	err := r.Enumerate(point, func(d nbd.Device) error {
+		var s []byte
+		for i := 0; i < blocks; i++ {
+			b := make([]byte, 1)
+			if _, err := d.ReadAt(b, int64(i)*4096); err != nil {
+				return err
+			}
+			s = append(s, b[0]+'0')
+		}
+		if _, err := d.WriteAt([]byte{1}, 0); err == nil {
+			t.Error("crash state is writable")
+		}
+		out = append(out, string(s))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestEnumerate(t *testing.T) {
+	const size = 4 * 4096
+	r := NewRecorder(nbd.NewMemDevice(size), size)
+	block := func(v byte) []byte {
+		return bytes.Repeat([]byte{v}, 4096)
+	}
+	r.WriteAt(block(1), 0)
+	r.Sync()
+	r.WriteAt(block(2), 4096)
+	r.WriteAt(block(3), 8192)
+	r.WriteFUA(block(4), 12288)
+
+	tcs := []struct {
+		point int
+		want  []string
+	}{
+		{0, []string{"0000"}},
+		{1, []string{"0000", "1000"}},
+		{2, []string{"1000"}},
+		{4, []string{"1000", "1200", "1030", "1230"}},
+		{5, []string{"1004", "1204", "1034", "1234"}},
+	}
+	for _, tc := range tcs {
+		want := slices.Clone(tc.want)
+		sort.Strings(want)
+		if got := states(t, r, tc.point, 4); !slices.Equal(got, want) {
+			t.Errorf("states at %d = %v, want %v", tc.point, got, want)
+		}
+	}
+
+	if err := r.Enumerate(6, func(nbd.Device) error { return nil }); err == nil {
+		t.Error("Enumerate past the end succeeded")
+	}
+	errStop := errors.New("stop")
+	if err := r.Enumerate(5, func(nbd.Device) error { return errStop }); err != errStop {
+		t.Errorf("Enumerate returned %v, want error of callback", err)
+	}
+	if err := r.Enumerate(5, func(nbd.Device) error { return nil }, WithLimit(2)); err != ErrLimit {
+		t.Errorf("Enumerate with limit returned %v, want %v", err, ErrLimit)
+	}
+}
+
+func TestEnumerateReorder(t *testing.T) {
+	const size = 2 * 4096
+	r := NewRecorder(nbd.NewMemDevice(size), size)
+	r.WriteAt(bytes.Repeat([]byte{1}, 4096), 0)
+	r.WriteAt(bytes.Repeat([]byte{2}, 4096), 0)
+	r.WriteZeroes(0, size, true)
+
+	// The device could be left with each of the writes applied last, or
+	// none of them.
+	want := []string{"00", "10", "20"}
+	if got := states(t, r, 2, 2); !slices.Equal(got, want) {
+		t.Errorf("states = %v, want %v", got, want)
+	}
+	if got := states(t, r, 3, 2); !slices.Equal(got, want) {
+		t.Errorf("states with zeroes = %v, want %v", got, want)
+	}
+	got := make([]byte, 1)
+	r.ReadAt(got, 0)
+	if got[0] != 0 {
+		t.Errorf("Recorder reads %d after WriteZeroes, want 0", got[0])
+	}
+}
@@ -28,7 +28,10 @@
 // can be used to list the exports a server provides and their respective
 // capabilities. Its Go method enters transmission phase. The returned Export
 // can then be passed to Configure (linux only) to hook it up to an NBD device
-// (/dev/nbdX).
+// (/dev/nbdX). Alternatively, Open does the handshake and returns a Conn,
+// which can be used to access an export from userspace. It can optionally
+// reconnect to the server transparently, if the connection is lost. Dial
+// does the same for a server identified by an NBD URI (see ParseURI).
 //
 // The server side combines both handshake and transmission phase into the
 // Serve or ListenAndServe functions. The user is expected to implement the
@@ -38,24 +41,14 @@ package nbd
 
 // BUG(1): BlockSizeConstraints are not yet enforced by the server.
 
-// BUG(2): The server does not yet support FUA for direct IO.
-
-// BUG(3): StartTLS is not supported yet.
+// BUG(3): StartTLS is not yet supported by the server.
 
 // BUG(4): There is no way to declare a preferred block size for Loopback yet.
 
-// BUG(5): Server flags are not yet set (or used) correctly.
-
-// BUG(6): Structured replies are not yet supported.
-
-// BUG(7): CMD_TRIM is not yet supported.
+// BUG(5): Server flags are not yet used correctly.
 
 // BUG(8): Lame-duck mode (ESHUTDOWN) is not yet implemented.
 
-// BUG(9): CMD_WRITE_ZEROES is not yet supported.
-
-// BUG(10): Metadata querying is not yet supported.
-
 // BUG(11): FLAG_ROTATIONAL is not yet supported.
 
 // BUG(12): CMD_CACHE is not yet supported.
@@ -0,0 +1,619 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fat synthesizes a read-only FAT32 filesystem image from an fs.FS.
+//
+// The image is never materialized. The boot sector and directories are
+// generated when the Image is created, the FATs are computed on the fly and
+// file contents are read from the source on every access.
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/Merovius/nbd"
+)
+
+const (
+	sectorSize      = 512
+	reservedSectors = 32
+	numFATs         = 2
+	// minClusters is the minimum number of clusters for a FAT32 volume. We
+	// add a bit of margin, as some implementations are off by a few.
+	minClusters = 65525 + 16
+	maxClusters = 0x0ffffff5 - 2
+	entrySize   = 32
+
+	attrReadOnly = 0x01
+	attrVolumeID = 0x08
+	attrDir      = 0x10
+	attrArchive  = 0x20
+	attrLFN      = 0x0f
+
+	eoc = 0x0fffffff
+)
+
+// Option is an option for New.
+type Option func(*options)
+
+type options struct {
+	clusterSize int
+	label       string
+}
+
+// WithClusterSize sets the cluster size of the image. It must be a power of
+// two between 512 bytes and 32KiB. The default is 4KiB.
+func WithClusterSize(size int) Option {
+	return func(o *options) {
+		o.clusterSize = size
+	}
+}
+
+// WithLabel sets the volume label of the image. It must be at most 11
+// characters long.
+func WithLabel(label string) Option {
+	return func(o *options) {
+		o.label = label
+	}
+}
+
+// Image is a read-only nbd.Device containing a FAT32 filesystem. It also
+// implements nbd.ExtentReporter.
+type Image struct {
+	fsys      fs.FS
+	cs        int64
+	size      int64
+	fatStart  int64
+	fatBytes  int64
+	dataStart int64
+	// boot contains the reserved sectors.
+	boot []byte
+	// runs contains the cluster runs of all files and directories, sorted
+	// by cluster. Clusters from next on are free.
+	runs []run
+	next uint32
+}
+
+type run struct {
+	start, count uint32
+	n            *node
+}
+
+// node is a file or directory in the image.
+type node struct {
+	path     string
+	name     string
+	dir      bool
+	size     int64
+	modTime  time.Time
+	children []*node
+	// entries is the number of directory entries of a directory.
+	entries int
+	short   [11]byte
+	lfn     bool
+	cluster uint32
+	// data contains the directory entries of a directory.
+	data []byte
+}
+
+// New creates an Image with the contents of fsys. Only regular files and
+// directories are included, symbolic links and special files are skipped.
+// Changes to fsys after New returns must not change the size of any file.
+func New(fsys fs.FS, opts ...Option) (*Image, error) {
+	o := options{clusterSize: 4096}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.clusterSize < sectorSize || o.clusterSize > 32768 || o.clusterSize&(o.clusterSize-1) != 0 {
+		return nil, fmt.Errorf("invalid cluster size %d", o.clusterSize)
+	}
+	if len(o.label) > 11 {
+		return nil, fmt.Errorf("label %q is too long", o.label)
+	}
+	im := &Image{fsys: fsys, cs: int64(o.clusterSize), next: 2}
+
+	fi, err := fs.Stat(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	root := &node{path: ".", dir: true, modTime: fi.ModTime()}
+	if err := im.walk(root); err != nil {
+		return nil, err
+	}
+	if o.label != "" {
+		root.entries++
+	}
+	im.allocate(root)
+
+	clusters := max(im.next-2, minClusters)
+	if clusters > maxClusters {
+		return nil, errors.New("contents too large for FAT32")
+	}
+	fatSectors := (int64(clusters+2)*4 + sectorSize - 1) / sectorSize
+	im.fatStart = reservedSectors * sectorSize
+	im.fatBytes = fatSectors * sectorSize
+	im.dataStart = im.fatStart + numFATs*im.fatBytes
+	im.size = im.dataStart + int64(clusters)*im.cs
+
+	im.encodeDir(root, nil, o.label)
+	im.boot = im.bootSectors(clusters, uint32(fatSectors), o.label, uint32(root.modTime.Unix()))
+	return im, nil
+}
+
+// walk reads the contents of the directory n.
+func (im *Image) walk(n *node) error {
+	des, err := fs.ReadDir(im.fsys, n.path)
+	if err != nil {
+		return err
+	}
+	used := make(map[[11]byte]bool)
+	for _, de := range des {
+		if !de.IsDir() && !de.Type().IsRegular() {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+		c := &node{
+			path:    path.Join(n.path, de.Name()),
+			name:    de.Name(),
+			dir:     de.IsDir(),
+			modTime: fi.ModTime(),
+		}
+		if !c.dir {
+			c.size = fi.Size()
+			if c.size > 0xffffffff {
+				return fmt.Errorf("%s: file too large for FAT32", c.path)
+			}
+		}
+		lfn, err := lfnLength(c.name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.path, err)
+		}
+		c.short, c.lfn = shortName(c.name, used)
+		used[c.short] = true
+		n.entries++
+		if c.lfn {
+			n.entries += lfn
+		}
+		n.children = append(n.children, c)
+		if c.dir {
+			// "." and ".."
+			c.entries = 2
+			if err := im.walk(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clusters returns the number of clusters needed for n.
+func (im *Image) clusters(n *node) uint32 {
+	if n.dir {
+		return uint32(max(1, (int64(n.entries)*entrySize+im.cs-1)/im.cs))
+	}
+	return uint32((n.size + im.cs - 1) / im.cs)
+}
+
+// allocate assigns clusters to n and all its children.
+func (im *Image) allocate(n *node) {
+	if c := im.clusters(n); c > 0 {
+		n.cluster = im.next
+		im.runs = append(im.runs, run{im.next, c, n})
+		im.next += c
+	}
+	for _, c := range n.children {
+		im.allocate(c)
+	}
+}
+
+// encodeDir generates the directory entries of n and all its children.
+// parent is nil for the root directory.
+func (im *Image) encodeDir(n, parent *node, label string) {
+	n.data = make([]byte, 0, n.entries*entrySize)
+	if parent == nil {
+		if label != "" {
+			var name [11]byte
+			copy(name[:], fmt.Sprintf("%-11s", strings.ToUpper(label)))
+			n.data = appendEntry(n.data, name, attrVolumeID, 0, 0, n.modTime)
+		}
+	} else {
+		dot := [11]byte{'.', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}
+		n.data = appendEntry(n.data, dot, attrDir, n.cluster, 0, n.modTime)
+		dot[1] = '.'
+		// The root directory is referred to as cluster 0 in "..".
+		var pc uint32
+		if parent.path != "." {
+			pc = parent.cluster
+		}
+		n.data = appendEntry(n.data, dot, attrDir, pc, 0, parent.modTime)
+	}
+	for _, c := range n.children {
+		if c.lfn {
+			n.data = appendLFN(n.data, c.name, c.short)
+		}
+		attr := byte(attrArchive | attrReadOnly)
+		if c.dir {
+			attr = attrDir | attrReadOnly
+		}
+		n.data = appendEntry(n.data, c.short, attr, c.cluster, uint32(c.size), c.modTime)
+		if c.dir {
+			im.encodeDir(c, n, "")
+		}
+	}
+}
+
+// appendEntry appends a short directory entry to b.
+func appendEntry(b []byte, name [11]byte, attr byte, cluster, size uint32, t time.Time) []byte {
+	var e [entrySize]byte
+	le := binary.LittleEndian
+	copy(e[:11], name[:])
+	e[11] = attr
+	date, tm := fatTime(t)
+	le.PutUint16(e[14:], tm)
+	le.PutUint16(e[16:], date)
+	le.PutUint16(e[18:], date)
+	le.PutUint16(e[20:], uint16(cluster>>16))
+	le.PutUint16(e[22:], tm)
+	le.PutUint16(e[24:], date)
+	le.PutUint16(e[26:], uint16(cluster))
+	le.PutUint32(e[28:], size)
+	return append(b, e[:]...)
+}
+
+// lfnChars is the number of UTF-16 code units in a long file name entry.
+const lfnChars = 13
+
+// lfnLength returns the number of long file name entries needed for name, or
+// an error if name is not a valid long file name.
+func lfnLength(name string) (int, error) {
+	if strings.ContainsAny(name, "\"*/:<>?\\|") || strings.ContainsFunc(name, func(r rune) bool { return r < 0x20 }) {
+		return 0, errors.New("invalid characters in name for FAT")
+	}
+	n := len(utf16.Encode([]rune(name)))
+	if n > 255 {
+		return 0, errors.New("name too long for FAT")
+	}
+	return (n + lfnChars - 1) / lfnChars, nil
+}
+
+// appendLFN appends the long file name entries for name to b.
+func appendLFN(b []byte, name string, short [11]byte) []byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	u := utf16.Encode([]rune(name))
+	n := (len(u) + lfnChars - 1) / lfnChars
+	// The name is terminated by a 0 and padded with 0xffff.
+	if len(u)%lfnChars != 0 {
+		u = append(u, 0)
+	}
+	for len(u)%lfnChars != 0 {
+		u = append(u, 0xffff)
+	}
+	// Entries are stored in reverse order.
+	for i := n; i > 0; i-- {
+		var e [entrySize]byte
+		e[0] = byte(i)
+		if i == n {
+			e[0] |= 0x40
+		}
+		e[11] = attrLFN
+		e[13] = sum
+		chars := u[(i-1)*lfnChars : i*lfnChars]
+		for j, c := range chars {
+			var off int
+			switch {
+			case j < 5:
+				off = 1 + 2*j
+			case j < 11:
+				off = 14 + 2*(j-5)
+			default:
+				off = 28 + 2*(j-11)
+			}
+			binary.LittleEndian.PutUint16(e[off:], c)
+		}
+		b = append(b, e[:]...)
+	}
+	return b
+}
+
+// shortName returns the 8.3 name to use for name and whether a long file
+// name is needed. used contains the short names already taken in the
+// directory.
+func shortName(name string, used map[[11]byte]bool) (short [11]byte, lfn bool) {
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	valid := func(s string, n int) bool {
+		if len(s) > n {
+			return false
+		}
+		for _, c := range []byte(s) {
+			if !validShort(c) {
+				return false
+			}
+		}
+		return true
+	}
+	// Names that are valid 8.3 names, except for case, get a long file
+	// name to preserve the case.
+	if base != "" && valid(base, 8) && valid(ext, 3) {
+		copy(short[:], fmt.Sprintf("%-8s%-3s", strings.ToUpper(base), strings.ToUpper(ext)))
+		if !used[short] {
+			return short, strings.ToUpper(name) != name
+		}
+	}
+
+	clean := func(s string) string {
+		var b []byte
+		for _, c := range []byte(strings.ToUpper(s)) {
+			switch {
+			case c == ' ' || c == '.':
+			case validShort(c):
+				b = append(b, c)
+			default:
+				b = append(b, '_')
+			}
+		}
+		return string(b)
+	}
+	base, ext = clean(strings.TrimLeft(base, ".")), clean(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	for i := 1; ; i++ {
+		tail := fmt.Sprintf("~%d", i)
+		b := base
+		if len(b) > 8-len(tail) {
+			b = b[:8-len(tail)]
+		}
+		copy(short[:], fmt.Sprintf("%-8s%-3s", b+tail, ext))
+		if !used[short] {
+			return short, true
+		}
+	}
+}
+
+// validShort returns whether c is valid in a short name.
+func validShort(c byte) bool {
+	switch {
+	case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'()-@^_`{}~", c) >= 0
+}
+
+// fatTime returns the FAT date and time of t.
+func fatTime(t time.Time) (date, tm uint16) {
+	switch {
+	case t.Year() < 1980:
+		return 1<<5 | 1, 0
+	case t.Year() > 2107:
+		return 127<<9 | 12<<5 | 31, 23<<11 | 59<<5 | 29
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
+
+// bootSectors returns the reserved sectors of the image.
+func (im *Image) bootSectors(clusters, fatSectors uint32, label string, id uint32) []byte {
+	b := make([]byte, reservedSectors*sectorSize)
+	le := binary.LittleEndian
+	bs := b[:sectorSize]
+	copy(bs, []byte{0xeb, 0x58, 0x90})
+	copy(bs[3:], "MSWIN4.1")
+	le.PutUint16(bs[11:], sectorSize)
+	bs[13] = byte(im.cs / sectorSize)
+	le.PutUint16(bs[14:], reservedSectors)
+	bs[16] = numFATs
+	bs[21] = 0xf8
+	le.PutUint16(bs[24:], 32)
+	le.PutUint16(bs[26:], 64)
+	le.PutUint32(bs[32:], uint32(im.size/sectorSize))
+	le.PutUint32(bs[36:], fatSectors)
+	le.PutUint32(bs[44:], 2)
+	le.PutUint16(bs[48:], 1)
+	le.PutUint16(bs[50:], 6)
+	bs[64] = 0x80
+	bs[66] = 0x29
+	le.PutUint32(bs[67:], id)
+	if label == "" {
+		label = "NO NAME"
+	}
+	copy(bs[71:], fmt.Sprintf("%-11s", strings.ToUpper(label)))
+	copy(bs[82:], "FAT32   ")
+	bs[510], bs[511] = 0x55, 0xaa
+
+	fsinfo := b[sectorSize : 2*sectorSize]
+	le.PutUint32(fsinfo, 0x41615252)
+	le.PutUint32(fsinfo[484:], 0x61417272)
+	le.PutUint32(fsinfo[488:], clusters-(im.next-2))
+	le.PutUint32(fsinfo[492:], im.next)
+	le.PutUint32(fsinfo[508:], 0xaa550000)
+
+	// Backup boot sector and FSInfo.
+	copy(b[6*sectorSize:], b[:2*sectorSize])
+	return b
+}
+
+// Size returns the size of the image.
+func (im *Image) Size() int64 {
+	return im.size
+}
+
+// Sync implements nbd.Device. It is a no-op.
+func (im *Image) Sync() error {
+	return nil
+}
+
+// WriteAt implements io.WriterAt. The image is read-only, so it always fails
+// with EPERM.
+func (im *Image) WriteAt(p []byte, off int64) (int, error) {
+	return 0, nbd.EPERM
+}
+
+// ReadAt implements io.ReaderAt.
+func (im *Image) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, nbd.EINVAL
+	}
+	if off >= im.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > im.size-off {
+		p, err = p[:im.size-off], io.EOF
+	}
+	for n < len(p) {
+		m, e := im.read(p[n:], off+int64(n))
+		n += m
+		if e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+// read reads from a single region of the image into p, returning the number
+// of bytes read.
+func (im *Image) read(p []byte, off int64) (int, error) {
+	switch {
+	case off < im.fatStart:
+		return copy(p, im.boot[off:]), nil
+	case off < im.dataStart:
+		rel := (off - im.fatStart) % im.fatBytes
+		n := int(min(int64(len(p)), im.fatBytes-rel))
+		var e [4]byte
+		for i := 0; i < n; {
+			binary.LittleEndian.PutUint32(e[:], im.fatEntry(uint32((rel+int64(i))/4)))
+			i += copy(p[i:n], e[(rel+int64(i))%4:])
+		}
+		return n, nil
+	}
+	rel := off - im.dataStart
+	c := uint32(2 + rel/im.cs)
+	if c >= im.next {
+		clear(p)
+		return len(p), nil
+	}
+	r := im.find(c)
+	ro := int64(c-r.start)*im.cs + rel%im.cs
+	p = p[:min(int64(len(p)), int64(r.count)*im.cs-ro)]
+	if r.n.dir {
+		n := copy(p, r.n.data[min(ro, int64(len(r.n.data))):])
+		clear(p[n:])
+		return len(p), nil
+	}
+	n := 0
+	if ro < r.n.size {
+		var err error
+		n, err = im.readFile(r.n, p[:min(int64(len(p)), r.n.size-ro)], ro)
+		if err != nil {
+			return 0, err
+		}
+	}
+	clear(p[n:])
+	return len(p), nil
+}
+
+// readFile reads from the file of n into p. If the file is shorter than
+// expected, a short count and no error is returned.
+func (im *Image) readFile(n *node, p []byte, off int64) (int, error) {
+	f, err := im.fsys.Open(n.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	switch f := f.(type) {
+	case io.ReaderAt:
+		n, err := f.ReadAt(p, off)
+		if err == io.EOF {
+			err = nil
+		}
+		return n, err
+	case io.Seeker:
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+	default:
+		if _, err := io.CopyN(io.Discard, f, off); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return 0, err
+		}
+	}
+	m, err := io.ReadFull(f, p)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return m, err
+}
+
+// find returns the run containing the allocated cluster c.
+func (im *Image) find(c uint32) *run {
+	i := sort.Search(len(im.runs), func(i int) bool {
+		return im.runs[i].start+im.runs[i].count > c
+	})
+	return &im.runs[i]
+}
+
+// fatEntry returns the value of the FAT entry of cluster c.
+func (im *Image) fatEntry(c uint32) uint32 {
+	switch {
+	case c == 0:
+		return 0x0ffffff8
+	case c == 1:
+		return eoc
+	case c >= im.next:
+		return 0
+	}
+	if r := im.find(c); c == r.start+r.count-1 {
+		return eoc
+	}
+	return c + 1
+}
+
+// ReportExtents implements nbd.ExtentReporter. The free clusters at the end
+// of the image are reported as a hole.
+func (im *Image) ReportExtents(off, length int64) ([]nbd.Extent, error) {
+	if off < 0 || length < 0 || off >= im.size {
+		return nil, nbd.EINVAL
+	}
+	end := min(off+length, im.size)
+	free := im.dataStart + int64(im.next-2)*im.cs
+	var ext []nbd.Extent
+	if off < free {
+		ext = append(ext, nbd.Extent{Offset: uint64(off), Length: uint64(min(end, free) - off)})
+	}
+	if end > free {
+		start := max(off, free)
+		ext = append(ext, nbd.Extent{Offset: uint64(start), Length: uint64(end - start), Flags: nbd.ExtentHole | nbd.ExtentZero})
+	}
+	return ext, nil
+}
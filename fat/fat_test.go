@@ -0,0 +1,194 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf16"
+)
+
+// reader is a minimal FAT32 reader, to check generated images.
+type reader struct {
+	t         *testing.T
+	r         io.ReaderAt
+	cs        int64
+	fatStart  int64
+	dataStart int64
+}
+
+func newReader(t *testing.T, r io.ReaderAt) *reader {
+	b := make([]byte, 512)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	if string(b[82:90]) != "FAT32   " || b[510] != 0x55 || b[511] != 0xaa {
+		t.Fatal("invalid boot sector")
+	}
+	ss := int64(le.Uint16(b[11:]))
+	reserved := int64(le.Uint16(b[14:]))
+	fatSize := int64(le.Uint32(b[36:])) * ss
+	if clusters := (int64(le.Uint32(b[32:]))*ss - reserved*ss - int64(b[16])*fatSize) / (int64(b[13]) * ss); clusters < 65525 {
+		t.Fatalf("image has %d clusters, FAT32 needs at least 65525", clusters)
+	}
+	return &reader{
+		t:         t,
+		r:         r,
+		cs:        int64(b[13]) * ss,
+		fatStart:  reserved * ss,
+		dataStart: reserved*ss + int64(b[16])*fatSize,
+	}
+}
+
+// chain reads the contents of the cluster chain starting at c.
+func (r *reader) chain(c uint32) []byte {
+	var out []byte
+	for c != 0 && c < 0x0ffffff8 {
+		b := make([]byte, r.cs)
+		if _, err := r.r.ReadAt(b, r.dataStart+int64(c-2)*r.cs); err != nil {
+			r.t.Fatal(err)
+		}
+		out = append(out, b...)
+		var e [4]byte
+		if _, err := r.r.ReadAt(e[:], r.fatStart+4*int64(c)); err != nil {
+			r.t.Fatal(err)
+		}
+		c = binary.LittleEndian.Uint32(e[:]) & 0x0fffffff
+	}
+	return out
+}
+
+type dirent struct {
+	name    string
+	short   string
+	attr    byte
+	cluster uint32
+	size    uint32
+}
+
+func (r *reader) readDir(c uint32) []dirent {
+	var (
+		out []dirent
+		lfn []uint16
+	)
+	b := r.chain(c)
+	for ; len(b) >= 32 && b[0] != 0; b = b[32:] {
+		if b[11] == attrLFN {
+			var chars []uint16
+			for _, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				chars = append(chars, binary.LittleEndian.Uint16(b[off:]))
+			}
+			lfn = append(chars, lfn...)
+			continue
+		}
+		e := dirent{
+			short:   string(b[:11]),
+			attr:    b[11],
+			cluster: uint32(binary.LittleEndian.Uint16(b[20:]))<<16 | uint32(binary.LittleEndian.Uint16(b[26:])),
+			size:    binary.LittleEndian.Uint32(b[28:]),
+		}
+		if lfn != nil {
+			for i, c := range lfn {
+				if c == 0 {
+					lfn = lfn[:i]
+					break
+				}
+			}
+			e.name = string(utf16.Decode(lfn))
+			lfn = nil
+		} else {
+			base, ext := strings.TrimRight(e.short[:8], " "), strings.TrimRight(e.short[8:], " ")
+			e.name = base
+			if ext != "" {
+				e.name += "." + ext
+			}
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// lookup returns the directory entry of the given path.
+func (r *reader) lookup(p string) dirent {
+	e := dirent{attr: attrDir, cluster: 2}
+	for _, name := range strings.Split(p, "/") {
+		found := false
+		for _, c := range r.readDir(e.cluster) {
+			if c.name == name {
+				e, found = c, true
+				break
+			}
+		}
+		if !found {
+			r.t.Fatalf("%s not found", p)
+		}
+	}
+	return e
+}
+
+func (r *reader) readFile(p string) []byte {
+	e := r.lookup(p)
+	return r.chain(e.cluster)[:e.size]
+}
+
+func TestImage(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	mt := time.Date(2020, 5, 17, 12, 30, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"README":                      {Data: []byte("hello\n"), ModTime: mt},
+		"config/network.conf":         {Data: []byte("dhcp\n")},
+		"config/a very long name.txt": {Data: big},
+		"config/a very long name.dat": {Data: []byte("x")},
+		"empty":                       {},
+		"deep/a/b/c/file":             {Data: []byte("deep")},
+	}
+	im, err := New(fsys, WithClusterSize(512), WithLabel("config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReader(t, im)
+
+	for name, f := range fsys {
+		if got := r.readFile(name); !bytes.Equal(got, f.Data) {
+			t.Errorf("%s has contents %q, want %q", name, got, f.Data)
+		}
+	}
+	if e := r.lookup("config"); e.attr&attrDir == 0 {
+		t.Errorf("config has attributes %#x, want directory", e.attr)
+	}
+	if e := r.lookup("README"); e.short != "README     " {
+		t.Errorf("README has short name %q, want %q", e.short, "README     ")
+	}
+	if e := r.lookup("empty"); e.short != "EMPTY      " {
+		t.Errorf("empty has short name %q, want %q", e.short, "EMPTY      ")
+	}
+	shorts := make(map[string]bool)
+	for _, e := range r.readDir(r.lookup("config").cluster) {
+		if shorts[e.short] {
+			t.Errorf("duplicate short name %q", e.short)
+		}
+		shorts[e.short] = true
+	}
+	if e := r.readDir(r.lookup("deep/a").cluster); len(e) != 3 || e[0].short != ".          " || e[1].short != "..         " {
+		t.Errorf("deep/a contains %+v, want ., .. and b", e)
+	}
+
+	if _, err := im.WriteAt([]byte{1}, 0); err == nil {
+		t.Error("WriteAt succeeded")
+	}
+	ext, err := im.ReportExtents(0, im.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ext) != 2 || ext[1].Offset+ext[1].Length != uint64(im.Size()) || ext[1].Flags == 0 {
+		t.Errorf("ReportExtents() = %+v, want data followed by a hole", ext)
+	}
+
+	if _, err := New(fstest.MapFS{"a:b": {}}); err == nil {
+		t.Error("New succeeded with invalid file name")
+	}
+}
@@ -0,0 +1,496 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fault provides an nbd.Device injecting faults according to a plan.
+//
+// A Plan is a list of rules, which match requests by operation, offset range,
+// number of matching requests, time and probability. A matching rule can
+// inject an error, a delay or make the request hang. It can also silently
+// corrupt data, by flipping bits, dropping writes or writing to the wrong
+// offset. Plans can be written in Go or loaded from JSON, like
+//
+//	{"seed": 42, "rules": [
+//		{"op": "write", "after": 999, "count": 1, "error": "ENOSPC"},
+//		{"op": "read", "offset": 0, "length": 65536, "error": "EIO"},
+//		{"op": "flush", "from": "10s", "delay": "2s"},
+//		{"op": "write", "probability": 0.001, "flip": 1}
+//	]}
+//
+// which fails the 1000th write with ENOSPC, all reads of the first 64KiB with
+// EIO, delays all flushes by two seconds, after the first ten seconds, and
+// flips a bit in one of every thousand writes. Random decisions are derived
+// from the seed, so they are reproducible for the same sequence of requests.
+package fault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+// Op is an operation rules can match on.
+type Op = nbd.Op
+
+const (
+	// Any matches all operations.
+	Any         = nbd.OpAny
+	Read        = nbd.OpRead
+	Write       = nbd.OpWrite
+	Trim        = nbd.OpTrim
+	WriteZeroes = nbd.OpWriteZeroes
+	Flush       = nbd.OpFlush
+)
+
+var errnos = map[string]nbd.Errno{
+	"EPERM":     nbd.EPERM,
+	"EIO":       nbd.EIO,
+	"ENOMEM":    nbd.ENOMEM,
+	"EINVAL":    nbd.EINVAL,
+	"ENOSPC":    nbd.ENOSPC,
+	"EOVERFLOW": nbd.EOVERFLOW,
+	"ESHUTDOWN": nbd.ESHUTDOWN,
+}
+
+// Rule describes a fault to inject.
+type Rule struct {
+	// Op is the operation to match. Write also matches writes with FUA.
+	Op Op
+	// Offset and Length restrict the rule to requests overlapping the
+	// range. If Length is 0, the range extends to the end of the device.
+	// Rules with a range never match flushes.
+	Offset int64
+	Length int64
+	// After is the number of matching requests to let through, before the
+	// rule fires.
+	After int
+	// Count is the number of times the rule fires. If it is 0, the rule
+	// fires on all matching requests.
+	Count int
+	// From and Until restrict the rule to requests made in the given time
+	// span, relative to the creation of the Device. If Until is 0, the
+	// span is unlimited.
+	From  time.Duration
+	Until time.Duration
+	// Probability is the probability with which the rule fires for a
+	// matching request. If it is 0, the rule always fires.
+	Probability float64
+
+	// Delay delays the request.
+	Delay time.Duration
+	// Hang makes the request hang until the Device is closed. Afterwards,
+	// it fails with Err, or EIO.
+	Hang bool
+	// Err is the error returned for the request. If it is 0, the request
+	// is passed on to the underlying device, after the delay.
+	Err nbd.Errno
+
+	// FlipBits is the number of random bits to flip in the data of a read
+	// or write.
+	FlipBits int
+	// Drop makes writes, trims and flushes report success, without
+	// passing them on to the underlying device.
+	Drop bool
+	// Misdirect is added to the offset of writes, trims and write zeroes.
+	// Failures of misdirected requests are not reported.
+	Misdirect int64
+}
+
+// ranged returns whether r is restricted to an offset range.
+func (r *Rule) ranged() bool {
+	return r.Offset != 0 || r.Length != 0
+}
+
+// match returns whether r matches the request, not taking After and Count
+// into account.
+func (r *Rule) match(op Op, off, length int64, t time.Duration) bool {
+	if r.Op != Any && r.Op != op {
+		return false
+	}
+	if t < r.From || (r.Until != 0 && t >= r.Until) {
+		return false
+	}
+	if !r.ranged() {
+		return true
+	}
+	if op == Flush {
+		return false
+	}
+	return off+length > r.Offset && (r.Length == 0 || off < r.Offset+r.Length)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Operations are given by name
+// ("read", "write", "trim", "zero" or "flush"), durations as strings like
+// "1.5s" and errors by name, like "EIO".
+func (r *Rule) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Op     string `json:"op"`
+		Offset int64  `json:"offset"`
+		Length int64  `json:"length"`
+		After  int    `json:"after"`
+		Count  int    `json:"count"`
+		From   string `json:"from"`
+		Until  string `json:"until"`
+		Delay  string `json:"delay"`
+		Hang   bool   `json:"hang"`
+		Error  string `json:"error"`
+
+		Probability float64 `json:"probability"`
+		Flip        int     `json:"flip"`
+		Drop        bool    `json:"drop"`
+		Misdirect   int64   `json:"misdirect"`
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&v); err != nil {
+		return err
+	}
+	*r = Rule{
+		Offset:      v.Offset,
+		Length:      v.Length,
+		After:       v.After,
+		Count:       v.Count,
+		Probability: v.Probability,
+		Hang:        v.Hang,
+		FlipBits:    v.Flip,
+		Drop:        v.Drop,
+		Misdirect:   v.Misdirect,
+	}
+	op, err := nbd.ParseOp(v.Op)
+	if err != nil {
+		return err
+	}
+	r.Op = op
+	for _, d := range []struct {
+		s string
+		p *time.Duration
+	}{{v.From, &r.From}, {v.Until, &r.Until}, {v.Delay, &r.Delay}} {
+		if d.s == "" {
+			continue
+		}
+		if *d.p, err = time.ParseDuration(d.s); err != nil {
+			return err
+		}
+	}
+	if v.Error != "" {
+		var ok bool
+		if r.Err, ok = errnos[v.Error]; !ok {
+			return fmt.Errorf("unknown error %q", v.Error)
+		}
+	}
+	return nil
+}
+
+// Plan is a list of rules. For each request, the first rule which matches
+// and fires is used. Seed is used for all random decisions.
+type Plan struct {
+	Seed  uint64 `json:"seed"`
+	Rules []Rule `json:"rules"`
+}
+
+// ParsePlan parses a JSON encoded Plan.
+func ParsePlan(r io.Reader) (Plan, error) {
+	var p Plan
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&p); err != nil {
+		return Plan{}, fmt.Errorf("invalid fault plan: %w", err)
+	}
+	return p, nil
+}
+
+// Event describes an injected fault.
+type Event struct {
+	// Rule is the index of the rule in the plan.
+	Rule   int
+	Op     Op
+	Offset int64
+	Length int64
+	// Fault describes what was injected, like "EIO", "dropped" or
+	// "flipped bit 3 at 4096".
+	Fault string
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("rule %d: %s [%d,%d): %s", e.Rule, e.Op, e.Offset, e.Offset+e.Length, e.Fault)
+}
+
+// Option is an option for New.
+type Option func(*Device)
+
+// WithLog makes the Device call f for every injected fault. f is called
+// synchronously and must not call methods of the Device.
+func WithLog(f func(Event)) Option {
+	return func(d *Device) {
+		d.log = f
+	}
+}
+
+// Device is an nbd.Device injecting faults into requests to an underlying
+// device. It implements nbd.Trimmer, nbd.ZeroWriter, nbd.FUAWriter and
+// nbd.ExtentReporter, passing requests on to the underlying device, if it
+// supports them.
+type Device struct {
+	d     nbd.Device
+	start time.Time
+	done  chan struct{}
+	once  sync.Once
+	log   func(Event)
+
+	mu    sync.Mutex
+	rnd   *rand.Rand
+	rules []Rule
+	hits  []int
+	fired []int
+}
+
+// New returns a Device injecting faults into requests to d according to p.
+func New(d nbd.Device, p Plan, opts ...Option) *Device {
+	f := &Device{
+		d:     d,
+		start: time.Now(),
+		done:  make(chan struct{}),
+		log:   func(Event) {},
+		rnd:   rand.New(rand.NewPCG(p.Seed, 0)),
+		rules: p.Rules,
+		hits:  make([]int, len(p.Rules)),
+		fired: make([]int, len(p.Rules)),
+	}
+	for _, o := range opts {
+		o(f)
+	}
+	return f
+}
+
+// Close releases all hanging requests and stops all delays. It does not close
+// the underlying device.
+func (f *Device) Close() error {
+	f.once.Do(func() { close(f.done) })
+	return nil
+}
+
+// Injected returns the number of faults injected so far.
+func (f *Device) Injected() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.fired {
+		n += c
+	}
+	return n
+}
+
+// fault is a rule firing for a request.
+type fault struct {
+	*Rule
+	ev Event
+	f  *Device
+}
+
+// logf logs an injected fault.
+func (ft *fault) logf(format string, v ...any) {
+	ev := ft.ev
+	ev.Fault = fmt.Sprintf(format, v...)
+	ft.f.log(ev)
+}
+
+// flip flips random bits in p, which contains the data at off.
+func (ft *fault) flip(p []byte, off int64) {
+	if ft.FlipBits <= 0 || len(p) == 0 {
+		return
+	}
+	ft.f.mu.Lock()
+	bits := make([]int64, ft.FlipBits)
+	for i := range bits {
+		bits[i] = ft.f.rnd.Int64N(int64(len(p)) * 8)
+	}
+	ft.f.mu.Unlock()
+	for _, b := range bits {
+		p[b/8] ^= 1 << (b % 8)
+		ft.logf("flipped bit %d at %d", b%8, off+b/8)
+	}
+}
+
+// inject applies the delay, hang and error of the first rule firing for a
+// request. It returns the firing rule, if any, and the error to return for
+// the request.
+func (f *Device) inject(op Op, off, length int64) (*fault, error) {
+	t := time.Since(f.start)
+	f.mu.Lock()
+	var ft *fault
+	for i := range f.rules {
+		r := &f.rules[i]
+		if !r.match(op, off, length, t) {
+			continue
+		}
+		if f.hits[i]++; f.hits[i] <= r.After || (r.Count > 0 && f.fired[i] >= r.Count) {
+			continue
+		}
+		if r.Probability > 0 && f.rnd.Float64() >= r.Probability {
+			continue
+		}
+		f.fired[i]++
+		ft = &fault{r, Event{Rule: i, Op: op, Offset: off, Length: length}, f}
+		break
+	}
+	f.mu.Unlock()
+	if ft == nil {
+		return nil, nil
+	}
+	if ft.Delay > 0 {
+		ft.logf("delayed by %v", ft.Delay)
+		tm := time.NewTimer(ft.Delay)
+		select {
+		case <-tm.C:
+		case <-f.done:
+			tm.Stop()
+		}
+	}
+	if ft.Hang {
+		ft.logf("hanging")
+		<-f.done
+		if ft.Err == 0 {
+			return nil, nbd.EIO
+		}
+	}
+	if ft.Err != 0 {
+		ft.logf("%v", errName(ft.Err))
+		return nil, ft.Err
+	}
+	return ft, nil
+}
+
+// errName returns the name of e.
+func errName(e nbd.Errno) string {
+	for name, v := range errnos {
+		if v == e {
+			return name
+		}
+	}
+	return e.Error()
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *Device) ReadAt(p []byte, off int64) (int, error) {
+	ft, err := f.inject(Read, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.d.ReadAt(p, off)
+	if ft != nil {
+		ft.flip(p[:n], off)
+	}
+	return n, err
+}
+
+// write passes a write on to do, applying the corruption of ft. do is called
+// with the offset to write to and the data to write.
+func (f *Device) write(ft *fault, p []byte, off int64, do func([]byte, int64) error) error {
+	if ft == nil {
+		return do(p, off)
+	}
+	if ft.Drop {
+		ft.logf("dropped")
+		return nil
+	}
+	if ft.FlipBits > 0 && p != nil {
+		p = bytes.Clone(p)
+		ft.flip(p, off)
+	}
+	if ft.Misdirect != 0 {
+		ft.logf("misdirected to %d", off+ft.Misdirect)
+		do(p, off+ft.Misdirect)
+		return nil
+	}
+	return do(p, off)
+}
+
+// WriteAt implements io.WriterAt.
+func (f *Device) WriteAt(p []byte, off int64) (int, error) {
+	ft, err := f.inject(Write, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	err = f.write(ft, p, off, func(p []byte, off int64) error {
+		_, err := f.d.WriteAt(p, off)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteFUA implements nbd.FUAWriter.
+func (f *Device) WriteFUA(p []byte, off int64) (int, error) {
+	ft, err := f.inject(Write, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	err = f.write(ft, p, off, func(p []byte, off int64) error {
+		_, err := nbd.WriteFUA(f.d, p, off)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sync implements nbd.Device.
+func (f *Device) Sync() error {
+	ft, err := f.inject(Flush, 0, 0)
+	if err != nil {
+		return err
+	}
+	if ft != nil && ft.Drop {
+		ft.logf("dropped")
+		return nil
+	}
+	return f.d.Sync()
+}
+
+// Trim implements nbd.Trimmer. It is a no-op, if the underlying device does
+// not support trimming.
+func (f *Device) Trim(off, length int64) error {
+	ft, err := f.inject(Trim, off, length)
+	if err != nil {
+		return err
+	}
+	return f.write(ft, nil, off, func(_ []byte, off int64) error {
+		return nbd.Trim(f.d, off, length)
+	})
+}
+
+// WriteZeroes implements nbd.ZeroWriter.
+func (f *Device) WriteZeroes(off, length int64, punch bool) error {
+	ft, err := f.inject(WriteZeroes, off, length)
+	if err != nil {
+		return err
+	}
+	return f.write(ft, nil, off, func(_ []byte, off int64) error {
+		return nbd.WriteZeroes(f.d, off, length, punch)
+	})
+}
+
+// ReportExtents implements nbd.ExtentReporter. Faults are not injected into
+// it.
+func (f *Device) ReportExtents(off, length int64) ([]nbd.Extent, error) {
+	return nbd.ReportExtents(f.d, off, length)
+}
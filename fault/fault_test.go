@@ -0,0 +1,170 @@
+package fault
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+func TestParsePlan(t *testing.T) {
+	p, err := ParsePlan(strings.NewReader(`{"seed": 42, "rules": [
+		{"op": "write", "after": 999, "count": 1, "error": "ENOSPC"},
+		{"op": "read", "offset": 4096, "length": 4096, "error": "EIO"},
+		{"from": "10s", "delay": "1.5s", "hang": true},
+		{"op": "write", "probability": 0.25, "flip": 2, "misdirect": -512},
+		{"op": "flush", "drop": true}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{Op: Write, After: 999, Count: 1, Err: nbd.ENOSPC},
+		{Op: Read, Offset: 4096, Length: 4096, Err: nbd.EIO},
+		{From: 10 * time.Second, Delay: 1500 * time.Millisecond, Hang: true},
+		{Op: Write, Probability: 0.25, FlipBits: 2, Misdirect: -512},
+		{Op: Flush, Drop: true},
+	}
+	if p.Seed != 42 {
+		t.Errorf("ParsePlan returned seed %d, want 42", p.Seed)
+	}
+	if len(p.Rules) != len(want) {
+		t.Fatalf("ParsePlan returned %d rules, want %d", len(p.Rules), len(want))
+	}
+	for i := range want {
+		if p.Rules[i] != want[i] {
+			t.Errorf("rule %d = %+v, want %+v", i, p.Rules[i], want[i])
+		}
+	}
+
+	for _, s := range []string{
+		`{"rules": [{"op": "frobnicate"}]}`,
+		`{"rules": [{"error": "EFOO"}]}`,
+		`{"rules": [{"delay": "soon"}]}`,
+		`{"rules": [{"offest": 5}]}`,
+	} {
+		if _, err := ParsePlan(strings.NewReader(s)); err == nil {
+			t.Errorf("ParsePlan(%s) succeeded", s)
+		}
+	}
+}
+
+func TestDevice(t *testing.T) {
+	d := New(nbd.NewMemDevice(1<<16), Plan{Rules: []Rule{
+		{Op: Write, After: 9, Count: 1, Err: nbd.ENOSPC},
+		{Op: Read, Offset: 4096, Length: 4096, Err: nbd.EIO},
+		{Op: Flush, Hang: true},
+	}})
+	defer d.Close()
+
+	for i := 1; i <= 12; i++ {
+		_, err := d.WriteAt([]byte{1}, 0)
+		if want := i == 10; (err != nil) != want {
+			t.Errorf("write %d returned %v, want error: %v", i, err, want)
+		} else if want && !errors.Is(err, nbd.ENOSPC) {
+			t.Errorf("write %d returned %v, want %v", i, err, nbd.ENOSPC)
+		}
+	}
+
+	b := make([]byte, 100)
+	for _, tc := range []struct {
+		off  int64
+		fail bool
+	}{{0, false}, {4000, true}, {4096, true}, {8191, true}, {8192, false}} {
+		if _, err := d.ReadAt(b, tc.off); (err != nil) != tc.fail {
+			t.Errorf("ReadAt(%d) = %v, want error: %v", tc.off, err, tc.fail)
+		}
+	}
+	if err := d.WriteZeroes(4096, 4096, true); err != nil {
+		t.Errorf("WriteZeroes() = %v, want nil", err)
+	}
+
+	ch := make(chan error)
+	go func() { ch <- d.Sync() }()
+	select {
+	case err := <-ch:
+		t.Fatalf("Sync() did not hang, returned %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	d.Close()
+	if err := <-ch; !errors.Is(err, nbd.EIO) {
+		t.Errorf("hanging Sync() returned %v after Close, want %v", err, nbd.EIO)
+	}
+	if n := d.Injected(); n != 5 {
+		t.Errorf("Injected() = %d, want 5", n)
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	const size = 1 << 16
+	plan := Plan{Seed: 7, Rules: []Rule{
+		{Op: Write, Offset: 0, Length: 4096, Drop: true},
+		{Op: Write, Offset: 4096, Length: 4096, Misdirect: 8192},
+		{Op: Write, Offset: 16384, Length: 4096, FlipBits: 3},
+		{Op: Read, Offset: 32768, Length: 4096, Probability: 0.5, FlipBits: 1},
+	}}
+	// run does a fixed sequence of requests and returns the logged events
+	// and the contents of the device.
+	run := func() ([]Event, []byte) {
+		var events []Event
+		base := nbd.NewMemDevice(size)
+		d := New(base, plan, WithLog(func(e Event) { events = append(events, e) }))
+		defer d.Close()
+		data := bytes.Repeat([]byte{0xff}, 100)
+		for _, off := range []int64{0, 4096, 16384, 32768} {
+			if _, err := d.WriteAt(data, off); err != nil {
+				t.Fatalf("WriteAt(%d) = %v", off, err)
+			}
+		}
+		b := make([]byte, 100)
+		for i := 0; i < 20; i++ {
+			d.ReadAt(b, 32768)
+		}
+		all := make([]byte, size)
+		base.ReadAt(all, 0)
+		return events, all
+	}
+	events, got := run()
+
+	ones := func(off int64) int {
+		n := 0
+		for _, b := range got[off : off+100] {
+			n += bits.OnesCount8(b)
+		}
+		return n
+	}
+	if n := ones(0); n != 0 {
+		t.Errorf("dropped write persisted %d bits", n)
+	}
+	if n, m := ones(4096), ones(12288); n != 0 || m != 800 {
+		t.Errorf("misdirected write persisted %d bits at offset and %d bits at target, want 0 and 800", n, m)
+	}
+	if n := ones(16384); n < 794 || n > 799 || n%2 != 1 {
+		t.Errorf("write with 3 flipped bits persisted %d bits", n)
+	}
+	if n := ones(32768); n != 800 {
+		t.Errorf("flipping bits on read changed the device")
+	}
+
+	var reads int
+	for _, e := range events {
+		if e.Op == Read {
+			reads++
+		}
+	}
+	if reads == 0 || reads == 20 {
+		t.Errorf("read rule with probability 0.5 fired %d of 20 times", reads)
+	}
+	if len(events) != reads+5 {
+		t.Errorf("got %d events, want %d", len(events), reads+5)
+	}
+	events2, got2 := run()
+	if !reflect.DeepEqual(events, events2) || !bytes.Equal(got, got2) {
+		t.Error("runs with the same seed differ")
+	}
+}
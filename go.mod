@@ -1,11 +1,12 @@
 module github.com/Merovius/nbd
 
-go 1.20
+go 1.23
 
 require (
 	github.com/google/subcommands v1.2.0
 	github.com/mdlayher/genetlink v1.3.2
 	github.com/mdlayher/netlink v1.7.2
+	golang.org/x/sync v0.2.0
 	golang.org/x/sys v0.13.0
 )
 
@@ -14,5 +15,4 @@ require (
 	github.com/josharian/native v1.1.0 // indirect
 	github.com/mdlayher/socket v0.4.1 // indirect
 	golang.org/x/net v0.17.0 // indirect
-	golang.org/x/sync v0.2.0 // indirect
 )
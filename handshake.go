@@ -16,11 +16,15 @@ package nbd
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
+	"strings"
+	"time"
 )
 
 // Export specifies the data needed for the NBD network protocol.
@@ -28,9 +32,31 @@ type Export struct {
 	Name        string
 	Description string
 	Size        uint64
-	Flags       uint16 // TODO: Determine Flags from Device.
+	Flags       uint16 // Combined with the flags implied by Device.
 	BlockSizes  *BlockSizeConstraints
 	Device      Device
+
+	// Ephemeral gives each connection its own copy-on-write Overlay of
+	// Device, kept in memory and discarded when the connection is closed.
+	// If Save is set, clients can connect to the export name followed by
+	// "@<name>", to have the overlay passed to Save when they disconnect.
+	Ephemeral bool
+	Save      func(name string, o *Overlay) error
+
+	// Views, if set, is called to list additional exports derived from this
+	// one, like the snapshots of a SnapshotDevice. They are listed after it
+	// and can be connected to by name.
+	Views func() []Export
+
+	// Lookup, if set, is called when a client asks for an export named like
+	// this one, followed by "@<suffix>", which does not exist otherwise. It
+	// can provide exports with synthetic names, which are not listed, like
+	// the views of the history of a device. If it returns false, the name
+	// is handled as if Lookup was not set.
+	Lookup func(suffix string) (Export, bool)
+
+	// saveAs is the name a client asked the overlay to be saved as.
+	saveAs string
 }
 
 // BlockSizeConstraints optionally specifies possible block sizes for a given
@@ -41,11 +67,97 @@ type BlockSizeConstraints struct {
 	Max       uint32
 }
 
+// deviceFlags returns the transmission flags implied by the optional
+// interfaces implemented by d.
+func deviceFlags(d Device) uint16 {
+	flags := uint16(FlagHasFlags | FlagSendFlush | FlagSendFUA | FlagSendWriteZeroes)
+	if _, ok := d.(Trimmer); ok {
+		flags |= FlagSendTrim
+	}
+	return flags
+}
+
+// exportFlags returns the transmission flags of e, combined with the flags
+// implied by the device serving it. For ephemeral exports, that is the
+// Overlay of the connection. Read-only exports do not advertise commands
+// modifying data.
+func exportFlags(e Export) uint16 {
+	var d Device = e.Device
+	if e.Ephemeral {
+		d = (*Overlay)(nil)
+	}
+	flags := e.Flags | deviceFlags(d)
+	if flags&FlagReadOnly != 0 {
+		flags &^= FlagSendTrim | FlagSendWriteZeroes | FlagSendFUA
+	}
+	return flags
+}
+
 var defaultBlockSizes = BlockSizeConstraints{1, 4096, 0xffffffff}
 
+// validate checks that b is valid according to the NBD protocol.
+func (b BlockSizeConstraints) validate() error {
+	if b.Min == 0 || b.Min > 64<<10 || b.Min&(b.Min-1) != 0 {
+		return fmt.Errorf("invalid minimum block size %d", b.Min)
+	}
+	if b.Preferred == 0 || b.Preferred&(b.Preferred-1) != 0 || (b.Preferred < b.Min && b.Preferred < 4096) {
+		return fmt.Errorf("invalid preferred block size %d", b.Preferred)
+	}
+	if b.Max != 0xffffffff && (b.Max < b.Min || b.Max%b.Min != 0) {
+		return fmt.Errorf("invalid maximum block size %d", b.Max)
+	}
+	return nil
+}
+
+// effective returns the constraints a client has to honor, if the server
+// sent b. Max is clamped to the largest payload the package supports.
+func (b *BlockSizeConstraints) effective() BlockSizeConstraints {
+	eff := defaultBlockSizes
+	if b != nil {
+		eff = *b
+	}
+	if eff.Max > maxPayloadSize {
+		eff.Max = maxPayloadSize - maxPayloadSize%eff.Min
+	}
+	return eff
+}
+
 type connParameters struct {
 	Export     Export
 	BlockSizes BlockSizeConstraints
+	Structured bool
+	// Allocation is set, if the client selected the base:allocation
+	// metadata context.
+	Allocation bool
+}
+
+// baseAllocationID is the ID the server uses for the base:allocation
+// metadata context.
+const baseAllocationID = 1
+
+// matchMetaContext returns the metadata contexts matched by query, as defined
+// by NBD_OPT_LIST_META_CONTEXT. The server only supports base:allocation.
+func matchMetaContext(query string) []string {
+	switch query {
+	case "base:", BaseAllocation:
+		return []string{BaseAllocation}
+	}
+	return nil
+}
+
+// expandViews returns exp with the views of every export inserted after it.
+func expandViews(exp []Export) []Export {
+	if !slices.ContainsFunc(exp, func(e Export) bool { return e.Views != nil }) {
+		return exp
+	}
+	var out []Export
+	for _, e := range exp {
+		out = append(out, e)
+		if e.Views != nil {
+			out = append(out, e.Views()...)
+		}
+	}
+	return out
 }
 
 func serverHandshake(rw io.ReadWriter, exp []Export) (connParameters, error) {
@@ -67,6 +179,9 @@ func serverHandshake(rw io.ReadWriter, exp []Export) (connParameters, error) {
 
 		for {
 			code, o, err := decodeOption(e)
+			// Views can change at any time, so they are listed anew for
+			// every option.
+			all := expandViews(exp)
 			if err != 0 {
 				encodeReply(e, code, &repError{err, ""})
 				continue
@@ -74,29 +189,62 @@ func serverHandshake(rw io.ReadWriter, exp []Export) (connParameters, error) {
 			switch o := o.(type) {
 			case *optExportName:
 				var ok bool
-				parms.Export, ok = findExport(o.name, exp)
+				parms.Export, ok = findExport(o.name, all)
 				if !ok {
 					encodeReply(e, code, &repError{errUnknown, ""})
 					continue
 				}
+				parms.Export.Flags = exportFlags(parms.Export)
 				e.writeUint64(parms.Export.Size)
 				e.writeUint16(parms.Export.Flags)
 				return
 			case *optAbort:
 				encodeReply(e, code, &repAck{})
 				e.check(errors.New("client aborted negotiation"))
+			case *optStructuredReply:
+				parms.Structured = true
+				encodeReply(e, code, &repAck{})
+			case *optMetaContext:
+				if o.set && !parms.Structured {
+					encodeReply(e, code, &repError{errInvalid, "structured replies not negotiated"})
+					continue
+				}
+				if _, ok := findExport(o.name, all); !ok {
+					encodeReply(e, code, &repError{errUnknown, ""})
+					continue
+				}
+				queries := o.queries
+				if !o.set && len(queries) == 0 {
+					queries = []string{"base:"}
+				}
+				if o.set {
+					parms.Allocation = false
+				}
+				for _, q := range queries {
+					for _, name := range matchMetaContext(q) {
+						if o.set {
+							if parms.Allocation {
+								continue
+							}
+							parms.Allocation = true
+						}
+						encodeReply(e, code, &repMetaContext{baseAllocationID, name})
+					}
+				}
+				encodeReply(e, code, &repAck{})
 			case *optList:
-				for _, ex := range exp {
-					encodeReply(e, code, &repServer{ex.Name, ""})
+				for _, ex := range all {
+					encodeReply(e, code, &repServer{ex.Name, ex.Description})
 				}
 				encodeReply(e, code, &repAck{})
 			case *optInfo:
 				var ok bool
-				parms.Export, ok = findExport(o.name, exp)
+				parms.Export, ok = findExport(o.name, all)
 				if !ok {
 					encodeReply(e, code, &repError{errUnknown, ""})
 					continue
 				}
+				parms.Export.Flags = exportFlags(parms.Export)
 				encodeReply(e, code, &infoExport{parms.Export.Size, parms.Export.Flags})
 				for _, r := range o.reqs {
 					switch r {
@@ -110,14 +258,11 @@ func serverHandshake(rw io.ReadWriter, exp []Export) (connParameters, error) {
 						if parms.Export.BlockSizes == nil {
 							break
 						}
+						bs := *parms.Export.BlockSizes
 						if o.done {
-							parms.BlockSizes = *parms.Export.BlockSizes
+							parms.BlockSizes = bs
 						}
-						encodeReply(e, code, &infoBlockSize{
-							parms.BlockSizes.Min,
-							parms.BlockSizes.Preferred,
-							parms.BlockSizes.Max,
-						})
+						encodeReply(e, code, &infoBlockSize{bs.Min, bs.Preferred, bs.Max})
 					}
 				}
 				encodeReply(e, code, &repAck{})
@@ -132,6 +277,8 @@ func serverHandshake(rw io.ReadWriter, exp []Export) (connParameters, error) {
 // Client performs the client-side of the NBD network protocol handshake and
 // can be used to query information about the exports from a server.
 type Client struct {
+	ctx    context.Context
+	nc     net.Conn
 	rw     io.ReadWriteCloser
 	closed bool
 }
@@ -139,7 +286,7 @@ type Client struct {
 // ClientHandshake starts the client-side of the NBD handshake over c.
 func ClientHandshake(ctx context.Context, c net.Conn) (*Client, error) {
 	rw := wrapConn(ctx, c)
-	cl := &Client{rw, false}
+	cl := &Client{ctx, c, rw, false}
 	return cl, do(rw, func(e *encoder) {
 		if e.uint64() != nbdMagic {
 			e.check(errors.New("invalid magic from server"))
@@ -191,6 +338,8 @@ func (c *Client) recv(e *encoder, code uint32) optionReply {
 		rep = new(repAck)
 	case cRepServer:
 		rep = new(repServer)
+	case cRepMetaContext:
+		rep = new(repMetaContext)
 	case cRepInfo:
 		return decodeInfo(e, length)
 	default:
@@ -222,9 +371,111 @@ func (c *Client) Abort() error {
 	})
 }
 
+// StartTLS upgrades the connection to TLS, using cfg. All further
+// communication with the server, including the transmission phase, has to use
+// the connection returned by NetConn.
+func (c *Client) StartTLS(cfg *tls.Config) error {
+	err := do(c.rw, func(e *encoder) {
+		c.send(e, &optStartTLS{})
+		switch c.recv(e, cOptStartTLS).(type) {
+		case *repAck:
+		default:
+			e.check(errors.New("invalid response to starttls request"))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// Closing rw expires the deadline of nc, so we have to reset it.
+	c.rw.Close()
+	if err := c.nc.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	tc := tls.Client(c.nc, cfg)
+	if err := tc.HandshakeContext(c.ctx); err != nil {
+		return err
+	}
+	c.nc = tc
+	c.rw = wrapConn(c.ctx, tc)
+	return nil
+}
+
+// StructuredReplies requests the use of structured replies in transmission
+// phase. Conn negotiates them automatically.
+func (c *Client) StructuredReplies() error {
+	return do(c.rw, func(e *encoder) {
+		c.send(e, &optStructuredReply{})
+		switch c.recv(e, cOptStructuredReply).(type) {
+		case *repAck:
+		default:
+			e.check(errors.New("invalid response to structured reply request"))
+		}
+	})
+}
+
+// ListMetaContexts returns the metadata contexts available for the given
+// export, which match any of the queries. If no queries are given, all
+// contexts are returned.
+func (c *Client) ListMetaContexts(exportName string, queries ...string) ([]string, error) {
+	var list []string
+	err := do(c.rw, func(e *encoder) {
+		c.send(e, &optMetaContext{false, exportName, queries})
+		for {
+			switch rep := c.recv(e, cOptListMetaContext).(type) {
+			case *repAck:
+				return
+			case *repMetaContext:
+				list = append(list, rep.name)
+			default:
+				e.check(errors.New("invalid response to list meta context request"))
+			}
+		}
+	})
+	return list, err
+}
+
+// SetMetaContexts selects the metadata contexts with the given names for use
+// with the given export in transmission phase. It returns the IDs assigned by
+// the server to the contexts it selected. Structured replies must have been
+// negotiated before. Conn selects metadata contexts automatically.
+func (c *Client) SetMetaContexts(exportName string, names ...string) (map[string]uint32, error) {
+	ids := make(map[string]uint32)
+	err := do(c.rw, func(e *encoder) {
+		c.send(e, &optMetaContext{true, exportName, names})
+		for {
+			switch rep := c.recv(e, cOptSetMetaContext).(type) {
+			case *repAck:
+				return
+			case *repMetaContext:
+				ids[rep.name] = rep.id
+			default:
+				e.check(errors.New("invalid response to set meta context request"))
+			}
+		}
+	})
+	return ids, err
+}
+
+// NetConn returns the connection used by c. If StartTLS was called, it is a
+// *tls.Conn wrapping the connection passed to ClientHandshake.
+func (c *Client) NetConn() net.Conn {
+	return c.nc
+}
+
 // List returns the names of exports the server is providing.
 func (c *Client) List() ([]string, error) {
+	exp, err := c.Exports()
 	var list []string
+	for _, e := range exp {
+		list = append(list, e.Name)
+	}
+	return list, err
+}
+
+// Exports returns the exports the server is providing. Only the Name and
+// Description fields are set. Use Info to query the other fields.
+func (c *Client) Exports() ([]Export, error) {
+	var list []Export
 	err := do(c.rw, func(e *encoder) {
 		c.send(e, &optList{})
 		for {
@@ -233,7 +484,7 @@ func (c *Client) List() ([]string, error) {
 			case *repAck:
 				return
 			case *repServer:
-				list = append(list, rep.name)
+				list = append(list, Export{Name: rep.name, Description: rep.details})
 			default:
 				e.check(errors.New("invalid response to list request"))
 			}
@@ -244,6 +495,9 @@ func (c *Client) List() ([]string, error) {
 
 // into sends an NBD_OPT_INFO (if done == false) or NBD_OPT_GO (if done ==
 // true) request and returns the export data returned by the server.
+//
+// Requesting NBD_INFO_BLOCK_SIZE with NBD_OPT_GO tells the server that the
+// client will honor the block size constraints. Both Conn and Configure do.
 func (c *Client) info(exportName string, done bool) (Export, error) {
 	var ex Export
 	err := do(c.rw, func(e *encoder) {
@@ -271,11 +525,15 @@ func (c *Client) info(exportName string, done bool) (Export, error) {
 					Preferred: rep.preferred,
 					Max:       rep.max,
 				}
+				e.check(ex.BlockSizes.validate())
 			default:
 				e.check(errors.New("invalid response to info request"))
 			}
 		}
 	})
+	if isErrno(err, errBlockSizeReqd) {
+		err = fmt.Errorf("export %q requires block size constraints to be honored: %w", exportName, err)
+	}
 	return ex, err
 }
 
@@ -301,6 +559,13 @@ func (c *Client) close() error {
 	return c.rw.Close()
 }
 
+// isErrno returns whether err is an error reply to an option with the given
+// code.
+func isErrno(err error, code errno) bool {
+	var re *repError
+	return errors.As(err, &re) && re.errno == code
+}
+
 // findExport searches the list of exports for one with the given name. If name
 // is empty, it returns the first export. findExport performs a linear search,
 // so it doesn't scale to a large number of exports, but we assume for now that
@@ -314,6 +579,18 @@ func findExport(name string, exp []Export) (Export, bool) {
 			return e, true
 		}
 	}
+	if i := strings.LastIndexByte(name, '@'); i >= 0 && i < len(name)-1 {
+		e, ok := findExport(name[:i], exp)
+		if ok && e.Lookup != nil {
+			if v, ok := e.Lookup(name[i+1:]); ok {
+				return v, true
+			}
+		}
+		if ok && e.Ephemeral && e.Save != nil {
+			e.saveAs = name[i+1:]
+			return e, true
+		}
+	}
 	return Export{}, false
 }
 
@@ -353,6 +630,10 @@ func (e *encoder) write(b []byte) {
 		e.buf = append(e.buf, b...)
 		return
 	}
+	if len(b) == 0 {
+		// Some connections (like net.Pipe) block on empty writes.
+		return
+	}
 	_, err := e.rw.Write(b)
 	e.check(err)
 }
@@ -382,7 +663,7 @@ func (e *encoder) read(b []byte) {
 func (e *encoder) discard(n uint32) {
 	buf := make([]byte, 512)
 	for n > 0 {
-		if n > uint32(len(buf)) {
+		if n < uint32(len(buf)) {
 			buf = buf[:n]
 		}
 		e.read(buf)
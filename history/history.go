@@ -0,0 +1,293 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package history implements an nbd.Device keeping all previous versions of
+// modified blocks, so it can be read as of any earlier point in time. Every
+// modification is assigned a sequence number, starting at 1, which identifies
+// the state of the device after it.
+//
+// This is meant for debugging: If a filesystem turns out to be corrupted after
+// a test, bisecting over the sequence numbers finds the write which introduced
+// the damage. As nothing is ever dropped, the history grows by a block for
+// every block modified.
+package history
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/Merovius/nbd"
+)
+
+// blockSize is the granularity with which versions are kept.
+const blockSize = 4096
+
+// Write describes a modification of the device.
+type Write struct {
+	Seq    uint64
+	Offset int64
+	Length int64
+}
+
+// version is the content a block had before the write with sequence number
+// seq. data is nil if the block was all zeroes.
+type version struct {
+	seq  uint64
+	data []byte
+}
+
+// Device is an nbd.Device keeping the history of an underlying device.
+//
+// Device implements nbd.Trimmer, nbd.ZeroWriter and nbd.ExtentReporter,
+// regardless of whether the underlying device does.
+type Device struct {
+	mu       sync.RWMutex
+	d        nbd.Device
+	size     int64
+	writes   []Write
+	versions map[int64][]version
+}
+
+// New returns a Device of the given size, keeping the history of d.
+func New(d nbd.Device, size int64) *Device {
+	return &Device{
+		d:        d,
+		size:     size,
+		versions: make(map[int64][]version),
+	}
+}
+
+// Seq returns the sequence number of the last modification, or 0 if there
+// was none.
+func (h *Device) Seq() uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return uint64(len(h.writes))
+}
+
+// Writes returns all modifications, ordered by sequence number.
+func (h *Device) Writes() []Write {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return slices.Clone(h.writes)
+}
+
+// check validates the range of length bytes at off.
+func (h *Device) check(off, length int64) error {
+	if off < 0 || length < 0 {
+		return nbd.EINVAL
+	}
+	if length > h.size-off {
+		return nbd.ENOSPC
+	}
+	return nil
+}
+
+// modify saves the current contents of all blocks overlapping the range of
+// length bytes at off, before calling f to modify it. If f succeeds, the
+// modification is assigned the next sequence number.
+func (h *Device) modify(off, length int64, f func() error) error {
+	if err := h.check(off, length); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var old [][]byte
+	if length > 0 {
+		for blk := off / blockSize; blk <= (off+length-1)/blockSize; blk++ {
+			b := make([]byte, min(blockSize, h.size-blk*blockSize))
+			if _, err := h.d.ReadAt(b, blk*blockSize); err != nil && err != io.EOF {
+				return err
+			}
+			if nbd.IsZero(b) {
+				b = nil
+			}
+			old = append(old, b)
+		}
+	}
+	if err := f(); err != nil {
+		return err
+	}
+	seq := uint64(len(h.writes)) + 1
+	for i, b := range old {
+		blk := off/blockSize + int64(i)
+		h.versions[blk] = append(h.versions[blk], version{seq, b})
+	}
+	h.writes = append(h.writes, Write{seq, off, length})
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (h *Device) ReadAt(p []byte, off int64) (int, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.d.ReadAt(p, off)
+}
+
+// WriteAt implements io.WriterAt.
+func (h *Device) WriteAt(p []byte, off int64) (n int, err error) {
+	err = h.modify(off, int64(len(p)), func() error {
+		n, err = h.d.WriteAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+// Sync implements nbd.Device.
+func (h *Device) Sync() error {
+	return h.d.Sync()
+}
+
+// Trim implements nbd.Trimmer. If the underlying device is not an
+// nbd.Trimmer, it does nothing.
+func (h *Device) Trim(off, length int64) error {
+	t, ok := h.d.(nbd.Trimmer)
+	if !ok {
+		return nil
+	}
+	return h.modify(off, length, func() error {
+		return t.Trim(off, length)
+	})
+}
+
+// WriteZeroes implements nbd.ZeroWriter.
+func (h *Device) WriteZeroes(off, length int64, punch bool) error {
+	return h.modify(off, length, func() error {
+		return nbd.WriteZeroes(h.d, off, length, punch)
+	})
+}
+
+// ReportExtents implements nbd.ExtentReporter. If the underlying device is
+// not an nbd.ExtentReporter, the range is reported as allocated.
+func (h *Device) ReportExtents(off, length int64) ([]nbd.Extent, error) {
+	if r, ok := h.d.(nbd.ExtentReporter); ok {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		return r.ReportExtents(off, length)
+	}
+	if off < 0 || length < 0 {
+		return nil, nbd.EINVAL
+	}
+	return []nbd.Extent{{Offset: uint64(off), Length: uint64(min(length, h.size-off))}}, nil
+}
+
+// At returns a read-only nbd.Device with the contents of h as of the given
+// sequence number, that is after the modification with that sequence number
+// and before all later ones. Sequence number 0 gives the initial contents.
+func (h *Device) At(seq uint64) (nbd.Device, error) {
+	if cur := h.Seq(); seq > cur {
+		return nil, fmt.Errorf("sequence number %d is in the future (current is %d)", seq, cur)
+	}
+	return &view{h, seq}, nil
+}
+
+// Lookup returns a read-only export of h as of the sequence number given by
+// suffix, in decimal, using the parameters of e. It can be used as the Lookup
+// of e, so clients can connect to the export <name>@<seq>.
+func (h *Device) Lookup(e nbd.Export, suffix string) (nbd.Export, bool) {
+	seq, err := strconv.ParseUint(suffix, 10, 64)
+	if err != nil {
+		return nbd.Export{}, false
+	}
+	d, err := h.At(seq)
+	if err != nil {
+		return nbd.Export{}, false
+	}
+	return nbd.Export{
+		Name:        e.Name + "@" + suffix,
+		Description: fmt.Sprintf("%s as of write %d", e.Name, seq),
+		Size:        e.Size,
+		Flags:       e.Flags | nbd.FlagReadOnly,
+		BlockSizes:  e.BlockSizes,
+		Device:      d,
+	}, true
+}
+
+// view is a read-only view of a Device as of a sequence number.
+type view struct {
+	h   *Device
+	seq uint64
+}
+
+// old returns the content block blk had as of v.seq, if it was modified
+// since. v.h.mu must be held.
+func (v *view) old(blk int64) (data []byte, ok bool) {
+	vs := v.h.versions[blk]
+	// The first version saved after v.seq holds the content as of v.seq.
+	i, _ := slices.BinarySearchFunc(vs, v.seq+1, func(x version, seq uint64) int {
+		switch {
+		case x.seq < seq:
+			return -1
+		case x.seq > seq:
+			return 1
+		}
+		return 0
+	})
+	if i == len(vs) {
+		return nil, false
+	}
+	return vs[i].data, true
+}
+
+func (v *view) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, nbd.EINVAL
+	}
+	if off >= v.h.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > v.h.size-off {
+		p, err = p[:v.h.size-off], io.EOF
+	}
+	v.h.mu.RLock()
+	defer v.h.mu.RUnlock()
+	for n < len(p) {
+		pos := off + int64(n)
+		blk := pos / blockSize
+		end := min(off+int64(len(p)), (blk+1)*blockSize)
+		if data, ok := v.old(blk); ok {
+			if data == nil {
+				clear(p[n : n+int(end-pos)])
+			} else {
+				copy(p[n:n+int(end-pos)], data[pos-blk*blockSize:])
+			}
+			n += int(end - pos)
+			continue
+		}
+		// Read unmodified blocks in one go.
+		for end < off+int64(len(p)) {
+			if _, ok := v.old(end / blockSize); ok {
+				break
+			}
+			end = min(off+int64(len(p)), end+blockSize)
+		}
+		m, e := v.h.d.ReadAt(p[n:n+int(end-pos)], pos)
+		n += m
+		if e != nil && m < int(end-pos) {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+func (v *view) WriteAt(p []byte, off int64) (int, error) {
+	return 0, nbd.Errorf(nbd.EPERM, "history is read-only")
+}
+
+func (v *view) Sync() error {
+	return nil
+}
@@ -0,0 +1,139 @@
+package history
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/Merovius/nbd"
+)
+
+func TestDevice(t *testing.T) {
+	const size = 1<<16 + 100
+	d := New(nbd.NewMemDevice(size), size)
+
+	// Every state of the device, indexed by sequence number.
+	want := [][]byte{make([]byte, size)}
+	step := func(f func() error, mod func(b []byte)) {
+		t.Helper()
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+		b := bytes.Clone(want[len(want)-1])
+		mod(b)
+		want = append(want, b)
+	}
+	write := func(p []byte, off int64) {
+		t.Helper()
+		step(func() error {
+			_, err := d.WriteAt(p, off)
+			return err
+		}, func(b []byte) { copy(b[off:], p) })
+	}
+	write(bytes.Repeat([]byte{1}, 10000), 100)
+	write(bytes.Repeat([]byte{2}, 100), 4090)
+	write(bytes.Repeat([]byte{3}, 200), size-200)
+	step(func() error { return d.WriteZeroes(4000, 200, false) }, func(b []byte) { clear(b[4000:4200]) })
+	write(bytes.Repeat([]byte{4}, 8192), 0)
+
+	if got := d.Seq(); got != uint64(len(want)-1) {
+		t.Fatalf("Seq() = %d, want %d", got, len(want)-1)
+	}
+	if w := d.Writes(); len(w) != len(want)-1 || w[1] != (Write{2, 4090, 100}) {
+		t.Errorf("Writes() = %v", w)
+	}
+	for seq, w := range want {
+		v, err := d.At(uint64(seq))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, size)
+		if _, err := v.ReadAt(got, 0); err != nil {
+			t.Fatalf("At(%d).ReadAt = %v", seq, err)
+		}
+		if !bytes.Equal(got, w) {
+			t.Errorf("At(%d) has wrong contents", seq)
+		}
+		got = make([]byte, 300)
+		if _, err := v.ReadAt(got, 3950); err != nil || !bytes.Equal(got, w[3950:4250]) {
+			t.Errorf("At(%d).ReadAt(…, 3950) = %v, has wrong contents", seq, err)
+		}
+	}
+	if _, err := d.At(uint64(len(want))); err == nil {
+		t.Error("At succeeded for future sequence number")
+	}
+	v, _ := d.At(1)
+	if _, err := v.WriteAt([]byte{1}, 0); err == nil {
+		t.Error("write to view succeeded")
+	}
+}
+
+// failDevice fails all writes.
+type failDevice struct {
+	nbd.Device
+}
+
+func (failDevice) WriteAt(p []byte, off int64) (int, error) {
+	return 0, nbd.EIO
+}
+
+func TestFailedWrite(t *testing.T) {
+	d := New(failDevice{nbd.NewMemDevice(4096)}, 4096)
+	if _, err := d.WriteAt([]byte{1}, 0); err == nil {
+		t.Fatal("WriteAt succeeded")
+	}
+	if s, w := d.Seq(), d.Writes(); s != 0 || len(w) != 0 {
+		t.Errorf("failed write was recorded: Seq() = %d, Writes() = %v", s, w)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := New(nbd.NewMemDevice(1<<20), 1<<20)
+	d.WriteAt([]byte("foo"), 0)
+	d.WriteAt([]byte("bar"), 0)
+	exp := nbd.Export{Name: "test", Size: 1 << 20, Device: d}
+	exp.Lookup = func(s string) (nbd.Export, bool) { return d.Lookup(exp, s) }
+
+	sock := filepath.Join(t.TempDir(), "nbd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go nbd.Serve(ctx, c, exp)
+		}
+	}()
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, "unix", sock)
+	}
+
+	for name, want := range map[string]string{"test": "bar", "test@0": "\x00\x00\x00", "test@1": "foo", "test@2": "bar"} {
+		c, err := nbd.Open(ctx, dial, name)
+		if err != nil {
+			t.Errorf("Open(%q) = %v", name, err)
+			continue
+		}
+		b := make([]byte, 3)
+		if _, err := c.ReadAt(b, 0); err != nil || string(b) != want {
+			t.Errorf("%s reads %q, %v, want %q", name, b, err, want)
+		}
+		c.Close()
+	}
+	for _, name := range []string{"test@3", "test@foo"} {
+		if c, err := nbd.Open(ctx, dial, name); err == nil {
+			c.Close()
+			t.Errorf("Open(%q) succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// memChunkSize is the granularity with which a MemDevice allocates memory.
+const memChunkSize = 64 << 10
+
+// MemDevice is a sparse Device kept in memory. Memory is allocated in chunks,
+// when they are first written to. It implements Trimmer, ZeroWriter and
+// ExtentReporter, reporting unallocated chunks as holes.
+type MemDevice struct {
+	mu     sync.RWMutex
+	size   int64
+	chunks map[int64][]byte
+}
+
+// NewMemDevice returns a new MemDevice of the given size, initially filled
+// with zeroes.
+func NewMemDevice(size int64) *MemDevice {
+	return &MemDevice{size: size, chunks: make(map[int64][]byte)}
+}
+
+// Size returns the size of d.
+func (d *MemDevice) Size() int64 {
+	return d.size
+}
+
+// Allocated returns the number of bytes of memory allocated by d.
+func (d *MemDevice) Allocated() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return int64(len(d.chunks)) * memChunkSize
+}
+
+// each calls f for every chunk overlapping the range of length bytes at off,
+// with the index of the chunk and the overlapping range within it.
+func (d *MemDevice) each(off, length int64, f func(idx int64, start, end int)) {
+	for length > 0 {
+		idx, start := off/memChunkSize, int(off%memChunkSize)
+		end := int(min(memChunkSize, int64(start)+length))
+		f(idx, start, end)
+		off, length = off+int64(end-start), length-int64(end-start)
+	}
+}
+
+// ReadAt implements io.ReaderAt.
+func (d *MemDevice) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, EINVAL
+	}
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > d.size-off {
+		p, err = p[:d.size-off], io.EOF
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	d.each(off, int64(len(p)), func(idx int64, start, end int) {
+		if c := d.chunks[idx]; c != nil {
+			n += copy(p[n:], c[start:end])
+		} else {
+			clear(p[n : n+end-start])
+			n += end - start
+		}
+	})
+	return n, err
+}
+
+// WriteAt implements io.WriterAt. Writing zeroes to unallocated chunks does
+// not allocate them.
+func (d *MemDevice) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, EINVAL
+	}
+	if int64(len(p)) > d.size-off {
+		return 0, ENOSPC
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.each(off, int64(len(p)), func(idx int64, start, end int) {
+		b := p[n : n+end-start]
+		n += len(b)
+		c := d.chunks[idx]
+		if c == nil {
+			if IsZero(b) {
+				return
+			}
+			c = make([]byte, memChunkSize)
+			d.chunks[idx] = c
+		}
+		copy(c[start:end], b)
+	})
+	return n, nil
+}
+
+// Sync implements Device. It is a no-op.
+func (d *MemDevice) Sync() error {
+	return nil
+}
+
+// Trim implements Trimmer. Trimmed ranges read as zeroes.
+func (d *MemDevice) Trim(off, length int64) error {
+	return d.WriteZeroes(off, length, true)
+}
+
+// WriteZeroes implements ZeroWriter. Chunks which are entirely covered are
+// deallocated, if punch is set.
+func (d *MemDevice) WriteZeroes(off, length int64, punch bool) error {
+	if off < 0 || length < 0 {
+		return EINVAL
+	}
+	if length > d.size-off {
+		return ENOSPC
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.each(off, length, func(idx int64, start, end int) {
+		c := d.chunks[idx]
+		switch {
+		case c == nil:
+		case punch && start == 0 && end == memChunkSize:
+			delete(d.chunks, idx)
+		default:
+			clear(c[start:end])
+		}
+	})
+	return nil
+}
+
+// ReportExtents implements ExtentReporter. Unallocated chunks are reported as
+// holes.
+func (d *MemDevice) ReportExtents(off, length int64) ([]Extent, error) {
+	if off < 0 || length < 0 {
+		return nil, EINVAL
+	}
+	length = min(length, d.size-off)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var ext []Extent
+	d.each(off, length, func(idx int64, start, end int) {
+		var flags uint32
+		if d.chunks[idx] == nil {
+			flags = ExtentHole | ExtentZero
+		}
+		if n := len(ext); n > 0 && ext[n-1].Flags == flags {
+			ext[n-1].Length += uint64(end - start)
+			return
+		}
+		ext = append(ext, Extent{uint64(idx*memChunkSize + int64(start)), uint64(end - start), flags})
+	})
+	return ext, nil
+}
+
+// IsZero returns whether b only contains zeroes.
+func IsZero(b []byte) bool {
+	var zero [4096]byte
+	for len(b) > 0 {
+		n := min(len(b), len(zero))
+		if !bytes.Equal(b[:n], zero[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package nbd
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMemDevice(t *testing.T) {
+	const size = 4*memChunkSize + 100
+	d := NewMemDevice(size)
+
+	if _, err := d.WriteAt(make([]byte, memChunkSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.Allocated(); n != 0 {
+		t.Errorf("writing zeroes allocated %d bytes", n)
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), memChunkSize/16)
+	if _, err := d.WriteAt(data, memChunkSize+100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.WriteAt([]byte{1}, size); err == nil {
+		t.Error("WriteAt past the end succeeded")
+	}
+
+	got := make([]byte, len(data)+200)
+	if _, err := d.ReadAt(got, memChunkSize); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(make([]byte, 100), data...), make([]byte, 100)...)
+	if !bytes.Equal(got, want) {
+		t.Error("ReadAt returned different data than written")
+	}
+	if n, err := d.ReadAt(got, size-10); n != 10 || err != io.EOF {
+		t.Errorf("ReadAt at end = %d, %v, want 10, EOF", n, err)
+	}
+
+	ext, err := d.ReportExtents(0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantExt := []Extent{
+		{0, memChunkSize, ExtentHole | ExtentZero},
+		{memChunkSize, 2 * memChunkSize, 0},
+		{3 * memChunkSize, memChunkSize + 100, ExtentHole | ExtentZero},
+	}
+	if !reflect.DeepEqual(ext, wantExt) {
+		t.Errorf("ReportExtents() = %v, want %v", ext, wantExt)
+	}
+
+	if err := d.WriteZeroes(memChunkSize, memChunkSize+100, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.Allocated(); n != memChunkSize {
+		t.Errorf("Allocated() = %d after punching, want %d", n, memChunkSize)
+	}
+	if err := d.Trim(0, size); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.Allocated(); n != 0 {
+		t.Errorf("Allocated() = %d after trimming, want 0", n)
+	}
+}
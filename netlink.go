@@ -34,15 +34,41 @@ import (
 // /dev/nbdX as a block device. Use nbdnl.Disconnect to disconnect the device
 // once you're done with it.
 //
+// The kernel only supports a single block size per device, so of
+// e.BlockSizes, only the minimum is honored. It fails if the kernel can not
+// satisfy the constraints.
+//
 // This is a Linux-only API.
 func Configure(e Export, socks ...*os.File) (uint32, error) {
 	var opts []nbdnl.ConnectOption
 	if e.BlockSizes != nil {
-		opts = append(opts, nbdnl.WithBlockSize(uint64(e.BlockSizes.Preferred)))
+		bs, err := kernelBlockSize(*e.BlockSizes, uint64(os.Getpagesize()))
+		if err != nil {
+			return 0, err
+		}
+		opts = append(opts, nbdnl.WithBlockSize(bs))
 	}
 	return nbdnl.Connect(nbdnl.IndexAny, socks, e.Size, 0, nbdnl.ServerFlags(e.Flags), opts...)
 }
 
+// kernelBlockSize returns the block size to configure the kernel with, to
+// honor b on a system with the given page size. The kernel only supports a
+// single block size, which it uses as the logical and physical block size of
+// the device, and it must be a power of two between 512 and the page size.
+// There is no way to pass on the preferred block size separately, so we use
+// the smallest valid block size compatible with b, to not make the kernel
+// align requests more coarsely than the server requires.
+func kernelBlockSize(b BlockSizeConstraints, pageSize uint64) (uint64, error) {
+	n := uint64(512)
+	for n < uint64(b.Min) {
+		n *= 2
+	}
+	if n <= uint64(b.Max) && n <= pageSize {
+		return n, nil
+	}
+	return 0, fmt.Errorf("block size constraints %d/%d/%d are not supported by the kernel", b.Min, b.Preferred, b.Max)
+}
+
 // Loopback serves d on a private socket, passing the other end to the kernel
 // to connect to an NBD device. It returns the device-number that the kernel
 // chose. wait should be called to check for errors from serving the device. It
@@ -60,7 +86,7 @@ func Loopback(ctx context.Context, d Device, size uint64) (idx uint32, wait func
 		Size:       size,
 		Device:     d,
 		BlockSizes: &defaultBlockSizes,
-		Flags:      uint16(nbdnl.FlagHasFlags | nbdnl.FlagSendFlush),
+		Flags:      deviceFlags(d),
 	}
 
 	client, server := os.NewFile(uintptr(sp[0]), "client"), os.NewFile(uintptr(sp[1]), "server")
@@ -79,7 +105,7 @@ func Loopback(ctx context.Context, d Device, size uint64) (idx uint32, wait func
 
 	var eg errgroup.Group
 	eg.Go(func() error {
-		return serve(ctx, serverc, connParameters{exp, defaultBlockSizes})
+		return serve(ctx, serverc, connParameters{Export: exp, BlockSizes: defaultBlockSizes})
 	})
 	wait = func() error {
 		err := eg.Wait()
@@ -0,0 +1,35 @@
+//go:build linux
+
+package nbd
+
+import "testing"
+
+func TestKernelBlockSize(t *testing.T) {
+	tcs := []struct {
+		b        BlockSizeConstraints
+		pageSize uint64
+		want     uint64
+		wantErr  bool
+	}{
+		{BlockSizeConstraints{1, 4096, 0xffffffff}, 4096, 512, false},
+		{BlockSizeConstraints{512, 4096, 32 << 20}, 4096, 512, false},
+		{BlockSizeConstraints{1024, 1024, 32 << 20}, 4096, 1024, false},
+		{BlockSizeConstraints{4096, 65536, 32 << 20}, 4096, 4096, false},
+		{BlockSizeConstraints{4096, 65536, 32 << 20}, 65536, 4096, false},
+		{BlockSizeConstraints{1536, 4096, 32 << 20}, 4096, 2048, false},
+		{BlockSizeConstraints{8192, 8192, 32 << 20}, 4096, 0, true},
+		{BlockSizeConstraints{1, 256, 256}, 4096, 0, true},
+	}
+	for _, tc := range tcs {
+		got, err := kernelBlockSize(tc.b, tc.pageSize)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("kernelBlockSize(%v, %d) = %d, want error", tc.b, tc.pageSize, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("kernelBlockSize(%v, %d) = %d, %v, want %d, <nil>", tc.b, tc.pageSize, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import "fmt"
+
+// Op is a kind of request to a Device. Wrappers use it to configure their
+// behavior per operation.
+type Op int
+
+const (
+	// OpAny stands for all operations.
+	OpAny Op = iota
+	OpRead
+	OpWrite
+	OpTrim
+	OpWriteZeroes
+	OpFlush
+)
+
+var opNames = [...]string{
+	OpAny:         "any",
+	OpRead:        "read",
+	OpWrite:       "write",
+	OpTrim:        "trim",
+	OpWriteZeroes: "zero",
+	OpFlush:       "flush",
+}
+
+func (o Op) String() string {
+	if o >= 0 && int(o) < len(opNames) {
+		return opNames[o]
+	}
+	return fmt.Sprintf("Op(%d)", int(o))
+}
+
+// ParseOp parses the name of an operation, as returned by String. The empty
+// string is parsed as OpAny.
+func ParseOp(s string) (Op, error) {
+	if s == "" {
+		return OpAny, nil
+	}
+	for o, n := range opNames {
+		if n == s {
+			return Op(o), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown operation %q", s)
+}
@@ -0,0 +1,21 @@
+package nbd
+
+import "testing"
+
+func TestParseOp(t *testing.T) {
+	for o := OpAny; o <= OpFlush; o++ {
+		got, err := ParseOp(o.String())
+		if err != nil || got != o {
+			t.Errorf("ParseOp(%q) = %v, %v, want %v, <nil>", o.String(), got, err, o)
+		}
+	}
+	if got, err := ParseOp(""); err != nil || got != OpAny {
+		t.Errorf(`ParseOp("") = %v, %v, want any, <nil>`, got, err)
+	}
+	if got, err := ParseOp("fsync"); err == nil {
+		t.Errorf(`ParseOp("fsync") = %v, want error`, got)
+	}
+	if s := Op(42).String(); s != "Op(42)" {
+		t.Errorf("Op(42).String() = %q, want %q", s, "Op(42)")
+	}
+}
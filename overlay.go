@@ -0,0 +1,318 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// overlayBlockSize is the granularity with which an Overlay tracks modified
+// data.
+const overlayBlockSize = 4096
+
+// Overlay is a copy-on-write Device. Reads are served from a base Device,
+// until the data is modified. Modified blocks are written to a separate top
+// Device and tracked in a bitmap, so the base is never written to, unless the
+// changes are committed. Top can be a MemDevice or a sparse file.
+//
+// Overlay implements Trimmer, ZeroWriter and ExtentReporter, regardless of
+// whether the underlying devices do.
+type Overlay struct {
+	mu    sync.RWMutex
+	base  Device
+	top   Device
+	size  int64
+	dirty []uint64
+}
+
+// NewOverlay returns an Overlay of the given size, on top of base. Changes are
+// written to top, which must be at least as large.
+func NewOverlay(base, top Device, size int64) *Overlay {
+	n := (size + overlayBlockSize - 1) / overlayBlockSize
+	return &Overlay{
+		base:  base,
+		top:   top,
+		size:  size,
+		dirty: make([]uint64, (n+63)/64),
+	}
+}
+
+func (o *Overlay) isDirty(blk int64) bool {
+	return o.dirty[blk/64]&(1<<(blk%64)) != 0
+}
+
+func (o *Overlay) setDirty(blk int64) {
+	o.dirty[blk/64] |= 1 << (blk % 64)
+}
+
+// runs calls f for each maximal run of blocks overlapping the range of length
+// bytes at off, which are either all dirty or all clean. The run is clipped to
+// the range.
+func (o *Overlay) runs(off, length int64, f func(off, length int64, dirty bool) error) error {
+	end := off + length
+	for off < end {
+		blk := off / overlayBlockSize
+		d := o.isDirty(blk)
+		next := (blk + 1) * overlayBlockSize
+		for next < end && o.isDirty(next/overlayBlockSize) == d {
+			next += overlayBlockSize
+		}
+		next = min(next, end)
+		if err := f(off, next-off, d); err != nil {
+			return err
+		}
+		off = next
+	}
+	return nil
+}
+
+// Modified returns the number of bytes modified in the overlay.
+func (o *Overlay) Modified() int64 {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	var n int64
+	for _, w := range o.dirty {
+		n += int64(bits.OnesCount64(w))
+	}
+	return min(n*overlayBlockSize, o.size)
+}
+
+// check validates the range of length bytes at off.
+func (o *Overlay) check(off, length int64) error {
+	if off < 0 || length < 0 {
+		return EINVAL
+	}
+	if length > o.size-off {
+		return ENOSPC
+	}
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (o *Overlay) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, EINVAL
+	}
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > o.size-off {
+		p, err = p[:o.size-off], io.EOF
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	e := o.runs(off, int64(len(p)), func(roff, rlen int64, dirty bool) error {
+		d := o.base
+		if dirty {
+			d = o.top
+		}
+		m, err := d.ReadAt(p[n:n+int(rlen)], roff)
+		n += m
+		if err != nil && m < int(rlen) {
+			return err
+		}
+		return nil
+	})
+	if e != nil {
+		return n, e
+	}
+	return n, err
+}
+
+// WriteAt implements io.WriterAt. Partially written blocks are first copied
+// from the base.
+func (o *Overlay) WriteAt(p []byte, off int64) (n int, err error) {
+	if err := o.check(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.copyUp(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err = o.top.WriteAt(p, off)
+	o.mark(off, int64(n))
+	return n, err
+}
+
+// copyUp copies clean blocks only partially covered by the range of length
+// bytes at off from the base to the top.
+func (o *Overlay) copyUp(off, length int64) error {
+	end := off + length
+	for _, blk := range []int64{off / overlayBlockSize, (end - 1) / overlayBlockSize} {
+		start := blk * overlayBlockSize
+		if length == 0 || o.isDirty(blk) || (start >= off && start+overlayBlockSize <= end) {
+			continue
+		}
+		b := make([]byte, min(overlayBlockSize, o.size-start))
+		if _, err := o.base.ReadAt(b, start); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := o.top.WriteAt(b, start); err != nil {
+			return err
+		}
+		o.setDirty(blk)
+	}
+	return nil
+}
+
+// mark marks all blocks overlapping the range of length bytes at off as
+// dirty.
+func (o *Overlay) mark(off, length int64) {
+	if length <= 0 {
+		return
+	}
+	for blk := off / overlayBlockSize; blk <= (off+length-1)/overlayBlockSize; blk++ {
+		o.setDirty(blk)
+	}
+}
+
+// Sync implements Device, by syncing the top device.
+func (o *Overlay) Sync() error {
+	return o.top.Sync()
+}
+
+// Trim implements Trimmer. Trimmed blocks read as zeroes.
+func (o *Overlay) Trim(off, length int64) error {
+	return o.WriteZeroes(off, length, true)
+}
+
+// WriteZeroes implements ZeroWriter.
+func (o *Overlay) WriteZeroes(off, length int64, punch bool) error {
+	if err := o.check(off, length); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.copyUp(off, length); err != nil {
+		return err
+	}
+	if err := WriteZeroes(o.top, off, length, punch); err != nil {
+		return err
+	}
+	o.mark(off, length)
+	return nil
+}
+
+// ReportExtents implements ExtentReporter. Extents are reported from the
+// layer holding the current data.
+func (o *Overlay) ReportExtents(off, length int64) ([]Extent, error) {
+	if off < 0 || length < 0 {
+		return nil, EINVAL
+	}
+	length = min(length, o.size-off)
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	var out []Extent
+	err := o.runs(off, length, func(roff, rlen int64, dirty bool) error {
+		d := o.base
+		if dirty {
+			d = o.top
+		}
+		ext, err := deviceExtents(d, roff, rlen)
+		if err != nil {
+			return err
+		}
+		for _, x := range ext {
+			if n := len(out); n > 0 && out[n-1].Flags == x.Flags {
+				out[n-1].Length += x.Length
+				continue
+			}
+			out = append(out, x)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// Commit writes all modified blocks to the base and syncs it. Afterwards,
+// the overlay is empty.
+func (o *Overlay) Commit() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	buf := make([]byte, 1<<20)
+	err := o.runs(0, o.size, func(off, length int64, dirty bool) error {
+		if !dirty {
+			return nil
+		}
+		for length > 0 {
+			b := buf[:min(length, int64(len(buf)))]
+			if _, err := o.top.ReadAt(b, off); err != nil && err != io.EOF {
+				return err
+			}
+			if _, err := o.base.WriteAt(b, off); err != nil {
+				return err
+			}
+			off, length = off+int64(len(b)), length-int64(len(b))
+		}
+		return nil
+	})
+	if err == nil {
+		err = o.base.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	o.discard()
+	return nil
+}
+
+// Discard drops all modifications, so the Overlay reads the same as its base
+// again. If the top device is a Trimmer, its contents are trimmed.
+func (o *Overlay) Discard() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.discard()
+}
+
+func (o *Overlay) discard() {
+	clear(o.dirty)
+	// Trimming is advisory, so errors are ignored.
+	Trim(o.top, 0, o.size)
+}
+
+// deviceExtents returns the extents of the range of length bytes at off of
+// d, covering the whole range. If d is not an ExtentReporter, the range is
+// reported as allocated.
+func deviceExtents(d Device, off, length int64) ([]Extent, error) {
+	r, ok := d.(ExtentReporter)
+	if !ok {
+		return []Extent{{uint64(off), uint64(length), 0}}, nil
+	}
+	var out []Extent
+	for length > 0 {
+		ext, err := r.ReportExtents(off, length)
+		if err != nil {
+			return nil, err
+		}
+		if len(ext) == 0 {
+			return nil, Errorf(EIO, "device reported no extents at %d", off)
+		}
+		for _, x := range ext {
+			if x.Offset != uint64(off) || x.Length == 0 {
+				return nil, Errorf(EIO, "device reported invalid extent %+v at %d", x, off)
+			}
+			x.Length = min(x.Length, uint64(length))
+			out = append(out, x)
+			off, length = off+int64(x.Length), length-int64(x.Length)
+			if length == 0 {
+				break
+			}
+		}
+	}
+	return out, nil
+}
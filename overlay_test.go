@@ -0,0 +1,76 @@
+package nbd
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	const size = 1 << 20
+	base := NewMemDevice(size)
+	golden := bytes.Repeat([]byte{1}, size/2)
+	if _, err := base.WriteAt(golden, 0); err != nil {
+		t.Fatal(err)
+	}
+	o := NewOverlay(base, NewMemDevice(size), size)
+
+	want := make([]byte, size)
+	copy(want, golden)
+	write := func(p []byte, off int64) {
+		t.Helper()
+		if _, err := o.WriteAt(p, off); err != nil {
+			t.Fatalf("WriteAt(%d) = %v", off, err)
+		}
+		copy(want[off:], p)
+	}
+	check := func(d Device, want []byte) {
+		t.Helper()
+		got := make([]byte, size)
+		if _, err := d.ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Error("device has wrong contents")
+		}
+	}
+
+	write([]byte("Hello, world!"), 4090)
+	write(bytes.Repeat([]byte{2}, 3*overlayBlockSize), size/2-overlayBlockSize)
+	if err := o.WriteZeroes(100, 200, true); err != nil {
+		t.Fatal(err)
+	}
+	clear(want[100:300])
+	check(o, want)
+	check(base, append(golden, make([]byte, size/2)...))
+	if n := o.Modified(); n != 5*overlayBlockSize {
+		t.Errorf("Modified() = %d, want %d", n, 5*overlayBlockSize)
+	}
+
+	ext, err := o.ReportExtents(0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantExt := []Extent{
+		{0, size/2 + 2*overlayBlockSize, 0},
+		{size/2 + 2*overlayBlockSize, size/2 - 2*overlayBlockSize, ExtentHole | ExtentZero},
+	}
+	if !reflect.DeepEqual(ext, wantExt) {
+		t.Errorf("ReportExtents() = %v, want %v", ext, wantExt)
+	}
+
+	o.Discard()
+	check(o, append(golden, make([]byte, size/2)...))
+
+	copy(want, golden)
+	clear(want[size/2:])
+	write([]byte("foobar"), 12345)
+	if err := o.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := o.Modified(); n != 0 {
+		t.Errorf("Modified() = %d after Commit, want 0", n)
+	}
+	check(base, want)
+	check(o, want)
+}
@@ -0,0 +1,368 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package partition reads MBR and GPT partition tables and provides access to
+// individual partitions of an nbd.Device.
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+
+	"github.com/Merovius/nbd"
+)
+
+// Table is a partition table.
+type Table struct {
+	// Scheme is either "mbr" or "gpt".
+	Scheme string
+	// DiskGUID is the GUID of a GPT disk.
+	DiskGUID string
+	// SectorSize is the logical sector size the table uses.
+	SectorSize int64
+
+	Partitions []Partition
+}
+
+// Partition is an entry in a partition table.
+type Partition struct {
+	// Number is the number of the partition, as used by Linux. For GPT, it
+	// is the index of the entry plus one. For MBR, primary partitions are
+	// numbered 1-4 and logical partitions from 5.
+	Number int
+	// Start and Size are in bytes.
+	Start int64
+	Size  int64
+	// Type is the partition type. For MBR, it is the type byte in hex
+	// (like "0x83"), for GPT the type GUID.
+	Type string
+	// GUID and Name are the unique partition GUID and name of a GPT
+	// partition.
+	GUID string
+	Name string
+}
+
+// ErrNoTable is returned by Read, if no partition table was found.
+var ErrNoTable = errors.New("no partition table found")
+
+// Read reads the partition table of a disk of the given size. If the disk has
+// a protective MBR, the GPT is used. If the primary GPT header is corrupt,
+// the backup is used.
+func Read(r io.ReaderAt, size int64) (*Table, error) {
+	mbr := make([]byte, 512)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrNoTable
+		}
+		return nil, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, ErrNoTable
+	}
+	for i := 0; i < 4; i++ {
+		if mbr[446+16*i+4] == 0xee {
+			return readGPT(r, size)
+		}
+	}
+	return readMBR(r, size, mbr)
+}
+
+// mbrEntry is an entry in an MBR or EBR.
+type mbrEntry struct {
+	typ   byte
+	start int64
+	size  int64
+}
+
+func parseMBR(b []byte) [4]mbrEntry {
+	var e [4]mbrEntry
+	for i := range e {
+		p := b[446+16*i:]
+		e[i] = mbrEntry{
+			typ:   p[4],
+			start: int64(binary.LittleEndian.Uint32(p[8:])) * 512,
+			size:  int64(binary.LittleEndian.Uint32(p[12:])) * 512,
+		}
+	}
+	return e
+}
+
+func isExtended(typ byte) bool {
+	return typ == 0x05 || typ == 0x0f || typ == 0x85
+}
+
+// maxLogical is the maximum number of logical partitions read from an
+// extended partition, to protect against loops.
+const maxLogical = 128
+
+func readMBR(r io.ReaderAt, size int64, mbr []byte) (*Table, error) {
+	t := &Table{Scheme: "mbr", SectorSize: 512}
+	var ext *mbrEntry
+	for i, e := range parseMBR(mbr) {
+		if e.typ == 0 || e.size == 0 {
+			continue
+		}
+		if isExtended(e.typ) {
+			ext = &e
+			continue
+		}
+		if err := t.add(size, Partition{Number: i + 1, Start: e.start, Size: e.size, Type: fmt.Sprintf("0x%02x", e.typ)}); err != nil {
+			return nil, err
+		}
+	}
+	if ext == nil {
+		return t, nil
+	}
+	// Logical partitions are stored in a linked list of EBRs. Offsets of
+	// logical partitions are relative to their EBR, offsets of the next
+	// EBR relative to the start of the extended partition.
+	ebr := make([]byte, 512)
+	for off, n := ext.start, 5; n < 5+maxLogical; n++ {
+		if _, err := r.ReadAt(ebr, off); err != nil {
+			return nil, fmt.Errorf("reading EBR at %d: %w", off, err)
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			return nil, fmt.Errorf("invalid EBR at %d", off)
+		}
+		e := parseMBR(ebr)
+		if e[0].typ != 0 && e[0].size != 0 {
+			if err := t.add(size, Partition{Number: n, Start: off + e[0].start, Size: e[0].size, Type: fmt.Sprintf("0x%02x", e[0].typ)}); err != nil {
+				return nil, err
+			}
+		}
+		if !isExtended(e[1].typ) || e[1].start == 0 {
+			break
+		}
+		off = ext.start + e[1].start
+	}
+	return t, nil
+}
+
+// add adds p to t, after checking that it is inside a disk of the given size.
+func (t *Table) add(size int64, p Partition) error {
+	if p.Start <= 0 || p.Size <= 0 || p.Start+p.Size > size {
+		return fmt.Errorf("partition %d [%d,%d) is outside of the disk", p.Number, p.Start, p.Start+p.Size)
+	}
+	t.Partitions = append(t.Partitions, p)
+	return nil
+}
+
+// gptSignature is the signature of a GPT header.
+const gptSignature = "EFI PART"
+
+func readGPT(r io.ReaderAt, size int64) (*Table, error) {
+	var errs []error
+	for _, ss := range []int64{512, 4096} {
+		if size < 2*ss {
+			continue
+		}
+		for _, lba := range []int64{1, size/ss - 1} {
+			t, err := readGPTHeader(r, size, ss, lba)
+			if err == nil {
+				return t, nil
+			}
+			if err != errNoGPT {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("protective MBR, but no GPT header found")
+	}
+	return nil, errors.Join(errs...)
+}
+
+var errNoGPT = errors.New("no GPT header")
+
+// maxGPTEntriesSize is the maximum size of the GPT partition entries we read.
+// Usually, they are 16KiB.
+const maxGPTEntriesSize = 1 << 20
+
+// readGPTHeader reads the GPT with the header at the given LBA, using the
+// sector size ss.
+func readGPTHeader(r io.ReaderAt, size, ss, lba int64) (*Table, error) {
+	h := make([]byte, ss)
+	if _, err := r.ReadAt(h, lba*ss); err != nil {
+		return nil, err
+	}
+	if string(h[:8]) != gptSignature {
+		return nil, errNoGPT
+	}
+	le := binary.LittleEndian
+	hsize := le.Uint32(h[12:])
+	if hsize < 92 || int64(hsize) > ss {
+		return nil, fmt.Errorf("invalid GPT header size %d at LBA %d", hsize, lba)
+	}
+	sum := le.Uint32(h[16:])
+	le.PutUint32(h[16:], 0)
+	if crc32.ChecksumIEEE(h[:hsize]) != sum {
+		return nil, fmt.Errorf("invalid GPT header checksum at LBA %d", lba)
+	}
+	entriesLBA := int64(le.Uint64(h[72:]))
+	n, esize := int64(le.Uint32(h[80:])), int64(le.Uint32(h[84:]))
+	if esize < 128 || esize%8 != 0 || n > 1<<16 || n*esize > maxGPTEntriesSize {
+		return nil, fmt.Errorf("invalid GPT partition entries at LBA %d", lba)
+	}
+	if entriesLBA < 0 || entriesLBA > (size-n*esize)/ss {
+		return nil, fmt.Errorf("GPT partition entries at LBA %d are beyond the end of the disk", entriesLBA)
+	}
+	entries := make([]byte, n*esize)
+	if _, err := r.ReadAt(entries, entriesLBA*ss); err != nil {
+		return nil, fmt.Errorf("reading GPT partition entries: %w", err)
+	}
+	if crc32.ChecksumIEEE(entries) != le.Uint32(h[88:]) {
+		return nil, fmt.Errorf("invalid GPT partition entries checksum at LBA %d", lba)
+	}
+	t := &Table{Scheme: "gpt", DiskGUID: guid(h[56:72]), SectorSize: ss}
+	var zero [16]byte
+	for i := int64(0); i < n; i++ {
+		e := entries[i*esize : (i+1)*esize]
+		if bytes.Equal(e[:16], zero[:]) {
+			continue
+		}
+		first, last := int64(le.Uint64(e[32:])), int64(le.Uint64(e[40:]))
+		name := make([]uint16, 36)
+		for j := range name {
+			name[j] = le.Uint16(e[56+2*j:])
+		}
+		if j := indexZero(name); j >= 0 {
+			name = name[:j]
+		}
+		p := Partition{
+			Number: int(i + 1),
+			Start:  first * ss,
+			Size:   (last - first + 1) * ss,
+			Type:   guid(e[:16]),
+			GUID:   guid(e[16:32]),
+			Name:   string(utf16.Decode(name)),
+		}
+		if err := t.add(size, p); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func indexZero(s []uint16) int {
+	for i, v := range s {
+		if v == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// guid formats a GUID in its mixed-endian on-disk representation.
+func guid(b []byte) string {
+	le := binary.LittleEndian
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", le.Uint32(b), le.Uint16(b[4:]), le.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+// Device is an nbd.Device exposing a single partition of a parent device.
+// It implements nbd.Trimmer, nbd.ZeroWriter and nbd.ExtentReporter, passing
+// requests on to the parent, if it supports them.
+type Device struct {
+	d    nbd.Device
+	off  int64
+	size int64
+}
+
+// Device returns a Device exposing p on the parent device d.
+func (p Partition) Device(d nbd.Device) *Device {
+	return &Device{d, p.Start, p.Size}
+}
+
+// Size returns the size of the partition.
+func (d *Device) Size() int64 {
+	return d.size
+}
+
+// check validates the range of length bytes at off.
+func (d *Device) check(off, length int64) error {
+	if off < 0 || length < 0 {
+		return nbd.EINVAL
+	}
+	if length > d.size-off {
+		return nbd.ENOSPC
+	}
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (d *Device) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, nbd.EINVAL
+	}
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > d.size-off {
+		p, err = p[:d.size-off], io.EOF
+	}
+	n, e := d.d.ReadAt(p, d.off+off)
+	if e != nil {
+		err = e
+	}
+	return n, err
+}
+
+// WriteAt implements io.WriterAt.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	if err := d.check(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	return d.d.WriteAt(p, d.off+off)
+}
+
+// Sync implements nbd.Device.
+func (d *Device) Sync() error {
+	return d.d.Sync()
+}
+
+// Trim implements nbd.Trimmer. It is a no-op, if the parent does not
+// support trimming.
+func (d *Device) Trim(off, length int64) error {
+	if err := d.check(off, length); err != nil {
+		return err
+	}
+	return nbd.Trim(d.d, d.off+off, length)
+}
+
+// WriteZeroes implements nbd.ZeroWriter.
+func (d *Device) WriteZeroes(off, length int64, punch bool) error {
+	if err := d.check(off, length); err != nil {
+		return err
+	}
+	return nbd.WriteZeroes(d.d, d.off+off, length, punch)
+}
+
+// ReportExtents implements nbd.ExtentReporter.
+func (d *Device) ReportExtents(off, length int64) ([]nbd.Extent, error) {
+	if off < 0 || length < 0 || off >= d.size {
+		return nil, nbd.EINVAL
+	}
+	ext, err := nbd.ReportExtents(d.d, d.off+off, min(length, d.size-off))
+	if err != nil {
+		return nil, err
+	}
+	for i := range ext {
+		ext[i].Offset -= uint64(d.off)
+	}
+	return ext, nil
+}
@@ -0,0 +1,174 @@
+package partition
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/Merovius/nbd"
+)
+
+const diskSize = 1 << 20
+
+func putMBREntry(b []byte, i int, typ byte, start, sectors uint32) {
+	p := b[446+16*i:]
+	p[4] = typ
+	binary.LittleEndian.PutUint32(p[8:], start)
+	binary.LittleEndian.PutUint32(p[12:], sectors)
+	b[510], b[511] = 0x55, 0xaa
+}
+
+func TestMBR(t *testing.T) {
+	d := nbd.NewMemDevice(diskSize)
+	b := make([]byte, 512)
+	putMBREntry(b, 0, 0x83, 1, 100)
+	putMBREntry(b, 1, 0x05, 200, 1000)
+	d.WriteAt(b, 0)
+
+	// First EBR at sector 200, logical partition at 210, next EBR at 500.
+	b = make([]byte, 512)
+	putMBREntry(b, 0, 0x07, 10, 50)
+	putMBREntry(b, 1, 0x05, 300, 100)
+	d.WriteAt(b, 200*512)
+	b = make([]byte, 512)
+	putMBREntry(b, 0, 0x82, 1, 20)
+	d.WriteAt(b, 500*512)
+
+	tab, err := Read(d, diskSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Partition{
+		{Number: 1, Start: 512, Size: 100 * 512, Type: "0x83"},
+		{Number: 5, Start: 210 * 512, Size: 50 * 512, Type: "0x07"},
+		{Number: 6, Start: 501 * 512, Size: 20 * 512, Type: "0x82"},
+	}
+	if tab.Scheme != "mbr" || !reflect.DeepEqual(tab.Partitions, want) {
+		t.Errorf("Read() = %+v, want %+v", tab.Partitions, want)
+	}
+
+	if _, err := Read(nbd.NewMemDevice(diskSize), diskSize); err != ErrNoTable {
+		t.Errorf("Read(empty disk) = %v, want %v", err, ErrNoTable)
+	}
+}
+
+// writeGPT writes a GPT header at LBA lba, with the entries at LBA entriesLBA.
+func writeGPT(d nbd.Device, lba, entriesLBA int64, entries []byte) {
+	le := binary.LittleEndian
+	h := make([]byte, 512)
+	copy(h, gptSignature)
+	le.PutUint32(h[8:], 0x10000)
+	le.PutUint32(h[12:], 92)
+	le.PutUint64(h[24:], uint64(lba))
+	copy(h[56:], "0123456789abcdef")
+	le.PutUint64(h[72:], uint64(entriesLBA))
+	le.PutUint32(h[80:], uint32(len(entries)/128))
+	le.PutUint32(h[84:], 128)
+	le.PutUint32(h[88:], crc32.ChecksumIEEE(entries))
+	le.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+	d.WriteAt(h, lba*512)
+	d.WriteAt(entries, entriesLBA*512)
+}
+
+func TestGPT(t *testing.T) {
+	le := binary.LittleEndian
+	d := nbd.NewMemDevice(diskSize)
+	b := make([]byte, 512)
+	putMBREntry(b, 0, 0xee, 1, diskSize/512-1)
+	d.WriteAt(b, 0)
+
+	entries := make([]byte, 4*128)
+	e := entries[128:]
+	copy(e, []byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4})
+	copy(e[16:], []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	le.PutUint64(e[32:], 34)
+	le.PutUint64(e[40:], 133)
+	for i, c := range utf16.Encode([]rune("rootfs")) {
+		le.PutUint16(e[56+2*i:], c)
+	}
+	writeGPT(d, 1, 2, entries)
+
+	want := []Partition{{
+		Number: 2,
+		Start:  34 * 512,
+		Size:   100 * 512,
+		Type:   "0fc63daf-8483-4772-8e79-3d69d8477de4",
+		GUID:   "04030201-0605-0807-090a-0b0c0d0e0f10",
+		Name:   "rootfs",
+	}}
+	tab, err := Read(d, diskSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tab.Scheme != "gpt" || !reflect.DeepEqual(tab.Partitions, want) {
+		t.Errorf("Read() = %+v, want %+v", tab.Partitions, want)
+	}
+
+	// Corrupt the primary header, the backup should be used.
+	last := int64(diskSize/512 - 1)
+	writeGPT(d, last, last-4, entries)
+	d.WriteAt([]byte{1}, 512+20)
+	if tab, err = Read(d, diskSize); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tab.Partitions, want) {
+		t.Errorf("Read() with backup = %+v, want %+v", tab.Partitions, want)
+	}
+	d.WriteAt([]byte{1}, last*512+20)
+	if _, err := Read(d, diskSize); err == nil {
+		t.Error("Read() with corrupt headers succeeded")
+	}
+
+	// Huge partition entries must be rejected before reading them.
+	writeGPT(d, 1, 2, entries)
+	h := make([]byte, 92)
+	d.ReadAt(h, 512)
+	le.PutUint32(h[80:], 1<<16)
+	le.PutUint32(h[84:], 1<<31)
+	le.PutUint32(h[16:], 0)
+	le.PutUint32(h[16:], crc32.ChecksumIEEE(h))
+	d.WriteAt(h, 512)
+	if _, err := Read(d, diskSize); err == nil {
+		t.Error("Read() with huge partition entries succeeded")
+	}
+}
+
+func TestDevice(t *testing.T) {
+	parent := nbd.NewMemDevice(diskSize)
+	p := Partition{Start: 4096, Size: 8192}
+	d := p.Device(parent)
+
+	if _, err := d.WriteAt([]byte("hello"), 8190); err == nil {
+		t.Error("WriteAt past the end of the partition succeeded")
+	}
+	if _, err := d.WriteAt([]byte("hello"), 100); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := parent.ReadAt(buf, 4196); err != nil || string(buf) != "hello" {
+		t.Errorf("parent.ReadAt() = %q, %v, want %q, nil", buf, err, "hello")
+	}
+	if n, err := d.ReadAt(buf, 8190); n != 2 || err != io.EOF {
+		t.Errorf("ReadAt at end = %d, %v, want 2, EOF", n, err)
+	}
+
+	ext, err := d.ReportExtents(0, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ext) == 0 || ext[0].Offset != 0 || ext[0].Flags != 0 {
+		t.Errorf("ReportExtents() = %+v, want data at 0", ext)
+	}
+	if err := d.WriteZeroes(0, 8192, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parent.ReadAt(buf, 4196); err != nil || string(buf) != "\x00\x00\x00\x00\x00" {
+		t.Errorf("parent.ReadAt() after WriteZeroes = %q, %v, want zeroes", buf, err)
+	}
+	if err := d.Trim(4096, 8192); err == nil {
+		t.Error("Trim past the end of the partition succeeded")
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"io"
+	"math/rand/v2"
+	"sync"
+)
+
+// CrashMode selects which unsynced writes survive a simulated power loss.
+type CrashMode int
+
+const (
+	// DropAll discards all unsynced writes, up to the parts kept by
+	// WithTornWrites.
+	DropAll CrashMode = iota
+	// KeepAll keeps all unsynced writes, as if they had been synced.
+	KeepAll
+	// DropRandom discards a random subset of the unsynced writes.
+	DropRandom
+)
+
+// TearMode selects which parts of a torn write are persisted.
+type TearMode int
+
+const (
+	// TearPrefix persists a prefix of the write.
+	TearPrefix TearMode = iota
+	// TearSuffix persists a suffix of the write.
+	TearSuffix
+	// TearRandom persists a random subset of the atomic units of the write.
+	TearRandom
+)
+
+// PowerLossOption is an option for NewPowerLoss.
+type PowerLossOption func(*PowerLoss)
+
+// WithTornWrites makes writes only atomic in aligned units of the given size.
+// Writes spanning multiple units, which are discarded by a crash, may instead
+// be persisted partially, as selected by mode, or still be lost entirely.
+// Writes done with WriteFUA are never torn.
+func WithTornWrites(unit int64, mode TearMode) PowerLossOption {
+	return func(p *PowerLoss) {
+		p.unit, p.tear = unit, mode
+	}
+}
+
+// PowerLoss is a Device simulating a disk with a volatile write cache, to
+// test the crash-resilience of software using it. Writes are buffered in
+// memory until Sync is called, when they are written to an underlying Device.
+// Writes done with WriteFUA are durable immediately. Crash simulates a power
+// loss, discarding some or all of the writes since the last Sync.
+//
+// PowerLoss implements Trimmer, ZeroWriter and FUAWriter, regardless of
+// whether the underlying device does.
+type PowerLoss struct {
+	mu      sync.RWMutex
+	d       Device
+	size    int64
+	rnd     *rand.Rand
+	unit    int64
+	tear    TearMode
+	pending []pendingWrite
+}
+
+// pendingWrite is a buffered write. If data is nil, the range of length
+// bytes at off is zeroed.
+type pendingWrite struct {
+	off     int64
+	length  int64
+	data    []byte
+	punch   bool
+	durable bool
+}
+
+// NewPowerLoss returns a PowerLoss of the given size on top of d. seed is
+// used to decide which writes are dropped by a random crash, so crashes are
+// reproducible.
+func NewPowerLoss(d Device, size int64, seed uint64, opts ...PowerLossOption) *PowerLoss {
+	p := &PowerLoss{
+		d:    d,
+		size: size,
+		rnd:  rand.New(rand.NewPCG(seed, 0)),
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	return p
+}
+
+// Pending returns the number of writes, which would be affected by a crash.
+func (p *PowerLoss) Pending() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	n := 0
+	for _, w := range p.pending {
+		if !w.durable {
+			n++
+		}
+	}
+	return n
+}
+
+// check validates the range of length bytes at off.
+func (p *PowerLoss) check(off, length int64) error {
+	if off < 0 || length < 0 {
+		return EINVAL
+	}
+	if length > p.size-off {
+		return ENOSPC
+	}
+	return nil
+}
+
+// ReadAt implements io.ReaderAt. It returns the data as it was last written,
+// including unsynced writes.
+func (p *PowerLoss) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, EINVAL
+	}
+	if off >= p.size {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > p.size-off {
+		b, err = b[:p.size-off], io.EOF
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if n, e := p.d.ReadAt(b, off); e != nil && n < len(b) {
+		return n, e
+	}
+	end := off + int64(len(b))
+	for _, w := range p.pending {
+		s, e := max(off, w.off), min(end, w.off+w.length)
+		if s >= e {
+			continue
+		}
+		if w.data == nil {
+			clear(b[s-off : e-off])
+		} else {
+			copy(b[s-off:e-off], w.data[s-w.off:])
+		}
+	}
+	return len(b), err
+}
+
+// add buffers w.
+func (p *PowerLoss) add(w pendingWrite) error {
+	if err := p.check(w.off, w.length); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, w)
+	return nil
+}
+
+// WriteAt implements io.WriterAt. The write is buffered until the next Sync.
+func (p *PowerLoss) WriteAt(b []byte, off int64) (int, error) {
+	if err := p.add(pendingWrite{off: off, length: int64(len(b)), data: append([]byte(nil), b...)}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteFUA implements FUAWriter. The write survives a crash, but writes done
+// before it might not.
+func (p *PowerLoss) WriteFUA(b []byte, off int64) (int, error) {
+	if err := p.add(pendingWrite{off: off, length: int64(len(b)), data: append([]byte(nil), b...), durable: true}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Trim implements Trimmer. Trimmed ranges read as zeroes.
+func (p *PowerLoss) Trim(off, length int64) error {
+	return p.WriteZeroes(off, length, true)
+}
+
+// WriteZeroes implements ZeroWriter. The write is buffered until the next
+// Sync.
+func (p *PowerLoss) WriteZeroes(off, length int64, punch bool) error {
+	return p.add(pendingWrite{off: off, length: length, punch: punch})
+}
+
+// Sync implements Device, by writing all buffered writes to the underlying
+// device and syncing it.
+func (p *PowerLoss) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.apply(func(w pendingWrite) []pendingWrite { return []pendingWrite{w} })
+}
+
+// Crash simulates a power loss. Writes since the last Sync are discarded
+// according to mode (or torn, see WithTornWrites) and the remaining ones are
+// written to the underlying device. Afterwards, the device can be used as if
+// it was restarted.
+func (p *PowerLoss) Crash(mode CrashMode) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.apply(func(w pendingWrite) []pendingWrite {
+		switch {
+		case w.durable || mode == KeepAll:
+			return []pendingWrite{w}
+		case mode == DropRandom && p.rnd.IntN(2) == 0:
+			return []pendingWrite{w}
+		default:
+			return p.tearWrite(w)
+		}
+	})
+}
+
+// tearWrite returns the parts of w persisted, if it is torn by a crash.
+func (p *PowerLoss) tearWrite(w pendingWrite) []pendingWrite {
+	if p.unit <= 0 {
+		return nil
+	}
+	var parts []pendingWrite
+	for off, end := w.off, w.off+w.length; off < end; {
+		next := min((off/p.unit+1)*p.unit, end)
+		part := pendingWrite{off: off, length: next - off, punch: w.punch}
+		if w.data != nil {
+			part.data = w.data[off-w.off : next-w.off]
+		}
+		parts = append(parts, part)
+		off = next
+	}
+	n := len(parts)
+	if n < 2 {
+		return nil
+	}
+	// Persisting no part at all is one of the possible outcomes.
+	switch p.tear {
+	case TearPrefix:
+		return parts[:p.rnd.IntN(n)]
+	case TearSuffix:
+		return parts[n-p.rnd.IntN(n):]
+	default:
+		kept := parts[:0]
+		for _, part := range parts {
+			if p.rnd.IntN(2) == 0 {
+				kept = append(kept, part)
+			}
+		}
+		return kept
+	}
+}
+
+// apply writes the parts of the buffered writes returned by persist to the
+// underlying device, in order, and syncs it. The buffer is cleared, even if an
+// error occurs.
+func (p *PowerLoss) apply(persist func(pendingWrite) []pendingWrite) error {
+	pending := p.pending
+	p.pending = nil
+	for _, w := range pending {
+		for _, part := range persist(w) {
+			var err error
+			if part.data == nil {
+				err = WriteZeroes(p.d, part.off, part.length, part.punch)
+			} else {
+				_, err = p.d.WriteAt(part.data, part.off)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return p.d.Sync()
+}
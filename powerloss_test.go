@@ -0,0 +1,193 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestPowerLoss(t *testing.T) {
+	const size = 1 << 16
+	base := NewMemDevice(size)
+	base.WriteAt(bytes.Repeat([]byte{1}, size), 0)
+	p := NewPowerLoss(base, size, 42)
+
+	read := func(off, length int64) []byte {
+		t.Helper()
+		b := make([]byte, length)
+		if _, err := p.ReadAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	p.WriteAt([]byte("synced"), 0)
+	if err := p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	p.WriteAt([]byte("lost"), 100)
+	p.WriteZeroes(200, 10, false)
+	p.WriteFUA([]byte("durable"), 300)
+	if got := read(100, 4); string(got) != "lost" {
+		t.Errorf("ReadAt before crash = %q, want %q", got, "lost")
+	}
+	if got := read(200, 10); !bytes.Equal(got, make([]byte, 10)) {
+		t.Errorf("ReadAt of zeroed range before crash = %v, want zeroes", got)
+	}
+	if n := p.Pending(); n != 2 {
+		t.Errorf("Pending() = %d, want 2", n)
+	}
+	if _, err := p.WriteAt([]byte("x"), size); err == nil {
+		t.Error("WriteAt past the end succeeded")
+	}
+
+	if err := p.Crash(DropAll); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(0, 6); string(got) != "synced" {
+		t.Errorf("synced write after crash = %q, want %q", got, "synced")
+	}
+	if got := read(100, 4); !bytes.Equal(got, []byte{1, 1, 1, 1}) {
+		t.Errorf("unsynced write after crash = %v, want old data", got)
+	}
+	if got := read(200, 10); !bytes.Equal(got, bytes.Repeat([]byte{1}, 10)) {
+		t.Errorf("unsynced zeroes after crash = %v, want old data", got)
+	}
+	if got := read(300, 7); string(got) != "durable" {
+		t.Errorf("FUA write after crash = %q, want %q", got, "durable")
+	}
+
+	p.WriteAt([]byte("kept"), 100)
+	if err := p.Crash(KeepAll); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(100, 4); string(got) != "kept" {
+		t.Errorf("unsynced write after KeepAll crash = %q, want %q", got, "kept")
+	}
+	if n := p.Pending(); n != 0 {
+		t.Errorf("Pending() after crash = %d, want 0", n)
+	}
+}
+
+func TestPowerLossRandom(t *testing.T) {
+	// crash writes one byte to each of 64 blocks and returns the result of
+	// a random crash.
+	crash := func(seed uint64) []byte {
+		p := NewPowerLoss(NewMemDevice(64), 64, seed)
+		for i := int64(0); i < 64; i++ {
+			p.WriteAt([]byte{1}, i)
+		}
+		if err := p.Crash(DropRandom); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 64)
+		p.ReadAt(b, 0)
+		return b
+	}
+	a, b := crash(1), crash(1)
+	if !bytes.Equal(a, b) {
+		t.Error("crashes with the same seed differ")
+	}
+	if n := bytes.Count(a, []byte{1}); n == 0 || n == 64 {
+		t.Errorf("random crash kept %d of 64 writes", n)
+	}
+	if bytes.Equal(a, crash(2)) {
+		t.Error("crashes with different seeds are equal")
+	}
+}
+
+func TestPowerLossTornWrites(t *testing.T) {
+	// crash does an unsynced write of 8 units, starting in the middle of
+	// a unit, and returns which bytes survive a crash.
+	crash := func(mode TearMode, seed uint64) []byte {
+		p := NewPowerLoss(NewMemDevice(5000), 5000, seed, WithTornWrites(512, mode))
+		p.WriteAt(bytes.Repeat([]byte{1}, 4000), 256)
+		p.WriteFUA([]byte{1}, 4999)
+		if err := p.Crash(DropAll); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 4256)
+		p.ReadAt(b, 0)
+		if b[255] != 0 {
+			t.Error("byte before the torn write was modified")
+		}
+		return b[256:]
+	}
+	var lost, torn int
+	for seed := uint64(0); seed < 64; seed++ {
+		b := crash(TearPrefix, seed)
+		n := bytes.IndexByte(b, 0)
+		if n < 0 || bytes.IndexByte(b[n:], 1) >= 0 || (n > 0 && (n+256)%512 != 0) {
+			t.Errorf("prefix tear persisted %d bytes, want a partial prefix of whole units", n)
+		}
+		if n == 0 {
+			lost++
+		} else {
+			torn++
+		}
+		b = crash(TearSuffix, seed)
+		n = bytes.IndexByte(b, 1)
+		if n == 0 || (n > 0 && (bytes.IndexByte(b[n:], 0) >= 0 || (n+256)%512 != 0)) {
+			t.Errorf("suffix tear persisted from %d, want a partial suffix of whole units", n)
+		}
+		b = crash(TearRandom, seed)
+		for i := 0; i < len(b); i++ {
+			if (i+256)%512 != 0 && b[i] != b[max(i-1, 0)] {
+				t.Errorf("random tear changes within unit at %d", i+256)
+				break
+			}
+		}
+		if !bytes.Equal(b, crash(TearRandom, seed)) {
+			t.Error("random tears with the same seed differ")
+		}
+	}
+	if lost == 0 || torn == 0 {
+		t.Errorf("prefix tears lost %d writes and tore %d, want both", lost, torn)
+	}
+
+	// Without tearing, the write is discarded entirely.
+	p := NewPowerLoss(NewMemDevice(5000), 5000, 0)
+	p.WriteAt(bytes.Repeat([]byte{1}, 4000), 256)
+	p.Crash(DropAll)
+	b := make([]byte, 5000)
+	p.ReadAt(b, 0)
+	if !bytes.Equal(b, make([]byte, 5000)) {
+		t.Error("write without tearing persisted partially")
+	}
+}
+
+func TestConnFUA(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := NewPowerLoss(NewMemDevice(1<<20), 1<<20, 0)
+	dial, _ := testServer(t, ctx, Export{
+		Size:   1 << 20,
+		Device: p,
+	})
+	c, err := Open(ctx, dial, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.Export().Flags&FlagSendFUA == 0 {
+		t.Fatal("server did not advertise FUA")
+	}
+	if _, err := c.WriteAt([]byte("lost"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WriteFUA([]byte("durable"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Crash(DropAll); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 107)
+	if _, err := c.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(got[:4]) != "\x00\x00\x00\x00" || string(got[100:]) != "durable" {
+		t.Errorf("after crash, read %q and %q, want zeroes and %q", got[:4], got[100:], "durable")
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qcow2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Option is an option for Create.
+type Option func(*options)
+
+type options struct {
+	clusterBits uint32
+	backing     string
+}
+
+// WithClusterSize sets the cluster size of a new image. It must be a power of
+// two between 512 bytes and 2MiB. The default is 64KiB.
+func WithClusterSize(size int) Option {
+	return func(o *options) {
+		o.clusterBits = 0
+		for 1<<o.clusterBits < size {
+			o.clusterBits++
+		}
+	}
+}
+
+// WithBackingFile sets the backing file of a new image. Relative paths are
+// interpreted relative to the directory of the image. The backing file can
+// either be a qcow2 image or a raw file.
+func WithBackingFile(path string) Option {
+	return func(o *options) {
+		o.backing = path
+	}
+}
+
+// Create creates a new, empty version 3 qcow2 image with the given name and
+// virtual size, truncating any existing file. If size is 0 and a backing file
+// is given, the size of the backing file is used.
+func Create(name string, size int64, opts ...Option) (*Image, error) {
+	o := options{clusterBits: 16}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.clusterBits < 9 || o.clusterBits > 21 {
+		return nil, errors.New("qcow2: invalid cluster size")
+	}
+	h := &header{
+		version:       3,
+		clusterBits:   o.clusterBits,
+		size:          uint64(size),
+		refcountOrder: 4,
+		backingFile:   o.backing,
+	}
+	if o.backing != "" {
+		path := o.backing
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(name), path)
+		}
+		format, bsize, err := probe(path)
+		if err != nil {
+			return nil, err
+		}
+		h.backingFormat = format
+		if size == 0 {
+			h.size = uint64(bsize)
+		}
+	}
+	if h.size == 0 || h.size > 1<<62 {
+		return nil, fmt.Errorf("qcow2: invalid size %d", h.size)
+	}
+
+	cs := int64(1) << o.clusterBits
+	clusters := (int64(h.size) + cs - 1) / cs
+	l2Tables := (clusters + cs/8 - 1) / (cs / 8)
+	if l2Tables > 1<<25 {
+		return nil, fmt.Errorf("qcow2: size %d too large for cluster size %d", h.size, cs)
+	}
+	h.l1Size = uint32(l2Tables)
+	l1Clusters := (l2Tables*8 + cs - 1) / cs
+	h.refcountTableOffset = uint64(cs)
+	h.refcountTableClusters = 1
+	h.l1TableOffset = uint64(2 * cs)
+
+	hdr := h.encode()
+	if int64(len(hdr)) > cs {
+		return nil, errors.New("qcow2: header does not fit into the first cluster")
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	img, err := create(f, name, h, hdr, 2+l1Clusters)
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	return img, nil
+}
+
+// create writes the header hdr and empty metadata tables to f, which have
+// to fill the first n clusters.
+func create(f *os.File, name string, h *header, hdr []byte, n int64) (*Image, error) {
+	cs := int64(1) << h.clusterBits
+	if _, err := f.WriteAt(append(hdr, make([]byte, n*cs-int64(len(hdr)))...), 0); err != nil {
+		return nil, err
+	}
+	img := &Image{
+		f:        f,
+		h:        h,
+		writable: true,
+		cs:       cs,
+		l1:       make([]uint64, h.l1Size),
+		rt:       make([]uint64, cs/8),
+		end:      n * cs,
+		zoff:     -1,
+	}
+	for i := int64(0); i < n; i++ {
+		if err := img.setRefcount(i, 1); err != nil {
+			return nil, err
+		}
+	}
+	if h.backingFile != "" {
+		path := h.backingFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(name), path)
+		}
+		if err := img.openBacking(path); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// probe returns the format and size of the image at path.
+func probe(path string) (format string, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	if IsImage(f) {
+		h, err := readHeader(f)
+		if err != nil {
+			return "", 0, err
+		}
+		return "qcow2", int64(h.size), nil
+	}
+	size, err = f.Seek(0, io.SeekEnd)
+	return "raw", size, err
+}
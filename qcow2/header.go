@@ -0,0 +1,209 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// magic is the magic number at the start of a qcow2 image, "QFI\xfb".
+const magic = 0x514649fb
+
+// Incompatible feature bits.
+const (
+	incompatDirty   = 1 << 0
+	incompatCorrupt = 1 << 1
+)
+
+// Header extension types.
+const (
+	extEnd           = 0
+	extBackingFormat = 0xe2792aca
+)
+
+// Size of the header of version 2 and 3 images.
+const (
+	headerSizeV2 = 72
+	headerSizeV3 = 104
+)
+
+// header is the header of a qcow2 image.
+type header struct {
+	version               uint32
+	backingFileOffset     uint64
+	backingFileSize       uint32
+	clusterBits           uint32
+	size                  uint64
+	cryptMethod           uint32
+	l1Size                uint32
+	l1TableOffset         uint64
+	refcountTableOffset   uint64
+	refcountTableClusters uint32
+	nbSnapshots           uint32
+	snapshotsOffset       uint64
+
+	// Only in version 3.
+	incompatible  uint64
+	compatible    uint64
+	autoclear     uint64
+	refcountOrder uint32
+	headerLength  uint32
+
+	// From the header extensions and the backing file name.
+	backingFormat string
+	backingFile   string
+}
+
+// readHeader reads the header, its extensions and the backing file name of
+// the image in r.
+func readHeader(r io.ReaderAt) (*header, error) {
+	buf := make([]byte, headerSizeV3)
+	if n, err := r.ReadAt(buf, 0); n < headerSizeV2 {
+		if err == io.EOF {
+			err = errors.New("qcow2: file too short")
+		}
+		return nil, err
+	}
+	be := binary.BigEndian
+	if be.Uint32(buf) != magic {
+		return nil, errors.New("qcow2: not a qcow2 image")
+	}
+	h := &header{
+		version:               be.Uint32(buf[4:]),
+		backingFileOffset:     be.Uint64(buf[8:]),
+		backingFileSize:       be.Uint32(buf[16:]),
+		clusterBits:           be.Uint32(buf[20:]),
+		size:                  be.Uint64(buf[24:]),
+		cryptMethod:           be.Uint32(buf[32:]),
+		l1Size:                be.Uint32(buf[36:]),
+		l1TableOffset:         be.Uint64(buf[40:]),
+		refcountTableOffset:   be.Uint64(buf[48:]),
+		refcountTableClusters: be.Uint32(buf[56:]),
+		nbSnapshots:           be.Uint32(buf[60:]),
+		snapshotsOffset:       be.Uint64(buf[64:]),
+		refcountOrder:         4,
+		headerLength:          headerSizeV2,
+	}
+	switch h.version {
+	case 2:
+	case 3:
+		h.incompatible = be.Uint64(buf[72:])
+		h.compatible = be.Uint64(buf[80:])
+		h.autoclear = be.Uint64(buf[88:])
+		h.refcountOrder = be.Uint32(buf[96:])
+		h.headerLength = be.Uint32(buf[100:])
+	default:
+		return nil, fmt.Errorf("qcow2: unsupported version %d", h.version)
+	}
+	if h.clusterBits < 9 || h.clusterBits > 21 {
+		return nil, fmt.Errorf("qcow2: invalid cluster size 2^%d", h.clusterBits)
+	}
+	if h.headerLength < headerSizeV2 || h.headerLength%8 != 0 || h.headerLength > 1<<h.clusterBits {
+		return nil, fmt.Errorf("qcow2: invalid header length %d", h.headerLength)
+	}
+	if h.refcountOrder > 6 {
+		return nil, fmt.Errorf("qcow2: invalid refcount order %d", h.refcountOrder)
+	}
+	if h.cryptMethod != 0 {
+		return nil, errors.New("qcow2: encrypted images are not supported")
+	}
+	if err := h.readExtensions(r); err != nil {
+		return nil, err
+	}
+	if h.backingFileOffset != 0 {
+		if h.backingFileSize == 0 || h.backingFileSize > 1023 {
+			return nil, fmt.Errorf("qcow2: invalid backing file name length %d", h.backingFileSize)
+		}
+		b := make([]byte, h.backingFileSize)
+		if _, err := r.ReadAt(b, int64(h.backingFileOffset)); err != nil {
+			return nil, fmt.Errorf("qcow2: reading backing file name: %w", err)
+		}
+		h.backingFile = string(b)
+	}
+	return h, nil
+}
+
+// readExtensions reads the header extensions following the header, which
+// have to be contained in the first cluster.
+func (h *header) readExtensions(r io.ReaderAt) error {
+	buf := make([]byte, (1<<h.clusterBits)-h.headerLength)
+	n, err := r.ReadAt(buf, int64(h.headerLength))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	buf = buf[:n]
+	for len(buf) >= 8 {
+		typ := binary.BigEndian.Uint32(buf)
+		length := binary.BigEndian.Uint32(buf[4:])
+		buf = buf[8:]
+		if typ == extEnd {
+			return nil
+		}
+		if uint64(length) > uint64(len(buf)) {
+			return errors.New("qcow2: invalid header extension")
+		}
+		if typ == extBackingFormat {
+			h.backingFormat = string(buf[:length])
+		}
+		buf = buf[min(len(buf), int(length+7)&^7):]
+	}
+	// Images without extensions may end right after the header.
+	return nil
+}
+
+// encode encodes h as a version 3 header, followed by the header extensions
+// and the backing file name. backingFileOffset and backingFileSize are set
+// accordingly.
+func (h *header) encode() []byte {
+	buf := make([]byte, headerSizeV3)
+	if h.backingFormat != "" {
+		ext := make([]byte, 8+(len(h.backingFormat)+7)&^7)
+		binary.BigEndian.PutUint32(ext, extBackingFormat)
+		binary.BigEndian.PutUint32(ext[4:], uint32(len(h.backingFormat)))
+		copy(ext[8:], h.backingFormat)
+		buf = append(buf, ext...)
+	}
+	buf = append(buf, make([]byte, 8)...)
+	if h.backingFile != "" {
+		h.backingFileOffset = uint64(len(buf))
+		h.backingFileSize = uint32(len(h.backingFile))
+		buf = append(buf, h.backingFile...)
+	}
+	h.headerLength = headerSizeV3
+
+	be := binary.BigEndian
+	be.PutUint32(buf, magic)
+	be.PutUint32(buf[4:], 3)
+	be.PutUint64(buf[8:], h.backingFileOffset)
+	be.PutUint32(buf[16:], h.backingFileSize)
+	be.PutUint32(buf[20:], h.clusterBits)
+	be.PutUint64(buf[24:], h.size)
+	be.PutUint32(buf[32:], h.cryptMethod)
+	be.PutUint32(buf[36:], h.l1Size)
+	be.PutUint64(buf[40:], h.l1TableOffset)
+	be.PutUint64(buf[48:], h.refcountTableOffset)
+	be.PutUint32(buf[56:], h.refcountTableClusters)
+	be.PutUint32(buf[60:], h.nbSnapshots)
+	be.PutUint64(buf[64:], h.snapshotsOffset)
+	be.PutUint64(buf[72:], h.incompatible)
+	be.PutUint64(buf[80:], h.compatible)
+	be.PutUint64(buf[88:], h.autoclear)
+	be.PutUint32(buf[96:], h.refcountOrder)
+	be.PutUint32(buf[100:], h.headerLength)
+	return buf
+}
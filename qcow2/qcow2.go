@@ -0,0 +1,778 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package qcow2 implements an nbd.Device backed by a qcow2 image, the native
+// image format of qemu.
+//
+// Versions 2 and 3 of the format are supported, including zero clusters,
+// compressed clusters and backing files. Images with internal snapshots can
+// only be opened read-only. Encryption, external data files and extended L2
+// entries are not supported.
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Merovius/nbd"
+)
+
+// Flags of L1 and L2 table entries.
+const (
+	flagCopied     = 1 << 63
+	flagCompressed = 1 << 62
+	flagZero       = 1 << 0
+
+	offsetMask = 0x00fffffffffffe00
+)
+
+// Image is a qcow2 image. It implements nbd.Device, as well as nbd.Trimmer,
+// nbd.ZeroWriter and nbd.ExtentReporter. It is safe for concurrent use.
+type Image struct {
+	mu       sync.Mutex
+	f        *os.File
+	h        *header
+	writable bool
+	cs       int64
+	l1       []uint64
+	rt       []uint64
+	// end is the offset of the next cluster to allocate.
+	end int64
+
+	backing     nbd.Device
+	backingSize int64
+
+	// The last decompressed cluster, to speed up sequential reads.
+	zoff int64
+	zbuf []byte
+}
+
+// Open opens the qcow2 image with the given name. flag is passed to
+// os.OpenFile and must be either os.O_RDONLY or os.O_RDWR. Backing files are
+// always opened read-only.
+func Open(name string, flag int) (*Image, error) {
+	f, err := os.OpenFile(name, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	img, err := open(f, name, flag&(os.O_WRONLY|os.O_RDWR) != 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// IsImage returns whether r starts with the qcow2 magic number.
+func IsImage(r io.ReaderAt) bool {
+	var b [4]byte
+	_, err := r.ReadAt(b[:], 0)
+	return err == nil && binary.BigEndian.Uint32(b[:]) == magic
+}
+
+func open(f *os.File, name string, writable bool) (*Image, error) {
+	h, err := readHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	if h.incompatible&^(incompatDirty|incompatCorrupt) != 0 {
+		return nil, fmt.Errorf("qcow2: unsupported incompatible features 0x%x", h.incompatible)
+	}
+	if writable && h.incompatible&incompatCorrupt != 0 {
+		return nil, errors.New("qcow2: image is marked as corrupt and can only be opened read-only")
+	}
+	if writable && h.incompatible&incompatDirty != 0 {
+		return nil, errors.New("qcow2: image is dirty and needs to be repaired before writing to it")
+	}
+	if writable && h.nbSnapshots != 0 {
+		return nil, errors.New("qcow2: images with internal snapshots can only be opened read-only")
+	}
+	img := &Image{
+		f:        f,
+		h:        h,
+		writable: writable,
+		cs:       1 << h.clusterBits,
+		zoff:     -1,
+	}
+	if img.l1, err = img.readTable(int64(h.l1TableOffset), int64(h.l1Size)); err != nil {
+		return nil, err
+	}
+	if writable {
+		n := int64(h.refcountTableClusters) * img.cs / 8
+		if img.rt, err = img.readTable(int64(h.refcountTableOffset), n); err != nil {
+			return nil, err
+		}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	img.end = (fi.Size() + img.cs - 1) &^ (img.cs - 1)
+
+	if h.backingFile != "" {
+		path := h.backingFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(name), path)
+		}
+		if err := img.openBacking(path); err != nil {
+			return nil, err
+		}
+	}
+	if writable && h.autoclear != 0 {
+		// We do not understand any autoclear features, so we have to clear
+		// them before modifying the image.
+		h.autoclear = 0
+		if _, err := f.WriteAt(make([]byte, 8), 88); err != nil {
+			img.closeBacking()
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// readTable reads a table of n big-endian 64 bit entries at off.
+func (img *Image) readTable(off, n int64) ([]uint64, error) {
+	buf := make([]byte, n*8)
+	if _, err := img.f.ReadAt(buf, off); err != nil {
+		return nil, fmt.Errorf("qcow2: reading table at %d: %w", off, err)
+	}
+	t := make([]uint64, n)
+	for i := range t {
+		t[i] = binary.BigEndian.Uint64(buf[8*i:])
+	}
+	return t, nil
+}
+
+// openBacking opens the backing file at path, read-only.
+func (img *Image) openBacking(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("qcow2: opening backing file: %w", err)
+	}
+	if img.h.backingFormat == "qcow2" || (img.h.backingFormat == "" && IsImage(f)) {
+		b, err := open(f, path, false)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		img.backing, img.backingSize = b, b.Size()
+		return nil
+	}
+	if img.h.backingFormat != "" && img.h.backingFormat != "raw" {
+		f.Close()
+		return fmt.Errorf("qcow2: unsupported backing file format %q", img.h.backingFormat)
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	img.backing, img.backingSize = f, size
+	return nil
+}
+
+func (img *Image) closeBacking() error {
+	if c, ok := img.backing.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Size returns the virtual size of the image.
+func (img *Image) Size() int64 {
+	return int64(img.h.size)
+}
+
+// Close closes the image and its backing files.
+func (img *Image) Close() error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	err := img.f.Close()
+	if e := img.closeBacking(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Sync implements nbd.Device.
+func (img *Image) Sync() error {
+	if !img.writable {
+		return nil
+	}
+	return img.f.Sync()
+}
+
+// check validates the range of length bytes at off for a write.
+func (img *Image) check(off, length int64) error {
+	if !img.writable {
+		return nbd.EPERM
+	}
+	if off < 0 || length < 0 {
+		return nbd.EINVAL
+	}
+	if length > img.Size()-off {
+		return nbd.ENOSPC
+	}
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (img *Image) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, nbd.EINVAL
+	}
+	if off >= img.Size() {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > img.Size()-off {
+		p, err = p[:img.Size()-off], io.EOF
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	for n < len(p) {
+		o := off + int64(n)
+		m := int(min(int64(len(p)-n), img.cs-o%img.cs))
+		e, err := img.entry(o / img.cs)
+		if err != nil {
+			return n, err
+		}
+		if err := img.readCluster(o, e, p[n:n+m]); err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, err
+}
+
+// WriteAt implements io.WriterAt.
+func (img *Image) WriteAt(p []byte, off int64) (n int, err error) {
+	if err := img.check(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	for n < len(p) {
+		o := off + int64(n)
+		m := int(min(int64(len(p)-n), img.cs-o%img.cs))
+		if err := img.writeCluster(o, p[n:n+m]); err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// WriteZeroes implements nbd.ZeroWriter. Whole clusters are marked as zero or
+// deallocated, if punch is set.
+func (img *Image) WriteZeroes(off, length int64, punch bool) error {
+	if err := img.check(off, length); err != nil {
+		return err
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	for length > 0 {
+		m := min(length, img.cs-off%img.cs)
+		var err error
+		if m == img.cs || off+m == img.Size() && off%img.cs == 0 {
+			err = img.zeroCluster(off/img.cs, punch)
+		} else {
+			err = img.zeroPartial(off, m)
+		}
+		if err != nil {
+			return err
+		}
+		off, length = off+m, length-m
+	}
+	return nil
+}
+
+// Trim implements nbd.Trimmer. Whole clusters are deallocated, as long as this
+// does not expose data from the backing file.
+func (img *Image) Trim(off, length int64) error {
+	if err := img.check(off, length); err != nil {
+		return err
+	}
+	if img.h.version < 3 && img.backing != nil {
+		return nil
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	for length > 0 {
+		m := min(length, img.cs-off%img.cs)
+		if m == img.cs || off+m == img.Size() && off%img.cs == 0 {
+			if err := img.zeroCluster(off/img.cs, true); err != nil {
+				return err
+			}
+		}
+		off, length = off+m, length-m
+	}
+	return nil
+}
+
+// maxReportClusters is the number of clusters ReportExtents looks at in a
+// single call.
+const maxReportClusters = 1 << 16
+
+// ReportExtents implements nbd.ExtentReporter.
+func (img *Image) ReportExtents(off, length int64) ([]nbd.Extent, error) {
+	if off < 0 || length < 0 {
+		return nil, nbd.EINVAL
+	}
+	length = min(length, img.Size()-off)
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	var ext []nbd.Extent
+	for i := 0; length > 0 && i < maxReportClusters; i++ {
+		m := min(length, img.cs-off%img.cs)
+		e, err := img.entry(off / img.cs)
+		if err != nil {
+			return nil, err
+		}
+		flags, err := img.status(off, m, e)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(ext); n > 0 && ext[n-1].Flags == flags {
+			ext[n-1].Length += uint64(m)
+		} else {
+			ext = append(ext, nbd.Extent{Offset: uint64(off), Length: uint64(m), Flags: flags})
+		}
+		off, length = off+m, length-m
+	}
+	return ext, nil
+}
+
+// status returns the base:allocation flags of the range of length bytes at
+// off, which must be inside a single cluster described by the L2 entry e.
+func (img *Image) status(off, length int64, e uint64) (uint32, error) {
+	switch {
+	case e&flagCompressed != 0:
+		return 0, nil
+	case img.isZero(e) && e&offsetMask != 0:
+		return nbd.ExtentZero, nil
+	case img.isZero(e):
+		return nbd.ExtentHole | nbd.ExtentZero, nil
+	case e&offsetMask != 0:
+		return 0, nil
+	case img.backing == nil || off >= img.backingSize:
+		return nbd.ExtentHole | nbd.ExtentZero, nil
+	}
+	r, ok := img.backing.(nbd.ExtentReporter)
+	if !ok {
+		return 0, nil
+	}
+	length = min(length, img.backingSize-off)
+	ext, err := r.ReportExtents(off, length)
+	if err != nil {
+		return 0, err
+	}
+	if len(ext) != 1 || ext[0].Length < uint64(length) {
+		return 0, nil
+	}
+	return ext[0].Flags, nil
+}
+
+// isZero returns whether the L2 entry e has the zero flag set.
+func (img *Image) isZero(e uint64) bool {
+	return img.h.version >= 3 && e&flagCompressed == 0 && e&flagZero != 0
+}
+
+// l2Table returns the offset of the L2 table for the cluster with index ci.
+// If alloc is set and the table does not exist yet, it is allocated.
+// Otherwise, 0 is returned for tables which do not exist.
+func (img *Image) l2Table(ci int64, alloc bool) (int64, error) {
+	i := ci / (img.cs / 8)
+	if i >= int64(len(img.l1)) {
+		return 0, fmt.Errorf("qcow2: L1 table too small for cluster %d", ci)
+	}
+	off := int64(img.l1[i] & offsetMask)
+	if off != 0 || !alloc {
+		if off != 0 && alloc && img.l1[i]&flagCopied == 0 {
+			return 0, errors.New("qcow2: writing to shared L2 tables is not supported")
+		}
+		return off, nil
+	}
+	off, err := img.alloc(make([]byte, img.cs))
+	if err != nil {
+		return 0, err
+	}
+	img.l1[i] = uint64(off) | flagCopied
+	return off, img.writeUint64(int64(img.h.l1TableOffset)+i*8, img.l1[i])
+}
+
+// entry returns the L2 entry for the cluster with index ci.
+func (img *Image) entry(ci int64) (uint64, error) {
+	l2, err := img.l2Table(ci, false)
+	if err != nil || l2 == 0 {
+		return 0, err
+	}
+	return img.readUint64(l2 + ci%(img.cs/8)*8)
+}
+
+// setEntry sets the L2 entry for the cluster with index ci, allocating the L2
+// table if needed.
+func (img *Image) setEntry(ci int64, e uint64) error {
+	l2, err := img.l2Table(ci, true)
+	if err != nil {
+		return err
+	}
+	return img.writeUint64(l2+ci%(img.cs/8)*8, e)
+}
+
+// readCluster reads len(p) bytes at off, described by the L2 entry e, into p.
+// The range must be inside a single cluster.
+func (img *Image) readCluster(off int64, e uint64, p []byte) error {
+	in := off % img.cs
+	host := int64(e & offsetMask)
+	switch {
+	case e&flagCompressed != 0:
+		b, err := img.decompress(e)
+		if err != nil {
+			return err
+		}
+		copy(p, b[in:])
+	case img.isZero(e):
+		clear(p)
+	case host != 0:
+		n, err := img.f.ReadAt(p, host+in)
+		if err == io.EOF {
+			// Data clusters may extend past the end of the file.
+			clear(p[n:])
+			err = nil
+		}
+		return err
+	default:
+		return img.readBacking(p, off)
+	}
+	return nil
+}
+
+// readBacking reads p from the backing file at off. Data past its end reads as
+// zeroes.
+func (img *Image) readBacking(p []byte, off int64) error {
+	if img.backing == nil || off >= img.backingSize {
+		clear(p)
+		return nil
+	}
+	n := int(min(int64(len(p)), img.backingSize-off))
+	if _, err := img.backing.ReadAt(p[:n], off); err != nil && err != io.EOF {
+		return err
+	}
+	clear(p[n:])
+	return nil
+}
+
+// compressed returns the host offset and length of the compressed cluster
+// described by the L2 entry e.
+func (img *Image) compressed(e uint64) (off, length int64) {
+	x := 62 - (img.h.clusterBits - 8)
+	off = int64(e & (1<<x - 1))
+	sectors := int64((e>>x)&(1<<(62-x)-1)) + 1
+	return off, sectors*512 - off%512
+}
+
+// decompress returns the contents of the compressed cluster described by the
+// L2 entry e.
+func (img *Image) decompress(e uint64) ([]byte, error) {
+	off, length := img.compressed(e)
+	if off == img.zoff {
+		return img.zbuf, nil
+	}
+	buf := make([]byte, length)
+	n, err := img.f.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	out := make([]byte, img.cs)
+	r := flate.NewReader(bytes.NewReader(buf[:n]))
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, fmt.Errorf("qcow2: decompressing cluster at %d: %w", off, err)
+	}
+	img.zoff, img.zbuf = off, out
+	return out, nil
+}
+
+// writeCluster writes p at off. The range must be inside a single cluster.
+func (img *Image) writeCluster(off int64, p []byte) error {
+	ci, in := off/img.cs, off%img.cs
+	e, err := img.entry(ci)
+	if err != nil {
+		return err
+	}
+	host := int64(e & offsetMask)
+	if e&flagCompressed == 0 && e&flagCopied != 0 && host != 0 {
+		if !img.isZero(e) {
+			_, err := img.f.WriteAt(p, host+in)
+			return err
+		}
+		// A preallocated zero cluster. The rest of it has to read as zero.
+		buf := make([]byte, img.cs)
+		copy(buf[in:], p)
+		if _, err := img.f.WriteAt(buf, host); err != nil {
+			return err
+		}
+		return img.setEntry(ci, uint64(host)|flagCopied)
+	}
+
+	// Copy the cluster to a newly allocated one.
+	buf := make([]byte, img.cs)
+	if int64(len(p)) < img.cs {
+		if err := img.readCluster(ci*img.cs, e, buf); err != nil {
+			return err
+		}
+	}
+	copy(buf[in:], p)
+	host, err = img.alloc(buf)
+	if err != nil {
+		return err
+	}
+	if err := img.setEntry(ci, uint64(host)|flagCopied); err != nil {
+		return err
+	}
+	return img.release(e)
+}
+
+// zeroPartial zeroes the range of length bytes at off, which must be inside a
+// single cluster.
+func (img *Image) zeroPartial(off, length int64) error {
+	e, err := img.entry(off / img.cs)
+	if err != nil {
+		return err
+	}
+	if img.isZero(e) || (e == 0 && img.backing == nil) {
+		return nil
+	}
+	return img.writeCluster(off, make([]byte, length))
+}
+
+// zeroCluster sets the cluster with index ci to zero. If punch is not set,
+// allocated clusters stay allocated.
+func (img *Image) zeroCluster(ci int64, punch bool) error {
+	e, err := img.entry(ci)
+	if err != nil {
+		return err
+	}
+	host := e & offsetMask
+	var ne uint64
+	switch {
+	case img.h.version < 3 && img.backing != nil:
+		return img.writeCluster(ci*img.cs, make([]byte, img.cs))
+	case img.h.version < 3:
+		ne = 0
+	case !punch && e&flagCompressed == 0 && e&flagCopied != 0 && host != 0:
+		ne = host | flagCopied | flagZero
+	case img.backing == nil:
+		ne = 0
+	default:
+		ne = flagZero
+	}
+	if ne == e {
+		return nil
+	}
+	if err := img.setEntry(ci, ne); err != nil {
+		return err
+	}
+	if ne&offsetMask != 0 {
+		return nil
+	}
+	return img.release(e)
+}
+
+// release decrements the refcounts of the clusters referenced by the L2
+// entry e.
+func (img *Image) release(e uint64) error {
+	if e&flagCompressed != 0 {
+		off, length := img.compressed(e)
+		for c := off / img.cs; c <= (off+length-1)/img.cs; c++ {
+			if err := img.decref(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if host := int64(e & offsetMask); host != 0 {
+		return img.decref(host / img.cs)
+	}
+	return nil
+}
+
+// alloc allocates a new cluster at the end of the file and writes buf to it.
+func (img *Image) alloc(buf []byte) (int64, error) {
+	off := img.end
+	img.end += img.cs
+	if _, err := img.f.WriteAt(buf, off); err != nil {
+		return 0, err
+	}
+	return off, img.setRefcount(off/img.cs, 1)
+}
+
+// refcountBlock returns the index of the refcount table entry and the index
+// inside the refcount block, of the refcount for the cluster with index ci.
+func (img *Image) refcountBlock(ci int64) (int64, int64) {
+	n := img.cs * 8 >> img.h.refcountOrder
+	return ci / n, ci % n
+}
+
+// refcount returns the refcount of the cluster with index ci.
+func (img *Image) refcount(ci int64) (uint64, error) {
+	ti, bi := img.refcountBlock(ci)
+	if ti >= int64(len(img.rt)) || img.rt[ti]&offsetMask == 0 {
+		return 0, nil
+	}
+	return img.refcountEntry(int64(img.rt[ti]&offsetMask), bi, 0, false)
+}
+
+// refcountEntry reads the refcount with index bi in the refcount block at
+// off. If set is true, it is set to v, instead.
+func (img *Image) refcountEntry(off, bi int64, v uint64, set bool) (uint64, error) {
+	bits := int64(1) << img.h.refcountOrder
+	var buf [8]byte
+	if bits < 8 {
+		b := buf[:1]
+		pos := off + bi*bits/8
+		shift := bi * bits % 8
+		mask := byte(1<<bits-1) << shift
+		if _, err := img.f.ReadAt(b, pos); err != nil {
+			return 0, err
+		}
+		if !set {
+			return uint64((b[0] & mask) >> shift), nil
+		}
+		b[0] = b[0]&^mask | byte(v<<shift)&mask
+		_, err := img.f.WriteAt(b, pos)
+		return v, err
+	}
+	b := buf[8-bits/8:]
+	pos := off + bi*bits/8
+	if !set {
+		if _, err := img.f.ReadAt(b, pos); err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(buf[:]), nil
+	}
+	binary.BigEndian.PutUint64(buf[:], v)
+	_, err := img.f.WriteAt(b, pos)
+	return v, err
+}
+
+// setRefcount sets the refcount of the cluster with index ci to v, allocating
+// refcount blocks and growing the refcount table as needed.
+func (img *Image) setRefcount(ci int64, v uint64) error {
+	if bits := uint(1) << img.h.refcountOrder; bits < 64 && v >= 1<<bits {
+		return errors.New("qcow2: refcount overflow")
+	}
+	ti, bi := img.refcountBlock(ci)
+	if ti >= int64(len(img.rt)) {
+		if err := img.growRefcountTable(ti + 1); err != nil {
+			return err
+		}
+	}
+	if img.rt[ti]&offsetMask == 0 {
+		off := img.end
+		img.end += img.cs
+		if _, err := img.f.WriteAt(make([]byte, img.cs), off); err != nil {
+			return err
+		}
+		img.rt[ti] = uint64(off)
+		if err := img.writeUint64(int64(img.h.refcountTableOffset)+ti*8, img.rt[ti]); err != nil {
+			return err
+		}
+		if err := img.setRefcount(off/img.cs, 1); err != nil {
+			return err
+		}
+	}
+	_, err := img.refcountEntry(int64(img.rt[ti]&offsetMask), bi, v, true)
+	return err
+}
+
+// decref decrements the refcount of the cluster with index ci.
+func (img *Image) decref(ci int64) error {
+	r, err := img.refcount(ci)
+	if err != nil {
+		return err
+	}
+	if r == 0 {
+		return fmt.Errorf("qcow2: refcount of cluster %d would become negative", ci)
+	}
+	return img.setRefcount(ci, r-1)
+}
+
+// growRefcountTable moves the refcount table to the end of the file, growing
+// it to at least n entries.
+func (img *Image) growRefcountTable(n int64) error {
+	perBlock := img.cs * 8 >> img.h.refcountOrder
+	clusters := int64(img.h.refcountTableClusters)
+	for {
+		clusters *= 2
+		// The new table and the refcount blocks for it have to be
+		// covered as well.
+		need := max(n, (img.end/img.cs+2*clusters)/perBlock+1)
+		if clusters*img.cs/8 >= need {
+			break
+		}
+	}
+	rt := make([]uint64, clusters*img.cs/8)
+	copy(rt, img.rt)
+	buf := make([]byte, clusters*img.cs)
+	for i, e := range rt {
+		binary.BigEndian.PutUint64(buf[8*i:], e)
+	}
+	off := img.end
+	img.end += clusters * img.cs
+	if _, err := img.f.WriteAt(buf, off); err != nil {
+		return err
+	}
+	var hdr [12]byte
+	binary.BigEndian.PutUint64(hdr[:], uint64(off))
+	binary.BigEndian.PutUint32(hdr[8:], uint32(clusters))
+	if _, err := img.f.WriteAt(hdr[:], 48); err != nil {
+		return err
+	}
+	oldOff, oldClusters := int64(img.h.refcountTableOffset), int64(img.h.refcountTableClusters)
+	img.rt = rt
+	img.h.refcountTableOffset, img.h.refcountTableClusters = uint64(off), uint32(clusters)
+	for i := int64(0); i < clusters; i++ {
+		if err := img.setRefcount(off/img.cs+i, 1); err != nil {
+			return err
+		}
+	}
+	for i := int64(0); i < oldClusters; i++ {
+		if err := img.setRefcount(oldOff/img.cs+i, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (img *Image) readUint64(off int64) (uint64, error) {
+	var b [8]byte
+	if _, err := img.f.ReadAt(b[:], off); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+func (img *Image) writeUint64(off int64, v uint64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	_, err := img.f.WriteAt(b[:], off)
+	return err
+}
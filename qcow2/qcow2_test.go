@@ -0,0 +1,307 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Merovius/nbd"
+)
+
+// checkRefcounts verifies, that the refcounts stored in img match the
+// references from the metadata.
+func checkRefcounts(t *testing.T, img *Image) {
+	t.Helper()
+	want := make(map[int64]uint64)
+	ref := func(off, length int64) {
+		for c := off / img.cs; c <= (off+length-1)/img.cs; c++ {
+			want[c]++
+		}
+	}
+	ref(0, img.cs)
+	ref(int64(img.h.refcountTableOffset), int64(img.h.refcountTableClusters)*img.cs)
+	for _, e := range img.rt {
+		if e != 0 {
+			ref(int64(e&offsetMask), img.cs)
+		}
+	}
+	ref(int64(img.h.l1TableOffset), int64(img.h.l1Size)*8)
+	for _, l1e := range img.l1 {
+		l2 := int64(l1e & offsetMask)
+		if l2 == 0 {
+			continue
+		}
+		ref(l2, img.cs)
+		for i := int64(0); i < img.cs/8; i++ {
+			e, err := img.readUint64(l2 + 8*i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e&flagCompressed != 0 {
+				ref(img.compressed(e))
+			} else if host := int64(e & offsetMask); host != 0 {
+				ref(host, img.cs)
+			}
+		}
+	}
+	for c := int64(0); c < img.end/img.cs; c++ {
+		got, err := img.refcount(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want[c] {
+			t.Errorf("refcount of cluster %d is %d, want %d", c, got, want[c])
+		}
+	}
+}
+
+func readAll(t *testing.T, d nbd.Device, size int64) []byte {
+	t.Helper()
+	buf := make([]byte, size)
+	if _, err := d.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestReadWrite(t *testing.T) {
+	const size = 16<<20 + 1000
+	name := filepath.Join(t.TempDir(), "test.qcow2")
+	img, err := Create(name, size, WithClusterSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	rnd := rand.New(rand.NewSource(0))
+	for i := 0; i < 200; i++ {
+		off := rnd.Int63n(size)
+		b := make([]byte, rnd.Int63n(min(size-off, 200000))+1)
+		rnd.Read(b)
+		if _, err := img.WriteAt(b, off); err != nil {
+			t.Fatalf("WriteAt(%d) = %v", off, err)
+		}
+		copy(want[off:], b)
+	}
+	if !bytes.Equal(readAll(t, img, size), want) {
+		t.Error("image has wrong contents")
+	}
+	if img.h.refcountTableClusters == 1 {
+		t.Error("refcount table was not grown")
+	}
+	checkRefcounts(t, img)
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err = Open(name, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if !bytes.Equal(readAll(t, img, size), want) {
+		t.Error("reopened image has wrong contents")
+	}
+	if _, err := img.WriteAt([]byte{1}, 0); err == nil {
+		t.Error("WriteAt on read-only image succeeded")
+	}
+}
+
+func TestBackingFile(t *testing.T) {
+	const size = 1 << 20
+	dir := t.TempDir()
+	base := bytes.Repeat([]byte("base"), size/4)
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), base[:size/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+	mid, err := Create(filepath.Join(dir, "mid.qcow2"), size, WithBackingFile("base.raw"), WithClusterSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mid.WriteAt([]byte("mid"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	mid.Close()
+	img, err := Create(filepath.Join(dir, "top.qcow2"), 0, WithBackingFile("mid.qcow2"), WithClusterSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if img.Size() != size {
+		t.Fatalf("Size() = %d, want %d", img.Size(), size)
+	}
+	if _, err := img.WriteAt([]byte("top"), 100); err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(append([]byte{}, base[:size/2]...), make([]byte, size/2)...)
+	copy(want[5000:], "mid")
+	copy(want[100:], "top")
+	if !bytes.Equal(readAll(t, img, size), want) {
+		t.Error("image has wrong contents")
+	}
+	if err := img.WriteZeroes(8192, 4096, true); err != nil {
+		t.Fatal(err)
+	}
+	clear(want[8192 : 8192+4096])
+	if !bytes.Equal(readAll(t, img, size), want) {
+		t.Error("image has wrong contents after WriteZeroes")
+	}
+
+	ext, err := img.ReportExtents(0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantExt := []nbd.Extent{
+		{Offset: 0, Length: 8192, Flags: 0},
+		{Offset: 8192, Length: 4096, Flags: nbd.ExtentHole | nbd.ExtentZero},
+		{Offset: 12288, Length: size/2 - 12288, Flags: 0},
+		{Offset: size / 2, Length: size / 2, Flags: nbd.ExtentHole | nbd.ExtentZero},
+	}
+	if !reflect.DeepEqual(ext, wantExt) {
+		t.Errorf("ReportExtents() = %v, want %v", ext, wantExt)
+	}
+	checkRefcounts(t, img)
+}
+
+func TestZeroes(t *testing.T) {
+	const size = 1 << 20
+	img, err := Create(filepath.Join(t.TempDir(), "test.qcow2"), size, WithClusterSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	data := bytes.Repeat([]byte{1}, 5*4096)
+	if _, err := img.WriteAt(data, 4096); err != nil {
+		t.Fatal(err)
+	}
+	// Keeps the allocation of the cluster at 8192 and partially zeroes the
+	// one at 4096.
+	if err := img.WriteZeroes(6000, 6288, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Trim(16384, 8192); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	copy(want[4096:6000], data)
+	copy(want[12288:16384], data)
+	if !bytes.Equal(readAll(t, img, size), want) {
+		t.Error("image has wrong contents")
+	}
+	ext, err := img.ReportExtents(0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantExt := []nbd.Extent{
+		{Offset: 0, Length: 4096, Flags: nbd.ExtentHole | nbd.ExtentZero},
+		{Offset: 4096, Length: 4096, Flags: 0},
+		{Offset: 8192, Length: 4096, Flags: nbd.ExtentZero},
+		{Offset: 12288, Length: 4096, Flags: 0},
+		{Offset: 16384, Length: size - 16384, Flags: nbd.ExtentHole | nbd.ExtentZero},
+	}
+	if !reflect.DeepEqual(ext, wantExt) {
+		t.Errorf("ReportExtents() = %v, want %v", ext, wantExt)
+	}
+	checkRefcounts(t, img)
+
+	// Writing to a preallocated zero cluster must not expose old data.
+	if _, err := img.WriteAt([]byte{2}, 9000); err != nil {
+		t.Fatal(err)
+	}
+	want[9000] = 2
+	if !bytes.Equal(readAll(t, img, size), want) {
+		t.Error("image has wrong contents after writing to zero cluster")
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	const size = 1 << 20
+	img, err := Create(filepath.Join(t.TempDir(), "test.qcow2"), size, WithClusterSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	// Write a compressed cluster by hand, like qemu-img convert -c does.
+	data := bytes.Repeat([]byte("compressed"), 410)[:4096]
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(data)
+	w.Close()
+	off := img.end + 100
+	if _, err := img.f.WriteAt(buf.Bytes(), off); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.setRefcount(off/img.cs, 1); err != nil {
+		t.Fatal(err)
+	}
+	img.end += img.cs
+	x := 62 - (img.h.clusterBits - 8)
+	sectors := (off%512 + int64(buf.Len()) + 511) / 512
+	if err := img.setEntry(3, flagCompressed|uint64(sectors-1)<<x|uint64(off)); err != nil {
+		t.Fatal(err)
+	}
+	checkRefcounts(t, img)
+
+	got := make([]byte, 4096)
+	if _, err := img.ReadAt(got, 3*4096); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("compressed cluster has wrong contents")
+	}
+	if _, err := img.WriteAt([]byte("X"), 3*4096+10); err != nil {
+		t.Fatal(err)
+	}
+	data[10] = 'X'
+	if _, err := img.ReadAt(got, 3*4096); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("cluster has wrong contents after overwriting compressed data")
+	}
+	checkRefcounts(t, img)
+}
+
+func TestVersion2(t *testing.T) {
+	const size = 1 << 20
+	name := filepath.Join(t.TempDir(), "test.qcow2")
+	img, err := Create(name, size, WithClusterSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte{1}, 3*4096), 0); err != nil {
+		t.Fatal(err)
+	}
+	// Turn the image into a version 2 image. The version 3 header fields
+	// are then read as an empty list of header extensions.
+	if _, err := img.f.WriteAt(make([]byte, 32), 72); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.f.WriteAt([]byte{0, 0, 0, 2}, 4); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	img, err = Open(name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if err := img.WriteZeroes(4096, 4096, false); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := img.entry(1); e != 0 {
+		t.Errorf("zeroed cluster has L2 entry %x, want 0", e)
+	}
+	want := bytes.Repeat([]byte{1}, 3*4096)
+	clear(want[4096:8192])
+	if got := readAll(t, img, 3*4096); !bytes.Equal(got, want) {
+		t.Error("image has wrong contents")
+	}
+	checkRefcounts(t, img)
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// SnapshotDevice is a Device supporting named point-in-time snapshots, which
+// can be taken while it is in use. Every snapshot adds an in-memory
+// copy-on-write Overlay, so taking one is cheap and only blocks modified
+// afterwards take up memory. The base device is not written to, until the
+// snapshots are committed.
+//
+// SnapshotDevice implements Trimmer, ZeroWriter and ExtentReporter, regardless
+// of whether the base device does.
+type SnapshotDevice struct {
+	mu    sync.RWMutex
+	base  Device
+	size  int64
+	snaps []snapshot
+}
+
+type snapshot struct {
+	name  string
+	layer *Overlay
+}
+
+// NewSnapshotDevice returns a SnapshotDevice of the given size, on top of base.
+func NewSnapshotDevice(base Device, size int64) *SnapshotDevice {
+	return &SnapshotDevice{base: base, size: size}
+}
+
+// below returns the device holding the contents of the i'th snapshot. s.mu
+// must be held.
+func (s *SnapshotDevice) below(i int) Device {
+	if i == 0 {
+		return s.base
+	}
+	return s.snaps[i-1].layer
+}
+
+// top returns the device holding the current contents. s.mu must be held.
+func (s *SnapshotDevice) top() Device {
+	return s.below(len(s.snaps))
+}
+
+func (s *SnapshotDevice) index(name string) int {
+	return slices.IndexFunc(s.snaps, func(sn snapshot) bool { return sn.name == name })
+}
+
+// Snapshots returns the names of all snapshots, from oldest to newest.
+func (s *SnapshotDevice) Snapshots() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var names []string
+	for _, sn := range s.snaps {
+		names = append(names, sn.name)
+	}
+	return names
+}
+
+// Snapshot takes a snapshot of the current contents with the given name,
+// which must be non-empty and unique.
+func (s *SnapshotDevice) Snapshot(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name == "" || s.index(name) >= 0 {
+		return fmt.Errorf("invalid or duplicate snapshot name %q", name)
+	}
+	s.snaps = append(s.snaps, snapshot{name, NewOverlay(s.top(), NewMemDevice(s.size), s.size)})
+	return nil
+}
+
+// Restore rolls the contents back to the snapshot with the given name. Later
+// snapshots are dropped.
+func (s *SnapshotDevice) Restore(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(name)
+	if i < 0 {
+		return fmt.Errorf("no snapshot %q", name)
+	}
+	clear(s.snaps[i+1:])
+	s.snaps = s.snaps[:i+1]
+	s.snaps[i].layer.Discard()
+	return nil
+}
+
+// Commit drops all snapshots, writing the current contents to the base
+// device.
+func (s *SnapshotDevice) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.snaps) > 0 {
+		n := len(s.snaps) - 1
+		if err := s.snaps[n].layer.Commit(); err != nil {
+			return err
+		}
+		s.snaps[n] = snapshot{}
+		s.snaps = s.snaps[:n]
+	}
+	return nil
+}
+
+// View returns a read-only Device with the contents of the snapshot with the
+// given name. Once the snapshot is dropped, all requests to it fail.
+func (s *SnapshotDevice) View(name string) (Device, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.index(name)
+	if i < 0 {
+		return nil, fmt.Errorf("no snapshot %q", name)
+	}
+	return &snapshotView{s, s.snaps[i].layer}, nil
+}
+
+// Exports returns a read-only export for every snapshot, named
+// <name>@<snapshot> and otherwise using the parameters of e. It can be used as
+// the Views of e.
+func (s *SnapshotDevice) Exports(e Export) []Export {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var exps []Export
+	for _, sn := range s.snaps {
+		exps = append(exps, Export{
+			Name:        e.Name + "@" + sn.name,
+			Description: fmt.Sprintf("snapshot %q of %s", sn.name, e.Name),
+			Size:        e.Size,
+			Flags:       e.Flags | FlagReadOnly,
+			BlockSizes:  e.BlockSizes,
+			Device:      &snapshotView{s, sn.layer},
+		})
+	}
+	return exps
+}
+
+// ReadAt implements io.ReaderAt.
+func (s *SnapshotDevice) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.top().ReadAt(p, off)
+}
+
+// WriteAt implements io.WriterAt.
+func (s *SnapshotDevice) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.top().WriteAt(p, off)
+}
+
+// Sync implements Device.
+func (s *SnapshotDevice) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.top().Sync()
+}
+
+// Trim implements Trimmer. If there are no snapshots and the base device is
+// not a Trimmer, it does nothing.
+func (s *SnapshotDevice) Trim(off, length int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return Trim(s.top(), off, length)
+}
+
+// WriteZeroes implements ZeroWriter.
+func (s *SnapshotDevice) WriteZeroes(off, length int64, punch bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return WriteZeroes(s.top(), off, length, punch)
+}
+
+// ReportExtents implements ExtentReporter.
+func (s *SnapshotDevice) ReportExtents(off, length int64) ([]Extent, error) {
+	if off < 0 || length < 0 {
+		return nil, EINVAL
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return deviceExtents(s.top(), off, min(length, s.size-off))
+}
+
+// snapshotView is a read-only view of a snapshot of a SnapshotDevice.
+type snapshotView struct {
+	s     *SnapshotDevice
+	layer *Overlay
+}
+
+// device returns the device holding the contents of the snapshot. v.s.mu must
+// be held.
+func (v *snapshotView) device() (Device, error) {
+	for i, sn := range v.s.snaps {
+		if sn.layer == v.layer {
+			return v.s.below(i), nil
+		}
+	}
+	return nil, Errorf(EIO, "snapshot was dropped")
+}
+
+func (v *snapshotView) ReadAt(p []byte, off int64) (int, error) {
+	v.s.mu.RLock()
+	defer v.s.mu.RUnlock()
+	d, err := v.device()
+	if err != nil {
+		return 0, err
+	}
+	return d.ReadAt(p, off)
+}
+
+func (v *snapshotView) WriteAt(p []byte, off int64) (int, error) {
+	return 0, Errorf(EPERM, "snapshot is read-only")
+}
+
+func (v *snapshotView) Sync() error {
+	return nil
+}
+
+func (v *snapshotView) ReportExtents(off, length int64) ([]Extent, error) {
+	if off < 0 || length < 0 {
+		return nil, EINVAL
+	}
+	v.s.mu.RLock()
+	defer v.s.mu.RUnlock()
+	d, err := v.device()
+	if err != nil {
+		return nil, err
+	}
+	return deviceExtents(d, off, min(length, v.s.size-off))
+}
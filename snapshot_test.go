@@ -0,0 +1,139 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestSnapshotDevice(t *testing.T) {
+	base := NewMemDevice(1 << 20)
+	s := NewSnapshotDevice(base, base.Size())
+
+	read := func(d Device) byte {
+		t.Helper()
+		b := make([]byte, 1)
+		if _, err := d.ReadAt(b, 42); err != nil {
+			t.Fatalf("ReadAt = %v", err)
+		}
+		return b[0]
+	}
+
+	s.WriteAt([]byte{1}, 42)
+	if err := s.Snapshot("one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Snapshot("one"); err == nil {
+		t.Error("Snapshot succeeded with duplicate name")
+	}
+	s.WriteAt([]byte{2}, 42)
+	if err := s.Snapshot("two"); err != nil {
+		t.Fatal(err)
+	}
+	s.WriteAt([]byte{3}, 42)
+
+	one, err := s.View("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := s.View("two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(one); got != 1 {
+		t.Errorf("snapshot one reads %d, want 1", got)
+	}
+	if got := read(two); got != 2 {
+		t.Errorf("snapshot two reads %d, want 2", got)
+	}
+	if got := read(s); got != 3 {
+		t.Errorf("device reads %d, want 3", got)
+	}
+	if got := read(base); got != 1 {
+		t.Errorf("base reads %d, want 1", got)
+	}
+	if _, err := one.WriteAt([]byte{0}, 42); err == nil {
+		t.Error("write to snapshot succeeded")
+	}
+
+	if err := s.Restore("one"); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(s); got != 1 {
+		t.Errorf("device reads %d after restore, want 1", got)
+	}
+	if got, want := s.Snapshots(), []string{"one"}; !slices.Equal(got, want) {
+		t.Errorf("Snapshots() = %q, want %q", got, want)
+	}
+	if _, err := two.ReadAt(make([]byte, 1), 42); err == nil {
+		t.Error("read from dropped snapshot succeeded")
+	}
+
+	s.WriteAt([]byte{4}, 42)
+	if got := read(one); got != 1 {
+		t.Errorf("snapshot one reads %d after restore, want 1", got)
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(base); got != 4 {
+		t.Errorf("base reads %d after commit, want 4", got)
+	}
+	if len(s.Snapshots()) != 0 {
+		t.Errorf("Snapshots() = %q after commit, want none", s.Snapshots())
+	}
+}
+
+func TestServeSnapshots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	base := NewMemDevice(1 << 20)
+	s := NewSnapshotDevice(base, base.Size())
+	exp := Export{Name: "test", Size: uint64(base.Size()), Device: s}
+	exp.Views = func() []Export { return s.Exports(exp) }
+	dial, _ := testServer(t, ctx, exp)
+
+	c, err := Open(ctx, dial, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.WriteAt([]byte("foo"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Snapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WriteAt([]byte("bar"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cl, err := dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ClientHandshake(ctx, cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := client.List()
+	client.Abort()
+	if want := []string{"test", "test@snap"}; err != nil || !slices.Equal(names, want) {
+		t.Errorf("List() = %q, %v, want %q", names, err, want)
+	}
+
+	sc, err := Open(ctx, dial, "test@snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	b := make([]byte, 3)
+	if _, err := sc.ReadAt(b, 0); err != nil || !bytes.Equal(b, []byte("foo")) {
+		t.Errorf("snapshot reads %q, %v, want foo", b, err)
+	}
+	if _, err := sc.WriteAt(b, 0); err == nil {
+		t.Error("write to snapshot export succeeded")
+	}
+}
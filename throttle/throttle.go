@@ -0,0 +1,375 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package throttle provides an nbd.Device emulating a slow disk. It adds
+// latencies drawn from configurable distributions to requests and limits the
+// rate of requests and the bandwidth using token buckets. This is useful to
+// reproduce timeouts and other slow-disk behavior without bad hardware.
+//
+// Latencies can be configured per operation, for example with
+//
+//	throttle.New(d,
+//		throttle.WithLatency(throttle.Read, throttle.LogNormal(2*time.Millisecond, 0.5)),
+//		throttle.WithLatency(throttle.Flush, throttle.LongTail(50*time.Millisecond, 1.5)),
+//		throttle.WithIOPS(200, 0),
+//		throttle.WithBandwidth(10<<20, 0),
+//	)
+//
+// or parsed from a string with ParseLatencies.
+package throttle
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+// Op is an operation latencies can be configured for.
+type Op = nbd.Op
+
+const (
+	// Any configures all operations.
+	Any         = nbd.OpAny
+	Read        = nbd.OpRead
+	Write       = nbd.OpWrite
+	Trim        = nbd.OpTrim
+	WriteZeroes = nbd.OpWriteZeroes
+	Flush       = nbd.OpFlush
+
+	numOps = Flush + 1
+)
+
+// Latency is a distribution of latencies.
+type Latency interface {
+	// Sample returns a random latency, using r.
+	Sample(r *rand.Rand) time.Duration
+}
+
+type fixed time.Duration
+
+// Fixed returns a Latency which is always d.
+func Fixed(d time.Duration) Latency {
+	return fixed(d)
+}
+
+func (l fixed) Sample(*rand.Rand) time.Duration {
+	return time.Duration(l)
+}
+
+type uniform struct {
+	min, max time.Duration
+}
+
+// Uniform returns a Latency distributed uniformly in [min, max).
+func Uniform(min, max time.Duration) Latency {
+	return uniform{min, max}
+}
+
+func (l uniform) Sample(r *rand.Rand) time.Duration {
+	if l.max <= l.min {
+		return l.min
+	}
+	return l.min + time.Duration(r.Int64N(int64(l.max-l.min)))
+}
+
+type logNormal struct {
+	median time.Duration
+	sigma  float64
+}
+
+// LogNormal returns a log-normally distributed Latency with the given median.
+// sigma is the standard deviation of its logarithm, larger values give a
+// wider spread.
+func LogNormal(median time.Duration, sigma float64) Latency {
+	return logNormal{median, sigma}
+}
+
+func (l logNormal) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(float64(l.median) * math.Exp(l.sigma*r.NormFloat64()))
+}
+
+type longTail struct {
+	min   time.Duration
+	alpha float64
+}
+
+// LongTail returns a Latency following a Pareto distribution with the given
+// minimum. Smaller values of alpha give a longer tail: The probability of a
+// latency exceeding k·min is k^-alpha.
+func LongTail(min time.Duration, alpha float64) Latency {
+	return longTail{min, alpha}
+}
+
+func (l longTail) Sample(r *rand.Rand) time.Duration {
+	f := float64(l.min) * math.Pow(1-r.Float64(), -1/l.alpha)
+	return time.Duration(min(f, math.MaxInt64))
+}
+
+// ParseLatency parses a Latency. It is either a fixed duration, like "5ms",
+// or a distribution with parameters, separated by colons:
+//
+//	uniform:<min>:<max>
+//	lognormal:<median>:<sigma>
+//	longtail:<min>:<alpha>
+func ParseLatency(s string) (Latency, error) {
+	f := strings.Split(s, ":")
+	if len(f) == 1 {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid latency %q", s)
+		}
+		return Fixed(d), nil
+	}
+	if len(f) != 3 {
+		return nil, fmt.Errorf("invalid latency %q", s)
+	}
+	d, err := time.ParseDuration(f[1])
+	if err != nil || d < 0 {
+		return nil, fmt.Errorf("invalid latency %q", s)
+	}
+	switch f[0] {
+	case "uniform":
+		max, err := time.ParseDuration(f[2])
+		if err != nil || max < d {
+			return nil, fmt.Errorf("invalid latency %q", s)
+		}
+		return Uniform(d, max), nil
+	case "lognormal", "longtail":
+		v, err := strconv.ParseFloat(f[2], 64)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid latency %q", s)
+		}
+		if f[0] == "lognormal" {
+			return LogNormal(d, v), nil
+		}
+		return LongTail(d, v), nil
+	}
+	return nil, fmt.Errorf("unknown latency distribution %q", f[0])
+}
+
+// ParseLatencies parses a comma-separated list of latencies for operations,
+// like "read=lognormal:2ms:0.5,flush=100ms", and returns an Option setting
+// them. The operations are read, write, trim, zero and flush. Latencies
+// without an operation apply to all operations. Later entries override
+// earlier ones.
+func ParseLatencies(s string) (Option, error) {
+	var opts []Option
+	for _, f := range strings.Split(s, ",") {
+		op := Any
+		if name, l, ok := strings.Cut(f, "="); ok {
+			var err error
+			if op, err = nbd.ParseOp(name); err != nil {
+				return nil, err
+			}
+			f = l
+		}
+		l, err := ParseLatency(f)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithLatency(op, l))
+	}
+	return func(d *Device) {
+		for _, o := range opts {
+			o(d)
+		}
+	}, nil
+}
+
+// bucket is a token bucket. Requests can take more tokens than available, so
+// later requests wait until the debt is paid off.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns a bucket filling at rate tokens per second. It returns nil,
+// meaning no limit, if rate is not positive.
+func newBucket(rate, burst float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = max(rate/10, 1)
+	}
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take takes n tokens and returns how long to wait until they are available.
+func (b *bucket) take(n float64, now time.Time) time.Duration {
+	b.tokens = min(b.burst, b.tokens+b.rate*now.Sub(b.last).Seconds())
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Option is an option for New.
+type Option func(*Device)
+
+// WithLatency adds latencies drawn from l to all requests of the given
+// operation. Writes with FUA get the latency of a write and of a flush.
+func WithLatency(op Op, l Latency) Option {
+	return func(d *Device) {
+		if op == Any {
+			for o := Read; o < numOps; o++ {
+				d.latency[o] = l
+			}
+			return
+		}
+		d.latency[op] = l
+	}
+}
+
+// WithIOPS limits the number of requests per second, excluding flushes, to n.
+// Up to burst requests can be made at once. If burst is 0, it is a tenth of a
+// second's worth of requests. If n is 0 or less, requests are not limited.
+func WithIOPS(n, burst int) Option {
+	return func(d *Device) {
+		d.iops = newBucket(float64(n), float64(burst))
+	}
+}
+
+// WithBandwidth limits the number of bytes read and written per second to n.
+// Up to burst bytes can be transferred at once. If burst is 0, it is a tenth
+// of a second's worth of bytes. If n is 0 or less, bandwidth is not limited.
+func WithBandwidth(n, burst int64) Option {
+	return func(d *Device) {
+		d.bw = newBucket(float64(n), float64(burst))
+	}
+}
+
+// WithSeed sets the seed for sampling latencies.
+func WithSeed(seed uint64) Option {
+	return func(d *Device) {
+		d.rnd = rand.New(rand.NewPCG(seed, 0))
+	}
+}
+
+// Device is an nbd.Device delaying requests to an underlying device. It
+// implements nbd.Trimmer, nbd.ZeroWriter, nbd.FUAWriter and
+// nbd.ExtentReporter, passing requests on to the underlying device, if it
+// supports them.
+type Device struct {
+	d    nbd.Device
+	done chan struct{}
+	once sync.Once
+
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	latency [numOps]Latency
+	iops    *bucket
+	bw      *bucket
+}
+
+// New returns a Device delaying requests to d.
+func New(d nbd.Device, opts ...Option) *Device {
+	t := &Device{
+		d:    d,
+		done: make(chan struct{}),
+		rnd:  rand.New(rand.NewPCG(0, 0)),
+	}
+	for _, o := range opts {
+		o(t)
+	}
+	return t
+}
+
+// Close stops all current and future delays. It does not close the
+// underlying device.
+func (t *Device) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+// delay waits before a request for n bytes with the given operations.
+func (t *Device) delay(n int64, ops ...Op) {
+	now := time.Now()
+	var d time.Duration
+	t.mu.Lock()
+	if t.iops != nil && ops[0] != Flush {
+		d = max(d, t.iops.take(1, now))
+	}
+	if t.bw != nil && (ops[0] == Read || ops[0] == Write) {
+		d = max(d, t.bw.take(float64(n), now))
+	}
+	for _, op := range ops {
+		if l := t.latency[op]; l != nil {
+			d += max(l.Sample(t.rnd), 0)
+		}
+	}
+	t.mu.Unlock()
+	if d <= 0 {
+		return
+	}
+	tm := time.NewTimer(d)
+	select {
+	case <-tm.C:
+	case <-t.done:
+		tm.Stop()
+	}
+}
+
+// ReadAt implements io.ReaderAt.
+func (t *Device) ReadAt(p []byte, off int64) (int, error) {
+	t.delay(int64(len(p)), Read)
+	return t.d.ReadAt(p, off)
+}
+
+// WriteAt implements io.WriterAt.
+func (t *Device) WriteAt(p []byte, off int64) (int, error) {
+	t.delay(int64(len(p)), Write)
+	return t.d.WriteAt(p, off)
+}
+
+// WriteFUA implements nbd.FUAWriter. If the underlying device does not
+// implement it, it is synced after the write.
+func (t *Device) WriteFUA(p []byte, off int64) (int, error) {
+	t.delay(int64(len(p)), Write, Flush)
+	return nbd.WriteFUA(t.d, p, off)
+}
+
+// Sync implements nbd.Device.
+func (t *Device) Sync() error {
+	t.delay(0, Flush)
+	return t.d.Sync()
+}
+
+// Trim implements nbd.Trimmer. It is a no-op, if the underlying device does
+// not implement it.
+func (t *Device) Trim(off, length int64) error {
+	t.delay(0, Trim)
+	return nbd.Trim(t.d, off, length)
+}
+
+// WriteZeroes implements nbd.ZeroWriter.
+func (t *Device) WriteZeroes(off, length int64, punch bool) error {
+	t.delay(0, WriteZeroes)
+	return nbd.WriteZeroes(t.d, off, length, punch)
+}
+
+// ReportExtents implements nbd.ExtentReporter. It is not delayed.
+func (t *Device) ReportExtents(off, length int64) ([]nbd.Extent, error) {
+	return nbd.ReportExtents(t.d, off, length)
+}
@@ -0,0 +1,142 @@
+package throttle
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+func TestParseLatency(t *testing.T) {
+	tcs := []struct {
+		in   string
+		want Latency
+	}{
+		{"5ms", Fixed(5 * time.Millisecond)},
+		{"uniform:1ms:10ms", Uniform(time.Millisecond, 10*time.Millisecond)},
+		{"lognormal:2ms:0.5", LogNormal(2*time.Millisecond, 0.5)},
+		{"longtail:1ms:1.5", LongTail(time.Millisecond, 1.5)},
+		{"", nil},
+		{"-1s", nil},
+		{"uniform:10ms:1ms", nil},
+		{"lognormal:2ms", nil},
+		{"longtail:1ms:0", nil},
+		{"pareto:1ms:1", nil},
+	}
+	for _, tc := range tcs {
+		got, err := ParseLatency(tc.in)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("ParseLatency(%q) = %v, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("ParseLatency(%q) = %v, %v, want %v, <nil>", tc.in, got, err, tc.want)
+		}
+	}
+
+	o, err := ParseLatencies("1ms,flush=100ms,zero=uniform:1s:2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(nbd.NewMemDevice(1), o)
+	want := [numOps]Latency{nil, Fixed(time.Millisecond), Fixed(time.Millisecond), Fixed(time.Millisecond), Uniform(time.Second, 2*time.Second), Fixed(100 * time.Millisecond)}
+	if d.latency != want {
+		t.Errorf("ParseLatencies set %v, want %v", d.latency, want)
+	}
+	if _, err := ParseLatencies("read=1ms,foo=1ms"); err == nil {
+		t.Error("ParseLatencies succeeded with unknown operation")
+	}
+}
+
+func TestDistributions(t *testing.T) {
+	const n = 10001
+	r := rand.New(rand.NewPCG(1, 2))
+	sample := func(l Latency) []time.Duration {
+		s := make([]time.Duration, n)
+		for i := range s {
+			s[i] = l.Sample(r)
+		}
+		slices.Sort(s)
+		return s
+	}
+	ms := time.Millisecond
+
+	if s := sample(Fixed(ms)); s[0] != ms || s[n-1] != ms {
+		t.Errorf("Fixed(1ms) sampled [%v, %v]", s[0], s[n-1])
+	}
+	if s := sample(Uniform(ms, 2*ms)); s[0] < ms || s[n-1] >= 2*ms || s[n/2] < 1400*time.Microsecond || s[n/2] > 1600*time.Microsecond {
+		t.Errorf("Uniform(1ms, 2ms) sampled [%v, %v], median %v", s[0], s[n-1], s[n/2])
+	}
+	if s := sample(LogNormal(10*ms, 0.5)); s[n/2] < 9*ms || s[n/2] > 11*ms || s[n-1] < 30*ms {
+		t.Errorf("LogNormal(10ms, 0.5) sampled median %v, max %v", s[n/2], s[n-1])
+	}
+	// The median of a Pareto distribution is min·2^(1/alpha).
+	if s := sample(LongTail(ms, 1)); s[0] < ms || s[n/2] < 1900*time.Microsecond || s[n/2] > 2100*time.Microsecond || s[n-1] < 100*ms {
+		t.Errorf("LongTail(1ms, 1) sampled min %v, median %v, max %v", s[0], s[n/2], s[n-1])
+	}
+}
+
+func TestDevice(t *testing.T) {
+	mem := nbd.NewMemDevice(1 << 20)
+	b := make([]byte, 4096)
+
+	d := New(mem, WithIOPS(100, 1))
+	start := time.Now()
+	for range 11 {
+		d.ReadAt(b, 0)
+	}
+	if e := time.Since(start); e < 90*time.Millisecond {
+		t.Errorf("11 requests at 100 IOPS took %v, want ≥100ms", e)
+	}
+
+	d = New(mem, WithBandwidth(1<<20, 4096))
+	start = time.Now()
+	for range 26 {
+		d.WriteAt(b, 0)
+	}
+	if e := time.Since(start); e < 90*time.Millisecond {
+		t.Errorf("writing 104KiB at 1MiB/s took %v, want ≥100ms", e)
+	}
+	start = time.Now()
+	d.Sync()
+	d.WriteZeroes(0, 1<<20, false)
+	if e := time.Since(start); e > 50*time.Millisecond {
+		t.Errorf("flush and zero were throttled by bandwidth (took %v)", e)
+	}
+
+	d = New(mem, WithIOPS(100, 1), WithIOPS(0, 0), WithBandwidth(1, 1), WithBandwidth(-1, 0))
+	start = time.Now()
+	for range 11 {
+		d.WriteAt(b, 0)
+	}
+	if e := time.Since(start); e > 50*time.Millisecond {
+		t.Errorf("requests without limits were throttled (took %v)", e)
+	}
+
+	d = New(mem, WithLatency(Flush, Fixed(time.Hour)), WithLatency(Read, Fixed(20*time.Millisecond)))
+	start = time.Now()
+	d.ReadAt(b, 0)
+	if e := time.Since(start); e < 20*time.Millisecond {
+		t.Errorf("read with 20ms latency took %v", e)
+	}
+	done := make(chan error)
+	go func() { done <- d.Sync() }()
+	select {
+	case <-done:
+		t.Fatal("Sync returned before Close")
+	case <-time.After(10 * time.Millisecond):
+	}
+	d.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Sync() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not stop delay")
+	}
+}
@@ -16,6 +16,7 @@ package nbd
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"io"
 	"net"
@@ -42,6 +43,64 @@ type Device interface {
 	Sync() error
 }
 
+// Trimmer is an optional interface for a Device, to discard data which is no
+// longer needed. If a Device implements it, the server supports NBD_CMD_TRIM.
+type Trimmer interface {
+	// Trim discards the range of length bytes at off. Reading the range
+	// afterwards returns unspecified data.
+	Trim(off, length int64) error
+}
+
+// ZeroWriter is an optional interface for a Device, to efficiently write
+// zeroes. If a Device does not implement it, the server serves
+// NBD_CMD_WRITE_ZEROES by writing buffers filled with zeroes.
+type ZeroWriter interface {
+	// WriteZeroes sets the range of length bytes at off to zero. If punch is
+	// true, the range may be deallocated.
+	WriteZeroes(off, length int64, punch bool) error
+}
+
+// FUAWriter is an optional interface for a Device, to write data with forced
+// unit access. If a Device does not implement it, the server serves writes
+// with NBD_CMD_FLAG_FUA by calling WriteAt followed by Sync.
+type FUAWriter interface {
+	// WriteFUA writes p at off, like WriteAt, but returns only after the
+	// data was written to persistent storage.
+	WriteFUA(p []byte, off int64) (int, error)
+}
+
+// BaseAllocation is the name of the metadata context describing which parts of
+// an export are allocated. Extents in this context use the flags ExtentHole and
+// ExtentZero.
+const BaseAllocation = "base:allocation"
+
+// Flags of extents in the base:allocation metadata context.
+const (
+	// ExtentHole is set for extents which are not allocated.
+	ExtentHole = 1 << 0
+	// ExtentZero is set for extents which read as zeroes.
+	ExtentZero = 1 << 1
+)
+
+// Extent is a range of an export, with flags describing its status in a
+// metadata context.
+type Extent struct {
+	Offset uint64
+	Length uint64
+	Flags  uint32
+}
+
+// ExtentReporter is an optional interface for a Device, to report which parts
+// of it are allocated. It is used to serve the base:allocation metadata
+// context. Devices not implementing it are reported as fully allocated.
+type ExtentReporter interface {
+	// ReportExtents returns the extents covering the range of length bytes
+	// at off, using the flags of the base:allocation context. The first
+	// extent must start at off and the extents must be contiguous. They may
+	// end before the end of the range, but must not be empty.
+	ReportExtents(off, length int64) ([]Extent, error)
+}
+
 // ListenAndServe starts listening on the given network/address and serves the
 // given exports, the first of which will serve as the default. It starts a new
 // goroutine for each connection. ListenAndServe only returns when ctx is
@@ -90,7 +149,21 @@ func Serve(ctx context.Context, c net.Conn, exp ...Export) error {
 	if err != nil {
 		return err
 	}
-	return serve(ctx, c, parms)
+	ex := parms.Export
+	if !ex.Ephemeral {
+		return serve(ctx, c, parms)
+	}
+	size := int64(ex.Size)
+	o := NewOverlay(ex.Device, NewMemDevice(size), size)
+	parms.Export.Device = o
+	err = serve(ctx, c, parms)
+	if ex.saveAs == "" {
+		return err
+	}
+	if e := ex.Save(ex.saveAs, o); err == nil {
+		err = e
+	}
+	return err
 }
 
 // serve serves nbd requests for a connection in transmission mode using p. It
@@ -102,65 +175,256 @@ func serve(ctx context.Context, c net.Conn, p connParameters) error {
 		var req request
 		for {
 			if err := req.decode(e); err != nil {
-				respondErr(e, req.handle, err)
+				respondErr(e, req.handle, err, p.Structured && req.typ == cmdRead)
 				continue
 			}
 			switch req.typ {
 			case cmdRead:
-				if req.length == 0 {
-					respondErr(e, req.handle, EINVAL)
+				if req.length == 0 || req.length > maxPayloadSize {
+					respondErr(e, req.handle, EINVAL, p.Structured)
 					continue
 				}
 				buf := make([]byte, req.length)
 				_, err := p.Export.Device.ReadAt(buf, int64(req.offset))
 				if err != nil {
-					respondErr(e, req.handle, err)
+					respondErr(e, req.handle, err, p.Structured)
 					continue
 				}
-				(&simpleReply{0, req.handle, buf, 0}).encode(e)
+				if !p.Structured {
+					(&simpleReply{0, req.handle, buf}).encode(e)
+					continue
+				}
+				data := make([]byte, 8, 8+len(buf))
+				binary.BigEndian.PutUint64(data, req.offset)
+				data = append(data, buf...)
+				(&structuredReply{replyFlagDone, replyTypeOffsetData, req.handle, uint32(len(data)), data}).encode(e)
 			case cmdWrite:
 				if req.length == 0 {
-					respondErr(e, req.handle, EINVAL)
+					respondErr(e, req.handle, EINVAL, false)
+					continue
+				}
+				if err := p.checkModify(req.offset, uint64(req.length)); err != nil {
+					respondErr(e, req.handle, err, false)
+					continue
+				}
+				if err := writeFUA(p.Export.Device, req.data, int64(req.offset), req.flags); err != nil {
+					respondErr(e, req.handle, err, false)
+					continue
+				}
+				(&simpleReply{0, req.handle, nil}).encode(e)
+			case cmdTrim:
+				t, ok := p.Export.Device.(Trimmer)
+				if !ok || req.length == 0 {
+					respondErr(e, req.handle, EINVAL, false)
+					continue
+				}
+				if err := p.checkModify(req.offset, uint64(req.length)); err != nil {
+					respondErr(e, req.handle, err, false)
+					continue
+				}
+				if err := syncFUA(p.Export.Device, t.Trim(int64(req.offset), int64(req.length)), req.flags); err != nil {
+					respondErr(e, req.handle, err, false)
+					continue
+				}
+				(&simpleReply{0, req.handle, nil}).encode(e)
+			case cmdWriteZeroes:
+				if req.length == 0 {
+					respondErr(e, req.handle, EINVAL, false)
+					continue
+				}
+				if err := p.checkModify(req.offset, uint64(req.length)); err != nil {
+					respondErr(e, req.handle, err, false)
 					continue
 				}
-				_, err := p.Export.Device.WriteAt(req.data, int64(req.offset))
+				punch := req.flags&cmdFlagNoHole == 0
+				if err := syncFUA(p.Export.Device, WriteZeroes(p.Export.Device, int64(req.offset), int64(req.length), punch), req.flags); err != nil {
+					respondErr(e, req.handle, err, false)
+					continue
+				}
+				(&simpleReply{0, req.handle, nil}).encode(e)
+			case cmdBlockStatus:
+				if !p.Structured || !p.Allocation || req.length == 0 {
+					respondErr(e, req.handle, EINVAL, p.Structured)
+					continue
+				}
+				ext, err := reportExtents(p.Export, req.offset, uint64(req.length))
 				if err != nil {
-					respondErr(e, req.handle, err)
+					respondErr(e, req.handle, err, true)
 					continue
 				}
-				(&simpleReply{0, req.handle, nil, 0}).encode(e)
+				if req.flags&cmdFlagReqOne != 0 {
+					ext = ext[:1]
+				}
+				data := make([]byte, 4, 4+8*len(ext))
+				binary.BigEndian.PutUint32(data, baseAllocationID)
+				for _, x := range ext {
+					data = binary.BigEndian.AppendUint32(data, uint32(x.Length))
+					data = binary.BigEndian.AppendUint32(data, x.Flags)
+				}
+				(&structuredReply{replyFlagDone, replyTypeBlockStatus, req.handle, uint32(len(data)), data}).encode(e)
 			case cmdDisc:
 				return
 			case cmdFlush:
 				if req.length != 0 || req.offset != 0 {
-					respondErr(e, req.handle, EINVAL)
+					respondErr(e, req.handle, EINVAL, false)
 					continue
 				}
 				err := p.Export.Device.Sync()
 				if err != nil {
-					respondErr(e, req.handle, err)
+					respondErr(e, req.handle, err, false)
 					continue
 				}
-				(&simpleReply{0, req.handle, nil, 0}).encode(e)
+				(&simpleReply{0, req.handle, nil}).encode(e)
 			default:
-				respondErr(e, req.handle, EINVAL)
+				respondErr(e, req.handle, EINVAL, false)
 			}
 		}
 	})
 }
 
-// respondErr writes an error respons to e, based on handle an err.
-func respondErr(e *encoder, handle uint64, err error) {
+// checkModify checks whether the range of length bytes at off of the export
+// may be modified.
+func (p connParameters) checkModify(off, length uint64) error {
+	if p.Export.Flags&FlagReadOnly != 0 {
+		return Errorf(EPERM, "export is read-only")
+	}
+	if off > p.Export.Size || length > p.Export.Size-off {
+		return Errorf(ENOSPC, "range [%d,%d) is beyond the end of the export", off, off+length)
+	}
+	return nil
+}
+
+// WriteZeroes sets the range of length bytes at off of d to zero, using
+// ZeroWriter, if d implements it. Otherwise, it writes buffers filled with
+// zeroes.
+func WriteZeroes(d Device, off, length int64, punch bool) error {
+	if z, ok := d.(ZeroWriter); ok {
+		return z.WriteZeroes(off, length, punch)
+	}
+	buf := make([]byte, min(length, 1<<20))
+	for length > 0 {
+		n := min(length, int64(len(buf)))
+		if _, err := d.WriteAt(buf[:n], off); err != nil {
+			return err
+		}
+		off, length = off+n, length-n
+	}
+	return nil
+}
+
+// WriteFUA writes p at off to d, using FUAWriter, if d implements it.
+// Otherwise, it syncs d after the write.
+func WriteFUA(d Device, p []byte, off int64) (int, error) {
+	if w, ok := d.(FUAWriter); ok {
+		return w.WriteFUA(p, off)
+	}
+	n, err := d.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	return n, d.Sync()
+}
+
+// Trim trims the range of length bytes at off of d, if d implements Trimmer.
+// Otherwise, it does nothing, as trimming is advisory.
+func Trim(d Device, off, length int64) error {
+	if t, ok := d.(Trimmer); ok {
+		return t.Trim(off, length)
+	}
+	return nil
+}
+
+// ReportExtents returns the extents of the range of length bytes at off of d,
+// using ExtentReporter, if d implements it. Otherwise, the range is reported
+// as allocated.
+func ReportExtents(d Device, off, length int64) ([]Extent, error) {
+	if r, ok := d.(ExtentReporter); ok {
+		return r.ReportExtents(off, length)
+	}
+	return []Extent{{Offset: uint64(off), Length: uint64(length)}}, nil
+}
+
+// writeFUA writes p at off to d. If flags has NBD_CMD_FLAG_FUA set, it uses
+// FUAWriter, if d implements it, or syncs d afterwards.
+func writeFUA(d Device, p []byte, off int64, flags uint16) error {
+	if w, ok := d.(FUAWriter); ok && flags&cmdFlagFUA != 0 {
+		_, err := w.WriteFUA(p, off)
+		return err
+	}
+	_, err := d.WriteAt(p, off)
+	return syncFUA(d, err, flags)
+}
+
+// syncFUA syncs d, if err is nil and flags has NBD_CMD_FLAG_FUA set. It
+// returns the first error.
+func syncFUA(d Device, err error, flags uint16) error {
+	if err != nil || flags&cmdFlagFUA == 0 {
+		return err
+	}
+	return d.Sync()
+}
+
+// reportExtents returns the extents of the range of length bytes at off of
+// exp, clipped to the range and the size of the export.
+func reportExtents(exp Export, off, length uint64) ([]Extent, error) {
+	if off >= exp.Size {
+		return nil, EINVAL
+	}
+	if length > exp.Size-off {
+		length = exp.Size - off
+	}
+	r, ok := exp.Device.(ExtentReporter)
+	if !ok {
+		return []Extent{{off, length, 0}}, nil
+	}
+	ext, err := r.ReportExtents(int64(off), int64(length))
+	if err != nil {
+		return nil, err
+	}
+	var out []Extent
+	for _, x := range ext {
+		if x.Offset != off || x.Length == 0 {
+			return nil, Errorf(EIO, "device reported invalid extent %+v at %d", x, off)
+		}
+		if x.Length > length {
+			x.Length = length
+		}
+		out = append(out, x)
+		off, length = off+x.Length, length-x.Length
+		if length == 0 {
+			break
+		}
+	}
+	if len(out) == 0 {
+		return nil, Errorf(EIO, "device reported no extents at %d", off)
+	}
+	return out, nil
+}
+
+// respondErr writes an error respons to e, based on handle an err. If
+// structured is true, a structured reply is used.
+func respondErr(e *encoder, handle uint64, err error, structured bool) {
 	code := EIO
 	if e, ok := err.(Error); ok {
 		code = e.Errno()
 	}
-	rep := simpleReply{
-		errno:  uint32(code),
-		handle: handle,
-		length: 0,
+	if !structured {
+		rep := simpleReply{
+			errno:  uint32(code),
+			handle: handle,
+		}
+		rep.encode(e)
+		return
+	}
+	msg := err.Error()
+	if len(msg) > maxOptionLength {
+		msg = msg[:maxOptionLength]
 	}
-	rep.encode(e)
+	data := make([]byte, 6, 6+len(msg))
+	binary.BigEndian.PutUint32(data, uint32(code))
+	binary.BigEndian.PutUint16(data[4:], uint16(len(msg)))
+	data = append(data, msg...)
+	(&structuredReply{replyFlagDone, replyTypeError, handle, uint32(len(data)), data}).encode(e)
 }
 
 // ctxRW wraps a net.Conn to respect context cancellation. It does so by
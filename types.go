@@ -15,6 +15,7 @@
 package nbd
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"strconv"
@@ -31,6 +32,24 @@ const (
 	flagNoZeroes         = 1 << 1
 	flagDefaults         = flagFixedNewstyle | flagNoZeroes
 	maxOptionLength      = 4 << 10
+	maxPayloadSize       = 4 << 20
+)
+
+// Transmission flags, as sent by the server along with the export size. They
+// can be set in the Flags of an Export.
+const (
+	FlagHasFlags        = 1 << 0
+	FlagReadOnly        = 1 << 1
+	FlagSendFlush       = 1 << 2
+	FlagSendFUA         = 1 << 3
+	FlagRotational      = 1 << 4
+	FlagSendTrim        = 1 << 5
+	FlagSendWriteZeroes = 1 << 6
+	FlagSendDF          = 1 << 7
+	FlagCanMulticonn    = 1 << 8
+	FlagSendResize      = 1 << 9
+	FlagSendCache       = 1 << 10
+	FlagSendFastZero    = 1 << 11
 )
 
 type optionRequest interface {
@@ -61,6 +80,12 @@ func decodeOption(e *encoder) (uint32, interface{}, errno) {
 		o = &optInfo{done: false}
 	case cOptGo:
 		o = &optInfo{done: true}
+	case cOptStructuredReply:
+		o = new(optStructuredReply)
+	case cOptListMetaContext:
+		o = &optMetaContext{set: false}
+	case cOptSetMetaContext:
+		o = &optMetaContext{set: true}
 	}
 	if o == nil {
 		return option, nil, errUnsup
@@ -104,6 +129,19 @@ func (o *optAbort) decode(e *encoder, l uint32) errno {
 	return 0
 }
 
+type optStartTLS struct{}
+
+func (o *optStartTLS) code() uint32 { return cOptStartTLS }
+
+func (o *optStartTLS) encode(e *encoder) {}
+
+func (o *optStartTLS) decode(e *encoder, l uint32) errno {
+	if l != 0 {
+		return errInvalid
+	}
+	return 0
+}
+
 type optList struct{}
 
 func (o *optList) code() uint32 { return cOptList }
@@ -117,6 +155,77 @@ func (o *optList) decode(e *encoder, l uint32) errno {
 
 func (o *optList) encode(e *encoder) {}
 
+type optStructuredReply struct{}
+
+func (o *optStructuredReply) code() uint32 { return cOptStructuredReply }
+
+func (o *optStructuredReply) encode(e *encoder) {}
+
+func (o *optStructuredReply) decode(e *encoder, l uint32) errno {
+	if l != 0 {
+		return errInvalid
+	}
+	return 0
+}
+
+type optMetaContext struct {
+	set     bool
+	name    string
+	queries []string
+}
+
+func (o *optMetaContext) code() uint32 {
+	if o.set {
+		return cOptSetMetaContext
+	}
+	return cOptListMetaContext
+}
+
+func (o *optMetaContext) encode(e *encoder) {
+	e.writeUint32(uint32(len(o.name)))
+	e.writeString(o.name)
+	e.writeUint32(uint32(len(o.queries)))
+	for _, q := range o.queries {
+		e.writeUint32(uint32(len(q)))
+		e.writeString(q)
+	}
+}
+
+func (o *optMetaContext) decode(e *encoder, l uint32) errno {
+	b := make([]byte, l)
+	e.read(b)
+	str := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint32(len(b)) < n {
+			return "", false
+		}
+		s := string(b[:n])
+		b = b[n:]
+		return s, true
+	}
+	var ok bool
+	if o.name, ok = str(); !ok || len(b) < 4 {
+		return errInvalid
+	}
+	n := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	for ; n > 0; n-- {
+		q, ok := str()
+		if !ok {
+			return errInvalid
+		}
+		o.queries = append(o.queries, q)
+	}
+	if len(b) != 0 {
+		return errInvalid
+	}
+	return 0
+}
+
 type optInfo struct {
 	done bool
 	name string
@@ -216,9 +325,10 @@ func encodeReply(e *encoder, option uint32, reply optionReply) {
 }
 
 const (
-	cRepAck    = 1
-	cRepServer = 2
-	cRepInfo   = 3
+	cRepAck         = 1
+	cRepServer      = 2
+	cRepInfo        = 3
+	cRepMetaContext = 4
 )
 
 type repAck struct{}
@@ -260,6 +370,28 @@ func (r *repServer) decode(e *encoder, l uint32) {
 	r.details = string(b[length:])
 }
 
+type repMetaContext struct {
+	id   uint32
+	name string
+}
+
+func (r *repMetaContext) code() uint32 { return cRepMetaContext }
+
+func (r *repMetaContext) encode(e *encoder) {
+	e.writeUint32(r.id)
+	e.writeString(r.name)
+}
+
+func (r *repMetaContext) decode(e *encoder, l uint32) {
+	if l < 4 || l > maxOptionLength {
+		e.check(errors.New("invalid meta context response"))
+	}
+	r.id = e.uint32()
+	b := make([]byte, l-4)
+	e.read(b)
+	r.name = string(b)
+}
+
 const (
 	cInfoExport      = 0
 	cInfoName        = 1
@@ -504,8 +636,10 @@ func (r *request) encode(e *encoder) {
 	e.writeUint16(r.typ)
 	e.writeUint64(r.handle)
 	e.writeUint64(r.offset)
-	e.writeUint32(uint32(len(r.data)))
-	e.write(r.data)
+	e.writeUint32(r.length)
+	if r.typ == cmdWrite {
+		e.write(r.data)
+	}
 }
 
 func (r *request) decode(e *encoder) Error {
@@ -523,7 +657,7 @@ func (r *request) decode(e *encoder) Error {
 	if r.typ != cmdWrite {
 		return nil
 	}
-	if r.length > 4<<20 {
+	if r.length > maxPayloadSize {
 		e.discard(r.length)
 		return EOVERFLOW
 	}
@@ -537,8 +671,6 @@ type simpleReply struct {
 	errno  uint32
 	handle uint64
 	data   []byte
-
-	length uint32
 }
 
 func (r *simpleReply) encode(e *encoder) {
@@ -548,14 +680,14 @@ func (r *simpleReply) encode(e *encoder) {
 	e.write(r.data)
 }
 
-func (r *simpleReply) decode(e *encoder) Error {
+// decode decodes the header of a simple reply. The payload (if any) is not
+// read, as its length depends on the request r is a reply to.
+func (r *simpleReply) decode(e *encoder) {
 	if e.uint32() != simpleReplyMagic {
 		e.check(errors.New("invalid magic for reply"))
 	}
+	r.errno = e.uint32()
 	r.handle = e.uint64()
-	buf := make([]byte, r.length)
-	e.read(buf)
-	return nil
 }
 
 type structuredReply struct {
@@ -575,20 +707,40 @@ func (r *structuredReply) encode(e *encoder) {
 	e.write(r.data)
 }
 
-func (r *structuredReply) decode(e *encoder) Error {
-	if e.uint64() != structuredReplyMagic {
+// decode decodes the header of a structured reply chunk. The payload is not
+// read, as how to decode it depends on the chunk type and the request r is a
+// reply to.
+func (r *structuredReply) decode(e *encoder) {
+	if e.uint32() != structuredReplyMagic {
 		e.check(errors.New("invalid magic for reply"))
 	}
 	r.flags = e.uint16()
 	r.typ = e.uint16()
 	r.handle = e.uint64()
 	r.length = e.uint32()
-	if r.length > 4<<20 {
-		e.discard(r.length)
-		return EOVERFLOW
+}
+
+// OffsetError is returned if the server reports an error at a specific offset
+// of a read request. All data before Offset has been read successfully.
+type OffsetError struct {
+	Code    Errno
+	Offset  uint64
+	Message string
+}
+
+func (e *OffsetError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("at offset %d: %s (%v)", e.Offset, e.Message, e.Code)
 	}
-	buf := make([]byte, r.length)
-	e.read(buf)
-	r.data = buf
-	return nil
+	return fmt.Sprintf("at offset %d: %v", e.Offset, e.Code)
+}
+
+// Errno returns the error number sent by the server.
+func (e *OffsetError) Errno() Errno {
+	return e.Code
+}
+
+// Unwrap returns the error number sent by the server.
+func (e *OffsetError) Unwrap() error {
+	return e.Code
 }
@@ -0,0 +1,233 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultPort is the default TCP port used by NBD servers.
+const DefaultPort = "10809"
+
+// URI is a parsed NBD URI. The format is specified in
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/uri.md
+// and is understood by other NBD tools, like qemu and libnbd.
+//
+// Examples:
+//
+//	nbd://example.com/disk
+//	nbds://example.com:10810/disk?tls-certificates=/etc/pki/nbd
+//	nbd+unix:///disk?socket=/run/nbd.sock
+type URI struct {
+	// TLS is set for the nbds schemes.
+	TLS bool
+	// Host and Port specify the server to connect to over TCP. If Port is
+	// empty, DefaultPort is used.
+	Host string
+	Port string
+	// Socket is the path of a unix domain socket to connect to. If it is set,
+	// Host and Port must be empty.
+	Socket string
+	// Export is the name of the export. The empty string refers to the
+	// default export.
+	Export string
+	// TLSCertificates is a directory containing ca-cert.pem and optionally
+	// client-cert.pem and client-key.pem, in the layout used by qemu.
+	TLSCertificates string
+	// TLSHostname overrides the hostname used to verify the server
+	// certificate.
+	TLSHostname string
+	// TLSSkipVerify disables verification of the server certificate.
+	TLSSkipVerify bool
+}
+
+// ParseURI parses an NBD URI.
+func ParseURI(s string) (*URI, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	var uri URI
+	switch u.Scheme {
+	case "nbd":
+	case "nbds":
+		uri.TLS = true
+	case "nbd+unix":
+	case "nbds+unix":
+		uri.TLS = true
+	case "":
+		return nil, fmt.Errorf("invalid NBD URI %q: missing scheme", s)
+	default:
+		return nil, fmt.Errorf("invalid NBD URI %q: unsupported scheme %q", s, u.Scheme)
+	}
+	if u.Opaque != "" || u.User != nil || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid NBD URI %q", s)
+	}
+	q := u.Query()
+	if strings.HasSuffix(u.Scheme, "+unix") {
+		if u.Host != "" {
+			return nil, fmt.Errorf("invalid NBD URI %q: unix socket URIs must not have a host", s)
+		}
+		if uri.Socket = q.Get("socket"); uri.Socket == "" {
+			return nil, fmt.Errorf("invalid NBD URI %q: missing socket parameter", s)
+		}
+	} else {
+		uri.Host, uri.Port = u.Hostname(), u.Port()
+		if uri.Host == "" {
+			uri.Host = "localhost"
+		}
+	}
+	if u.Path != "" {
+		if u.Path[0] != '/' {
+			return nil, fmt.Errorf("invalid NBD URI %q: invalid path", s)
+		}
+		uri.Export = u.Path[1:]
+	}
+	uri.TLSCertificates = q.Get("tls-certificates")
+	uri.TLSHostname = q.Get("tls-hostname")
+	switch v := q.Get("tls-verify-peer"); v {
+	case "", "true", "1":
+	case "false", "0":
+		uri.TLSSkipVerify = true
+	default:
+		return nil, fmt.Errorf("invalid NBD URI %q: invalid value %q for tls-verify-peer", s, v)
+	}
+	return &uri, nil
+}
+
+// String formats u as an NBD URI.
+func (u *URI) String() string {
+	v := url.URL{
+		Scheme: "nbd",
+		Path:   "/" + u.Export,
+	}
+	if u.TLS {
+		v.Scheme = "nbds"
+	}
+	q := make(url.Values)
+	if u.Socket != "" {
+		v.Scheme += "+unix"
+		q.Set("socket", u.Socket)
+	} else {
+		v.Host = u.Host
+		if strings.Contains(v.Host, ":") {
+			v.Host = "[" + v.Host + "]"
+		}
+		if u.Port != "" {
+			v.Host += ":" + u.Port
+		}
+	}
+	if u.TLSCertificates != "" {
+		q.Set("tls-certificates", u.TLSCertificates)
+	}
+	if u.TLSHostname != "" {
+		q.Set("tls-hostname", u.TLSHostname)
+	}
+	if u.TLSSkipVerify {
+		q.Set("tls-verify-peer", "false")
+	}
+	v.RawQuery = q.Encode()
+	return v.String()
+}
+
+// Network returns the network and address to connect to, as understood by
+// net.Dial.
+func (u *URI) Network() (network, addr string) {
+	if u.Socket != "" {
+		return "unix", u.Socket
+	}
+	port := u.Port
+	if port == "" {
+		port = DefaultPort
+	}
+	return "tcp", net.JoinHostPort(u.Host, port)
+}
+
+// DialContext connects to the server identified by u. It does not perform the
+// handshake.
+func (u *URI) DialContext(ctx context.Context) (net.Conn, error) {
+	network, addr := u.Network()
+	return new(net.Dialer).DialContext(ctx, network, addr)
+}
+
+// TLSConfig returns the TLS configuration specified by u. If u does not use
+// TLS, it returns nil. Verifying the server certificate requires a host name,
+// so for unix sockets, tls-hostname has to be set unless verification is
+// disabled.
+func (u *URI) TLSConfig() (*tls.Config, error) {
+	if !u.TLS {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName:         u.TLSHostname,
+		InsecureSkipVerify: u.TLSSkipVerify,
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Host
+	}
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		return nil, errors.New("no server name to verify the certificate against, set tls-hostname")
+	}
+	if u.TLSCertificates == "" {
+		return cfg, nil
+	}
+	ca, err := os.ReadFile(filepath.Join(u.TLSCertificates, "ca-cert.pem"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", filepath.Join(u.TLSCertificates, "ca-cert.pem"))
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(u.TLSCertificates, "client-cert.pem"),
+		filepath.Join(u.TLSCertificates, "client-key.pem"),
+	)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Dial connects to the export identified by the NBD URI uri, returning a Conn
+// in transmission phase. opts are applied after the options implied by uri.
+func Dial(ctx context.Context, uri string, opts ...ConnOption) (*Conn, error) {
+	u, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := u.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		opts = append([]ConnOption{WithTLS(cfg)}, opts...)
+	}
+	return Open(ctx, u.DialContext, u.Export, opts...)
+}
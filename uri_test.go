@@ -0,0 +1,96 @@
+package nbd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	tcs := []struct {
+		in   string
+		want URI
+		out  string
+	}{
+		{"nbd://example.com", URI{Host: "example.com"}, "nbd://example.com/"},
+		{"nbd://example.com/", URI{Host: "example.com"}, ""},
+		{"nbd://example.com:10810/disk", URI{Host: "example.com", Port: "10810", Export: "disk"}, ""},
+		{"nbd://[::1]:10810/a%20b", URI{Host: "::1", Port: "10810", Export: "a b"}, ""},
+		{"nbd://example.com//abs", URI{Host: "example.com", Export: "/abs"}, ""},
+		{"nbd:///foo", URI{Host: "localhost", Export: "foo"}, "nbd://localhost/foo"},
+		{"nbds://example.com/disk?tls-certificates=%2Fetc%2Fpki", URI{TLS: true, Host: "example.com", Export: "disk", TLSCertificates: "/etc/pki"}, ""},
+		{"nbds://example.com/?tls-hostname=foo&tls-verify-peer=false", URI{TLS: true, Host: "example.com", TLSHostname: "foo", TLSSkipVerify: true}, ""},
+		{"nbd+unix:///disk?socket=%2Frun%2Fnbd.sock", URI{Socket: "/run/nbd.sock", Export: "disk"}, ""},
+		{"nbds+unix:///?socket=nbd.sock", URI{TLS: true, Socket: "nbd.sock"}, ""},
+	}
+	for _, tc := range tcs {
+		got, err := ParseURI(tc.in)
+		if err != nil {
+			t.Errorf("ParseURI(%q) = %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("ParseURI(%q) = %+v, want %+v", tc.in, *got, tc.want)
+		}
+		out := tc.out
+		if out == "" {
+			out = tc.in
+		}
+		if s := got.String(); s != out {
+			t.Errorf("ParseURI(%q).String() = %q, want %q", tc.in, s, out)
+		}
+	}
+
+	for _, in := range []string{
+		"example.com:10809",
+		"http://example.com/",
+		"nbd+unix:///disk",
+		"nbd+unix://example.com/disk?socket=foo",
+		"nbd://user@example.com/",
+		"nbds://example.com/?tls-verify-peer=maybe",
+	} {
+		if u, err := ParseURI(in); err == nil {
+			t.Errorf("ParseURI(%q) = %+v, want error", in, u)
+		}
+	}
+}
+
+func TestURITLSConfig(t *testing.T) {
+	tcs := []struct {
+		in         string
+		serverName string
+		wantErr    bool
+	}{
+		{"nbd://example.com/", "", false},
+		{"nbds://example.com/", "example.com", false},
+		{"nbds://example.com/?tls-hostname=foo", "foo", false},
+		{"nbds+unix:///?socket=nbd.sock&tls-hostname=foo", "foo", false},
+		{"nbds+unix:///?socket=nbd.sock&tls-verify-peer=false", "", false},
+		{"nbds+unix:///?socket=nbd.sock", "", true},
+	}
+	for _, tc := range tcs {
+		u, err := ParseURI(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := u.TLSConfig()
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q.TLSConfig() succeeded, want error", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q.TLSConfig() = %v", tc.in, err)
+			continue
+		}
+		if cfg == nil {
+			if u.TLS {
+				t.Errorf("%q.TLSConfig() = nil", tc.in)
+			}
+			continue
+		}
+		if cfg.ServerName != tc.serverName {
+			t.Errorf("%q.TLSConfig().ServerName = %q, want %q", tc.in, cfg.ServerName, tc.serverName)
+		}
+	}
+}
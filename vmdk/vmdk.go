@@ -0,0 +1,367 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vmdk implements a read-only nbd.Device backed by a VMDK image, as
+// used by VMware.
+//
+// Only single-file images with a sparse extent are supported, i.e. images
+// of the monolithicSparse and streamOptimized types. Delta links (images with
+// a parent) are not supported.
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Merovius/nbd"
+)
+
+const (
+	magic       = 0x564d444b // "KDMV"
+	sectorSize  = 512
+	headerSize  = 512
+	gdAtEnd     = 0xffffffffffffffff
+	gteZero     = 1
+	markerSize  = 12
+	maxGTEs     = 1 << 16
+	maxDescSize = 1 << 20
+)
+
+// flagCompressed is the header flag indicating compressed grains.
+const flagCompressed = 1 << 16
+
+// compressDeflate is the only supported compression algorithm.
+const compressDeflate = 1
+
+// header is the header of a sparse extent.
+type header struct {
+	version           uint32
+	flags             uint32
+	capacity          uint64
+	grainSize         uint64
+	descriptorOffset  uint64
+	descriptorSize    uint64
+	numGTEsPerGT      uint32
+	gdOffset          uint64
+	compressAlgorithm uint16
+}
+
+func readHeader(r io.ReaderAt, off int64) (*header, error) {
+	buf := make([]byte, headerSize)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		if err == io.EOF {
+			err = errors.New("vmdk: file too short")
+		}
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if le.Uint32(buf) != magic {
+		return nil, errors.New("vmdk: not a sparse VMDK extent")
+	}
+	return &header{
+		version:           le.Uint32(buf[4:]),
+		flags:             le.Uint32(buf[8:]),
+		capacity:          le.Uint64(buf[12:]),
+		grainSize:         le.Uint64(buf[20:]),
+		descriptorOffset:  le.Uint64(buf[28:]),
+		descriptorSize:    le.Uint64(buf[36:]),
+		numGTEsPerGT:      le.Uint32(buf[44:]),
+		gdOffset:          le.Uint64(buf[56:]),
+		compressAlgorithm: le.Uint16(buf[77:]),
+	}, nil
+}
+
+// IsImage returns whether r starts with the magic number of a sparse VMDK
+// extent.
+func IsImage(r io.ReaderAt) bool {
+	var b [4]byte
+	_, err := r.ReadAt(b[:], 0)
+	return err == nil && binary.LittleEndian.Uint32(b[:]) == magic
+}
+
+// Image is a read-only VMDK image. It implements nbd.Device and
+// nbd.ExtentReporter. It is safe for concurrent use.
+type Image struct {
+	f          *os.File
+	size       int64
+	grainSize  int64
+	gtEntries  int64
+	compressed bool
+	gd         []uint32
+
+	mu sync.Mutex
+	// The last used grain table.
+	gtIdx int64
+	gt    []uint32
+	// The last decompressed grain.
+	zsec int64
+	zbuf []byte
+}
+
+// Open opens the VMDK image with the given name.
+func Open(name string) (*Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	img, err := open(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func open(f *os.File) (*Image, error) {
+	h, err := readHeader(f, 0)
+	if err != nil {
+		return nil, err
+	}
+	if h.gdOffset == gdAtEnd {
+		// Stream-optimized images have the actual header in a footer,
+		// followed by an end-of-stream marker.
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if h, err = readHeader(f, fi.Size()-2*sectorSize); err != nil {
+			return nil, fmt.Errorf("vmdk: reading footer: %w", err)
+		}
+	}
+	if h.version < 1 || h.version > 3 {
+		return nil, fmt.Errorf("vmdk: unsupported version %d", h.version)
+	}
+	if h.grainSize == 0 || h.grainSize&(h.grainSize-1) != 0 || h.grainSize > 1<<16 {
+		return nil, fmt.Errorf("vmdk: invalid grain size %d", h.grainSize)
+	}
+	if h.numGTEsPerGT == 0 || h.numGTEsPerGT > maxGTEs {
+		return nil, fmt.Errorf("vmdk: invalid number of grain table entries %d", h.numGTEsPerGT)
+	}
+	if h.capacity == 0 || h.capacity > 1<<53 {
+		return nil, fmt.Errorf("vmdk: invalid capacity %d", h.capacity)
+	}
+	compressed := h.flags&flagCompressed != 0
+	if compressed && h.compressAlgorithm != compressDeflate {
+		return nil, fmt.Errorf("vmdk: unsupported compression algorithm %d", h.compressAlgorithm)
+	}
+	if err := checkDescriptor(f, h); err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		f:          f,
+		size:       int64(h.capacity) * sectorSize,
+		grainSize:  int64(h.grainSize) * sectorSize,
+		gtEntries:  int64(h.numGTEsPerGT),
+		compressed: compressed,
+		gtIdx:      -1,
+		zsec:       -1,
+	}
+	grains := (int64(h.capacity) + int64(h.grainSize) - 1) / int64(h.grainSize)
+	n := (grains + img.gtEntries - 1) / img.gtEntries
+	if img.gd, err = img.readTable(int64(h.gdOffset)*sectorSize, n); err != nil {
+		return nil, fmt.Errorf("vmdk: reading grain directory: %w", err)
+	}
+	return img, nil
+}
+
+// checkDescriptor checks the embedded descriptor, if any, for features which
+// are not supported.
+func checkDescriptor(r io.ReaderAt, h *header) error {
+	if h.descriptorOffset == 0 || h.descriptorSize == 0 {
+		return nil
+	}
+	buf := make([]byte, min(h.descriptorSize*sectorSize, maxDescSize))
+	n, err := r.ReadAt(buf, int64(h.descriptorOffset)*sectorSize)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("vmdk: reading descriptor: %w", err)
+	}
+	buf = buf[:n]
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	for _, l := range strings.Split(string(buf), "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(l), "=")
+		if !ok {
+			continue
+		}
+		v = strings.Trim(strings.TrimSpace(v), `"`)
+		switch strings.TrimSpace(k) {
+		case "parentCID":
+			if v != "ffffffff" {
+				return errors.New("vmdk: images with a parent are not supported")
+			}
+		case "createType":
+			if v != "monolithicSparse" && v != "streamOptimized" {
+				return fmt.Errorf("vmdk: unsupported image type %q", v)
+			}
+		}
+	}
+	return nil
+}
+
+// readTable reads a table of n little-endian 32 bit entries at off.
+func (img *Image) readTable(off, n int64) ([]uint32, error) {
+	buf := make([]byte, n*4)
+	if _, err := img.f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	t := make([]uint32, n)
+	for i := range t {
+		t[i] = binary.LittleEndian.Uint32(buf[4*i:])
+	}
+	return t, nil
+}
+
+// Size returns the virtual size of the image.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// Close closes the image.
+func (img *Image) Close() error {
+	return img.f.Close()
+}
+
+// Sync implements nbd.Device. It is a no-op.
+func (img *Image) Sync() error {
+	return nil
+}
+
+// WriteAt implements io.WriterAt. As images are read-only, it always fails
+// with EPERM.
+func (img *Image) WriteAt(p []byte, off int64) (int, error) {
+	return 0, nbd.EPERM
+}
+
+// grain returns the sector of the grain with index g. 0 means, the grain is
+// not allocated and gteZero, that it reads as zero.
+func (img *Image) grain(g int64) (uint32, error) {
+	i := g / img.gtEntries
+	if i >= int64(len(img.gd)) || img.gd[i] == 0 {
+		return 0, nil
+	}
+	if i != img.gtIdx {
+		gt, err := img.readTable(int64(img.gd[i])*sectorSize, img.gtEntries)
+		if err != nil {
+			return 0, fmt.Errorf("vmdk: reading grain table: %w", err)
+		}
+		img.gtIdx, img.gt = i, gt
+	}
+	return img.gt[g%img.gtEntries], nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (img *Image) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, nbd.EINVAL
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > img.size-off {
+		p, err = p[:img.size-off], io.EOF
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	for n < len(p) {
+		o := off + int64(n)
+		in := o % img.grainSize
+		b := p[n:min(len(p), n+int(img.grainSize-in))]
+		sec, err := img.grain(o / img.grainSize)
+		if err != nil {
+			return n, err
+		}
+		switch {
+		case sec == 0 || sec == gteZero:
+			clear(b)
+		case img.compressed:
+			g, err := img.decompress(int64(sec))
+			if err != nil {
+				return n, err
+			}
+			clear(b[copy(b, g[min(in, int64(len(g))):]):])
+		default:
+			if _, err := img.f.ReadAt(b, int64(sec)*sectorSize+in); err != nil {
+				return n, fmt.Errorf("vmdk: reading grain: %w", err)
+			}
+		}
+		n += len(b)
+	}
+	return n, err
+}
+
+// decompress returns the contents of the compressed grain at sector sec.
+func (img *Image) decompress(sec int64) ([]byte, error) {
+	if sec == img.zsec {
+		return img.zbuf, nil
+	}
+	var m [markerSize]byte
+	if _, err := img.f.ReadAt(m[:], sec*sectorSize); err != nil {
+		return nil, fmt.Errorf("vmdk: reading grain marker: %w", err)
+	}
+	size := int64(binary.LittleEndian.Uint32(m[8:]))
+	r, err := zlib.NewReader(io.NewSectionReader(img.f, sec*sectorSize+markerSize, size))
+	if err != nil {
+		return nil, fmt.Errorf("vmdk: decompressing grain: %w", err)
+	}
+	buf := make([]byte, img.grainSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("vmdk: decompressing grain: %w", err)
+	}
+	img.zsec, img.zbuf = sec, buf[:n]
+	return img.zbuf, nil
+}
+
+// maxReportGrains is the number of grains ReportExtents looks at in a single
+// call.
+const maxReportGrains = 1 << 16
+
+// ReportExtents implements nbd.ExtentReporter. Unallocated and zero grains
+// are reported as holes.
+func (img *Image) ReportExtents(off, length int64) ([]nbd.Extent, error) {
+	if off < 0 || length < 0 {
+		return nil, nbd.EINVAL
+	}
+	length = min(length, img.size-off)
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	var ext []nbd.Extent
+	for i := 0; length > 0 && i < maxReportGrains; i++ {
+		m := min(length, img.grainSize-off%img.grainSize)
+		sec, err := img.grain(off / img.grainSize)
+		if err != nil {
+			return nil, err
+		}
+		var flags uint32
+		if sec == 0 || sec == gteZero {
+			flags = nbd.ExtentHole | nbd.ExtentZero
+		}
+		if n := len(ext); n > 0 && ext[n-1].Flags == flags {
+			ext[n-1].Length += uint64(m)
+		} else {
+			ext = append(ext, nbd.Extent{Offset: uint64(off), Length: uint64(m), Flags: flags})
+		}
+		off, length = off+m, length-m
+	}
+	return ext, nil
+}
@@ -0,0 +1,181 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Merovius/nbd"
+)
+
+// writeImage writes data as a VMDK image with grains of 4KiB and 4 entries
+// per grain table. Grains only containing zeroes are not allocated, except
+// for the first one, which is written as a zero grain. If stream is set, a
+// stream-optimized image is written.
+func writeImage(t *testing.T, data []byte, stream bool) string {
+	t.Helper()
+	const (
+		grainSectors = 8
+		grainSize    = grainSectors * sectorSize
+		gtEntries    = 4
+	)
+	var buf bytes.Buffer
+	pad := func() {
+		buf.Write(make([]byte, (sectorSize-buf.Len()%sectorSize)%sectorSize))
+	}
+	sector := func() uint32 {
+		return uint32(buf.Len() / sectorSize)
+	}
+	header := func(gdOffset uint64) {
+		var h [headerSize]byte
+		le := binary.LittleEndian
+		le.PutUint32(h[0:], magic)
+		le.PutUint32(h[4:], 1)
+		le.PutUint64(h[12:], uint64(len(data)/sectorSize))
+		le.PutUint64(h[20:], grainSectors)
+		le.PutUint64(h[28:], 1)
+		le.PutUint64(h[36:], 1)
+		le.PutUint32(h[44:], gtEntries)
+		le.PutUint64(h[56:], gdOffset)
+		copy(h[73:], "\n \r\n")
+		if stream {
+			le.PutUint32(h[8:], flagCompressed|1<<17)
+			le.PutUint16(h[77:], compressDeflate)
+		}
+		buf.Write(h[:])
+	}
+	marker := func(typ uint32) {
+		var m [sectorSize]byte
+		binary.LittleEndian.PutUint32(m[12:], typ)
+		buf.Write(m[:])
+	}
+
+	if stream {
+		header(gdAtEnd)
+	} else {
+		header(2)
+	}
+	desc := make([]byte, sectorSize)
+	copy(desc, "# Disk DescriptorFile\nversion=1\nparentCID=ffffffff\ncreateType=\"monolithicSparse\"\n")
+	buf.Write(desc)
+
+	grains := len(data) / grainSize
+	gts := (grains + gtEntries - 1) / gtEntries
+	gd := make([]uint32, gts)
+	gt := make([]uint32, gts*gtEntries)
+	var gdBuf bytes.Buffer
+	if !stream {
+		// Reserve space for the grain directory and tables.
+		buf.Write(make([]byte, sectorSize*(1+gts)))
+	}
+	for g := 0; g < grains; g++ {
+		b := data[g*grainSize : (g+1)*grainSize]
+		if bytes.Equal(b, make([]byte, grainSize)) {
+			if g == 0 {
+				gt[g] = gteZero
+			}
+			continue
+		}
+		gt[g] = sector()
+		if !stream {
+			buf.Write(b)
+			continue
+		}
+		var z bytes.Buffer
+		w := zlib.NewWriter(&z)
+		w.Write(b)
+		w.Close()
+		var m [markerSize]byte
+		binary.LittleEndian.PutUint64(m[:], uint64(g*grainSectors))
+		binary.LittleEndian.PutUint32(m[8:], uint32(z.Len()))
+		buf.Write(m[:])
+		buf.Write(z.Bytes())
+		pad()
+	}
+	for i := range gd {
+		if stream {
+			marker(1)
+			gd[i] = sector()
+			binary.Write(&buf, binary.LittleEndian, gt[i*gtEntries:(i+1)*gtEntries])
+			pad()
+		} else {
+			gd[i] = uint32(3 + i)
+		}
+	}
+	binary.Write(&gdBuf, binary.LittleEndian, gd)
+	img := buf.Bytes()
+	if stream {
+		marker(2)
+		gdSector := sector()
+		buf.Write(gdBuf.Bytes())
+		pad()
+		marker(3)
+		header(uint64(gdSector))
+		marker(0)
+		img = buf.Bytes()
+	} else {
+		copy(img[2*sectorSize:], gdBuf.Bytes())
+		for i := range gd {
+			b := new(bytes.Buffer)
+			binary.Write(b, binary.LittleEndian, gt[i*gtEntries:(i+1)*gtEntries])
+			copy(img[(3+i)*sectorSize:], b.Bytes())
+		}
+	}
+	name := filepath.Join(t.TempDir(), "test.vmdk")
+	if err := os.WriteFile(name, img, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestImage(t *testing.T) {
+	data := make([]byte, 40*4096)
+	copy(data[4096:], bytes.Repeat([]byte("vmdk"), 2000))
+	copy(data[30*4096+100:], "hello")
+	copy(data[39*4096:], bytes.Repeat([]byte{1}, 4096))
+	wantExt := []nbd.Extent{
+		{Offset: 0, Length: 4096, Flags: nbd.ExtentHole | nbd.ExtentZero},
+		{Offset: 4096, Length: 8192, Flags: 0},
+		{Offset: 12288, Length: 27 * 4096, Flags: nbd.ExtentHole | nbd.ExtentZero},
+		{Offset: 30 * 4096, Length: 4096, Flags: 0},
+		{Offset: 31 * 4096, Length: 8 * 4096, Flags: nbd.ExtentHole | nbd.ExtentZero},
+		{Offset: 39 * 4096, Length: 4096, Flags: 0},
+	}
+
+	for _, stream := range []bool{false, true} {
+		img, err := Open(writeImage(t, data, stream))
+		if err != nil {
+			t.Fatalf("Open(stream=%v) = %v", stream, err)
+		}
+		defer img.Close()
+		if img.Size() != int64(len(data)) {
+			t.Errorf("Size() = %d, want %d", img.Size(), len(data))
+		}
+		got := make([]byte, len(data))
+		if _, err := img.ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("image (stream=%v) has wrong contents", stream)
+		}
+		// Unaligned read across grains.
+		got = got[:5000]
+		if _, err := img.ReadAt(got, 4000); err != nil || !bytes.Equal(got, data[4000:9000]) {
+			t.Errorf("ReadAt(4000) = %v or wrong contents", err)
+		}
+		ext, err := img.ReportExtents(0, int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ext, wantExt) {
+			t.Errorf("ReportExtents(stream=%v) = %v, want %v", stream, ext, wantExt)
+		}
+		if _, err := img.WriteAt([]byte{1}, 0); err == nil {
+			t.Error("WriteAt succeeded")
+		}
+	}
+}
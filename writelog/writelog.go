@@ -0,0 +1,373 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package writelog records all modifications of an nbd.Device to a log, which
+// can be replayed to reconstruct the device at any point. This is the same
+// technique as used by dm-log-writes for testing filesystems.
+//
+// A log starts with a header containing the size of the device, followed by
+// entries. Each entry has a fixed size header, followed by its payload. All
+// integers are little endian.
+//
+//	header: magic "NBDWLOG\x00", version uint32, reserved uint32, size uint64
+//	entry:  type uint8, flags uint8, reserved uint16, payload length uint32,
+//	        offset uint64, length uint64, payload
+//
+// The payload of a write is its data, the payload of a mark is its name.
+package writelog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Merovius/nbd"
+)
+
+const (
+	magic      = "NBDWLOG\x00"
+	version    = 1
+	headerSize = 24
+	entrySize  = 24
+)
+
+// Type is the type of a log entry.
+type Type uint8
+
+const (
+	Write Type = iota + 1
+	Trim
+	WriteZeroes
+	Flush
+	Mark
+)
+
+func (t Type) String() string {
+	switch t {
+	case Write:
+		return "write"
+	case Trim:
+		return "trim"
+	case WriteZeroes:
+		return "write-zeroes"
+	case Flush:
+		return "flush"
+	case Mark:
+		return "mark"
+	}
+	return fmt.Sprintf("Type(%d)", uint8(t))
+}
+
+const (
+	flagFUA   = 1 << 0
+	flagPunch = 1 << 1
+)
+
+// Entry is an entry in a log.
+type Entry struct {
+	Type   Type
+	Offset int64
+	Length int64
+	// Data is the data of a write.
+	Data []byte
+	// Name is the name of a mark.
+	Name string
+	// FUA is set for writes with forced unit access.
+	FUA bool
+	// Punch is set for write zeroes, if the range may be deallocated.
+	Punch bool
+}
+
+func (e Entry) String() string {
+	switch e.Type {
+	case Flush:
+		return "flush"
+	case Mark:
+		return fmt.Sprintf("mark %q", e.Name)
+	}
+	s := fmt.Sprintf("%v [%d,%d)", e.Type, e.Offset, e.Offset+e.Length)
+	if e.FUA {
+		s += " fua"
+	}
+	if e.Punch {
+		s += " punch"
+	}
+	return s
+}
+
+// Device is an nbd.Device logging all modifications of an underlying device.
+// It implements nbd.Trimmer, nbd.ZeroWriter, nbd.FUAWriter and
+// nbd.ExtentReporter, passing requests on to the underlying device, if it
+// supports them.
+//
+// Entries are only logged after they succeeded on the underlying device.
+// Modifications are serialized, so the log has the same order as the
+// underlying device. The log is flushed on every Sync and WriteFUA. If the
+// log is an os.File (or anything else with a Sync method), it is synced as
+// well.
+type Device struct {
+	d nbd.Device
+
+	mu  sync.Mutex
+	w   *bufio.Writer
+	log io.Writer
+	err error
+}
+
+// New returns a Device logging all modifications of d, which has the given
+// size, to w.
+func New(d nbd.Device, size int64, w io.Writer) (*Device, error) {
+	h := make([]byte, headerSize)
+	copy(h, magic)
+	binary.LittleEndian.PutUint32(h[8:], version)
+	binary.LittleEndian.PutUint64(h[16:], uint64(size))
+	bw := bufio.NewWriterSize(w, 1<<20)
+	if _, err := bw.Write(h); err != nil {
+		return nil, err
+	}
+	return &Device{d: d, w: bw, log: w}, nil
+}
+
+// do calls f to apply e to the underlying device and logs it, if it
+// succeeds. If flush is true, the log is flushed and synced. The lock is held
+// during both, so entries are logged in the order they are applied.
+func (l *Device) do(e Entry, flush bool, f func() error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	if f != nil {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	var flags uint8
+	if e.FUA {
+		flags |= flagFUA
+	}
+	if e.Punch {
+		flags |= flagPunch
+	}
+	payload := e.Data
+	if e.Type == Mark {
+		payload = []byte(e.Name)
+	}
+	h := make([]byte, entrySize)
+	h[0], h[1] = uint8(e.Type), flags
+	binary.LittleEndian.PutUint32(h[4:], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(h[8:], uint64(e.Offset))
+	binary.LittleEndian.PutUint64(h[16:], uint64(e.Length))
+	if _, l.err = l.w.Write(h); l.err == nil {
+		_, l.err = l.w.Write(payload)
+	}
+	if l.err == nil && flush {
+		l.err = l.flush()
+	}
+	if l.err != nil {
+		l.err = fmt.Errorf("writing log: %w", l.err)
+	}
+	return l.err
+}
+
+func (l *Device) flush() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if s, ok := l.log.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (l *Device) ReadAt(p []byte, off int64) (int, error) {
+	return l.d.ReadAt(p, off)
+}
+
+// WriteAt implements io.WriterAt.
+func (l *Device) WriteAt(p []byte, off int64) (n int, err error) {
+	err = l.do(Entry{Type: Write, Offset: off, Length: int64(len(p)), Data: p}, false, func() error {
+		n, err = l.d.WriteAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+// WriteFUA implements nbd.FUAWriter.
+func (l *Device) WriteFUA(p []byte, off int64) (n int, err error) {
+	err = l.do(Entry{Type: Write, Offset: off, Length: int64(len(p)), Data: p, FUA: true}, true, func() error {
+		n, err = nbd.WriteFUA(l.d, p, off)
+		return err
+	})
+	return n, err
+}
+
+// Trim implements nbd.Trimmer. It is a no-op, if the underlying device does
+// not support trimming, but is logged anyways.
+func (l *Device) Trim(off, length int64) error {
+	return l.do(Entry{Type: Trim, Offset: off, Length: length}, false, func() error {
+		return nbd.Trim(l.d, off, length)
+	})
+}
+
+// WriteZeroes implements nbd.ZeroWriter.
+func (l *Device) WriteZeroes(off, length int64, punch bool) error {
+	return l.do(Entry{Type: WriteZeroes, Offset: off, Length: length, Punch: punch}, false, func() error {
+		return nbd.WriteZeroes(l.d, off, length, punch)
+	})
+}
+
+// Sync implements nbd.Device.
+func (l *Device) Sync() error {
+	return l.do(Entry{Type: Flush}, true, l.d.Sync)
+}
+
+// ReportExtents implements nbd.ExtentReporter.
+func (l *Device) ReportExtents(off, length int64) ([]nbd.Extent, error) {
+	return nbd.ReportExtents(l.d, off, length)
+}
+
+// Mark adds a mark with the given name to the log, which can be used as a
+// point to replay the log to.
+func (l *Device) Mark(name string) error {
+	return l.do(Entry{Type: Mark, Name: name}, true, nil)
+}
+
+// Close flushes the log. It does not close the underlying device.
+func (l *Device) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	return l.flush()
+}
+
+// Reader reads a log.
+type Reader struct {
+	r    *bufio.Reader
+	size int64
+}
+
+// NewReader reads the header of a log from r and returns a Reader for its
+// entries.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	h := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, h); err != nil {
+		return nil, fmt.Errorf("reading log header: %w", err)
+	}
+	if string(h[:8]) != magic {
+		return nil, errors.New("not a write log")
+	}
+	if v := binary.LittleEndian.Uint32(h[8:]); v != version {
+		return nil, fmt.Errorf("unsupported write log version %d", v)
+	}
+	return &Reader{r: br, size: int64(binary.LittleEndian.Uint64(h[16:]))}, nil
+}
+
+// Size returns the size of the logged device.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// maxPayload is the maximum size of the payload of an entry.
+const maxPayload = 1 << 30
+
+// Next returns the next entry. At the end of the log, it returns io.EOF. A
+// truncated entry at the end of the log, as left by a crash, is reported as
+// io.ErrUnexpectedEOF.
+func (r *Reader) Next() (Entry, error) {
+	h := make([]byte, entrySize)
+	if _, err := io.ReadFull(r.r, h); err != nil {
+		return Entry{}, err
+	}
+	e := Entry{
+		Type:   Type(h[0]),
+		FUA:    h[1]&flagFUA != 0,
+		Punch:  h[1]&flagPunch != 0,
+		Offset: int64(binary.LittleEndian.Uint64(h[8:])),
+		Length: int64(binary.LittleEndian.Uint64(h[16:])),
+	}
+	if e.Type < Write || e.Type > Mark {
+		return Entry{}, fmt.Errorf("invalid log entry type %d", h[0])
+	}
+	n := binary.LittleEndian.Uint32(h[4:])
+	if n > maxPayload {
+		return Entry{}, fmt.Errorf("invalid log entry payload length %d", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Entry{}, err
+	}
+	if e.Type == Mark {
+		e.Name = string(payload)
+	} else {
+		e.Data = payload
+	}
+	return e, nil
+}
+
+// Apply applies e to d. Trims are applied as write zeroes, so the result
+// is deterministic.
+func (e Entry) Apply(d nbd.Device) error {
+	switch e.Type {
+	case Write:
+		_, err := d.WriteAt(e.Data, e.Offset)
+		return err
+	case Trim:
+		return nbd.WriteZeroes(d, e.Offset, e.Length, true)
+	case WriteZeroes:
+		return nbd.WriteZeroes(d, e.Offset, e.Length, e.Punch)
+	case Flush:
+		return d.Sync()
+	}
+	return nil
+}
+
+// ErrNoMark is returned by Replay, if the mark to replay to is not in the log.
+var ErrNoMark = errors.New("mark not found in log")
+
+// Replay applies the entries of the log read by r to d. If until is not
+// empty, it stops after the mark with that name. If n is not negative, it
+// stops after n entries. It returns the number of entries applied.
+func Replay(d nbd.Device, r *Reader, until string, n int) (int, error) {
+	i := 0
+	for ; n < 0 || i < n; i++ {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return i, err
+		}
+		if err := e.Apply(d); err != nil {
+			return i, fmt.Errorf("applying entry %d (%v): %w", i, e, err)
+		}
+		if until != "" && e.Type == Mark && e.Name == until {
+			return i + 1, d.Sync()
+		}
+	}
+	if until != "" {
+		return i, ErrNoMark
+	}
+	return i, d.Sync()
+}
@@ -0,0 +1,160 @@
+package writelog
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/Merovius/nbd"
+)
+
+func contents(t *testing.T, d nbd.Device, size int64) []byte {
+	t.Helper()
+	b := make([]byte, size)
+	if _, err := d.ReadAt(b, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestReplay(t *testing.T) {
+	const size = 1 << 16
+	var buf bytes.Buffer
+	d, err := New(nbd.NewMemDevice(size), size, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.WriteAt(bytes.Repeat([]byte{1}, 8192), 0)
+	d.Sync()
+	if err := d.Mark("first"); err != nil {
+		t.Fatal(err)
+	}
+	first := contents(t, d, size)
+	d.WriteFUA([]byte("hello"), 100)
+	d.WriteZeroes(4096, 4096, true)
+	d.Trim(0, 50)
+	d.Mark("second")
+	second := contents(t, d, size)
+	d.WriteAt([]byte("end"), 200)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	final := contents(t, d, size)
+	log := buf.Bytes()
+
+	replay := func(until string, n int) ([]byte, int, error) {
+		t.Helper()
+		r, err := NewReader(bytes.NewReader(log))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Size() != size {
+			t.Fatalf("Size() = %d, want %d", r.Size(), size)
+		}
+		m := nbd.NewMemDevice(size)
+		n, err = Replay(m, r, until, n)
+		return contents(t, m, size), n, err
+	}
+	for _, tc := range []struct {
+		until string
+		want  []byte
+		n     int
+	}{
+		{"first", first, 3},
+		{"second", second, 7},
+		{"", final, 8},
+	} {
+		got, n, err := replay(tc.until, -1)
+		if err != nil {
+			t.Errorf("Replay(%q) = %v", tc.until, err)
+		}
+		if n != tc.n {
+			t.Errorf("Replay(%q) applied %d entries, want %d", tc.until, n, tc.n)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("Replay(%q) returned different contents", tc.until)
+		}
+	}
+	if got, _, err := replay("", 3); err != nil || !bytes.Equal(got, first) {
+		t.Errorf("Replay of 3 entries = %v, or returned different contents", err)
+	}
+	if _, _, err := replay("third", -1); err != ErrNoMark {
+		t.Errorf("Replay to missing mark = %v, want %v", err, ErrNoMark)
+	}
+
+	r, _ := NewReader(bytes.NewReader(log))
+	var types []Type
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, e.Type)
+		if e.Type == Write && e.Offset == 100 && !e.FUA {
+			t.Error("FUA write is not marked as FUA")
+		}
+	}
+	want := []Type{Write, Flush, Mark, Write, WriteZeroes, Trim, Mark, Write}
+	if !slices.Equal(types, want) {
+		t.Errorf("log contains %v, want %v", types, want)
+	}
+
+	r, _ = NewReader(bytes.NewReader(log[:len(log)-1]))
+	for err == nil {
+		_, err = r.Next()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("reading truncated log = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := NewReader(bytes.NewReader(make([]byte, 100))); err == nil {
+		t.Error("NewReader succeeded on invalid log")
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	const size = 1 << 16
+	var buf bytes.Buffer
+	live := nbd.NewMemDevice(size)
+	d, err := New(live, size, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := bytes.Repeat([]byte{byte(i + 1)}, 4096)
+			for j := range 100 {
+				d.WriteAt(p, int64(j%4)*1000)
+				if j%10 == 0 {
+					d.WriteZeroes(int64(j%3)*1500, 3000, false)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := nbd.NewMemDevice(size)
+	if _, err := Replay(replayed, r, "", -1); err != nil {
+		t.Fatal(err)
+	}
+	want, got := make([]byte, size), make([]byte, size)
+	live.ReadAt(want, 0)
+	replayed.ReadAt(got, 0)
+	if !bytes.Equal(got, want) {
+		t.Error("replayed log differs from device")
+	}
+}